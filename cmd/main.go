@@ -3,17 +3,27 @@ package main
 import (
 	"context"
 	"errors"
+	"github.com/bennerv/provisioning-api/pkg/api/audit"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
 	"github.com/bennerv/provisioning-api/pkg/api/handlers"
+	"github.com/bennerv/provisioning-api/pkg/api/k8sprobes"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/bennerv/provisioning-api/pkg/api/provisioner"
+	"github.com/bennerv/provisioning-api/pkg/api/tracing"
+	"github.com/bennerv/provisioning-api/pkg/api/webhook"
 	"github.com/bennerv/provisioning-api/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 // @title Swagger Kubernetes Provisioning API
@@ -26,63 +36,270 @@ import (
 // @BasePath /v1
 func main() {
 	if err := run(); err != nil {
-		log.Println("shutting down", "error:", err)
+		logging.Root().WithError(err).Error("shutting down")
 		os.Exit(1)
 	}
 }
 
 // Initializes the kubernetes go-client for an in cluster configuration using a service token
-func initInClusterConfig() (*kubernetes.Clientset, error) {
-	clusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return &kubernetes.Clientset{}, err
+func initInClusterConfig() (*rest.Config, error) {
+	return rest.InClusterConfig()
+}
+
+// Initializes the kubernetes go-client for an out of cluster configuration from a kubeconfig file, located at
+// $HOME/.kube/config when no file is given
+func initOutClusterConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		kubeconfig = filepath.Join(
+			os.Getenv("HOME"), ".kube", "config",
+		)
 	}
-	// creates the clientset
-	return kubernetes.NewForConfig(clusterConfig)
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
 }
 
-// Attempt to find a kubeconfig file located at $HOME/.kube/config
-// Initializes the kubernetes go-client for an out of cluster configuration
-func initOutClusterConfig() (*kubernetes.Clientset, error) {
-	kubeconfig := filepath.Join(
-		os.Getenv("HOME"), ".kube", "config",
-	)
-	clusterConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// Creates the clientset and the dynamic client used for the SaaSInstance custom resource.  A kubeconfig file given in
+// the configuration is used over the in cluster configuration
+func initKubernetesClient(kubeconfig string) (*kubernetes.Clientset, dynamic.Interface, error) {
+	var clusterConfig *rest.Config
+	var err error
+	if kubeconfig != "" {
+		clusterConfig, err = initOutClusterConfig(kubeconfig)
+	} else if clusterConfig, err = initInClusterConfig(); err != nil {
+		clusterConfig, err = initOutClusterConfig("")
+	}
 	if err != nil {
-		return &kubernetes.Clientset{}, err
+		return nil, nil, err
+	}
+
+	// Calls made for traced work, such as provisioning a tenant, get a span of their own
+	clusterConfig.Wrap(tracing.Transport)
+
+	clientset, err := kubernetes.NewForConfig(clusterConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(clusterConfig)
+	return clientset, dynamicClient, err
+}
+
+// Chain together every configured way of authenticating API callers
+func initAuthenticator(cfg *config.Config, clientset kubernetes.Interface) (auth.Authenticator, error) {
+	var chain auth.Chain
+
+	if cfg.Auth.APIKeysFile != "" {
+		apiKeys, err := auth.LoadAPIKeys(cfg.Auth.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, apiKeys)
+	}
+
+	if cfg.Auth.JWKSFile != "" {
+		jwt, err := auth.LoadJWKS(cfg.Auth.JWKSFile, auth.JWTOptions{
+			Issuer:    cfg.Auth.JWTIssuer,
+			Audience:  cfg.Auth.JWTAudience,
+			RoleClaim: cfg.Auth.JWTRoleClaim,
+			Leeway:    time.Minute,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, jwt)
+	}
+
+	if cfg.Auth.TokenReview {
+		tokenReview, err := auth.NewTokenReviewAuthenticator(clientset.AuthenticationV1().TokenReviews(), cfg.Auth.GroupRoles, cfg.Auth.TokenReviewAudiences, cfg.Auth.TokenReviewRejectedTTL)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokenReview)
 	}
 
-	return kubernetes.NewForConfig(clusterConfig)
+	if len(chain) == 0 {
+		return nil, errors.New("no authentication method configured")
+	}
+	return chain, nil
 }
 
-func initKubernetesClient() (*kubernetes.Clientset, error) {
-	clientset, err := initInClusterConfig()
+// Load the settings of the controller and the webhook subscriptions named by the configuration
+func loadSettings(cfg *config.Config) (provisioner.Settings, []webhook.Subscription, error) {
+	bp, err := provisioner.LoadBlueprint(cfg.Blueprint.Dir)
+	if err != nil {
+		return provisioner.Settings{}, nil, err
+	}
+
+	releases, err := provisioner.LoadReleases(cfg.Releases.File, provisioner.ComponentImages{
+		PostgreSQL: cfg.Releases.Images.PostgreSQL,
+		Backend:    cfg.Releases.Images.Backend,
+		Frontend:   cfg.Releases.Images.Frontend,
+	})
 	if err != nil {
-		clientset, err = initOutClusterConfig()
+		return provisioner.Settings{}, nil, err
 	}
-	return clientset, err
+
+	failurePolicy, err := provisioner.ParseFailurePolicy(cfg.Controller.FailurePolicy)
+	if err != nil {
+		return provisioner.Settings{}, nil, err
+	}
+
+	subscriptions, err := webhook.LoadSubscriptions(cfg.Webhooks.File)
+	if err != nil {
+		return provisioner.Settings{}, nil, err
+	}
+
+	return provisioner.Settings{
+		Blueprint: bp,
+		Tenants: provisioner.TenantSettings{
+			Domain:    cfg.Tenants.Domain,
+			Storage:   cfg.Tenants.Storage,
+			Resources: componentResources(cfg),
+		},
+		Releases: releases,
+		Retry: provisioner.RetryPolicy{
+			OnFailure:   failurePolicy,
+			MaxAttempts: cfg.Controller.MaxAttempts,
+			Backoff:     cfg.Controller.RetryBackoff,
+		},
+		Readiness: provisioner.ReadinessTimeouts{
+			Default:    cfg.Controller.ReadinessTimeout,
+			Components: cfg.Controller.ComponentReadinessTimeouts,
+		},
+		Jobs: provisioner.JobLimits{
+			Workers:        cfg.Controller.ProvisionWorkers,
+			QueueSize:      cfg.Controller.QueueSize,
+			QueuedPerOwner: cfg.Controller.QueuedPerOwner,
+		},
+	}, subscriptions, nil
+}
+
+// Requests and limits of the containers of each component, from the quantities set for them in the configuration.  The
+// quantities were checked when the configuration was loaded
+func componentResources(cfg *config.Config) map[string]corev1.ResourceRequirements {
+	resources := map[string]corev1.ResourceRequirements{}
+	add := func(quantities map[string]string, name corev1.ResourceName, limit bool) {
+		for component, quantity := range quantities {
+			requirements := resources[component]
+			list := &requirements.Requests
+			if limit {
+				list = &requirements.Limits
+			}
+			if *list == nil {
+				*list = corev1.ResourceList{}
+			}
+			(*list)[name] = resource.MustParse(quantity)
+			resources[component] = requirements
+		}
+	}
+	add(cfg.Tenants.CPURequests, corev1.ResourceCPU, false)
+	add(cfg.Tenants.MemoryRequests, corev1.ResourceMemory, false)
+	add(cfg.Tenants.CPULimits, corev1.ResourceCPU, true)
+	add(cfg.Tenants.MemoryLimits, corev1.ResourceMemory, true)
+	return resources
 }
 
 func run() error {
 
+	// Configuration, from the defaults, a file, the environment and flags
+	cfg, printConfig, err := config.Load(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if printConfig {
+		return config.Print(os.Stdout, cfg)
+	}
+
 	// initialize the logger
-	logger := log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	if err := logging.SetLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+	logger := logging.Root()
+
+	if err := audit.OpenFile(cfg.Audit.Path); err != nil {
+		return err
+	}
 
-	//todo Read config via a file or environment variables
-	// Configuration
-	cfg := config.GetConfig()
+	stopTracing, err := tracing.Setup(tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		File:        cfg.Tracing.File,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	// Spans still waiting are exported once the API and the controller have stopped
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			logger.WithError(err).Warn("main : failed to export the remaining spans")
+		}
+	}()
 
-	clientSet, err := initKubernetesClient()
+	clientSet, dynamicClient, err := initKubernetesClient(cfg.Kubernetes.Kubeconfig)
 	if err != nil {
 		panic(err.Error())
 	}
 
+	settings, subscriptions, err := loadSettings(cfg)
+	if err != nil {
+		return err
+	}
+	webhooks := webhook.NewDispatcher(subscriptions, webhook.Options{
+		Workers:     cfg.Webhooks.Workers,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		Backoff:     cfg.Webhooks.Backoff,
+	})
+
+	// Start the SaaSInstance controller.  Tenants which were being provisioned when the provisioner last stopped are
+	// picked up again once its caches have synced
+	controllerCtx, stopController := context.WithCancel(context.Background())
+	defer stopController()
+
+	webhooks.Start(controllerCtx)
+	controller := provisioner.NewController(controllerCtx, clientSet, dynamicClient, settings, webhooks, cfg.Auth.LegacyOwnerMethod, cfg.Controller.ResyncPeriod)
+	go func() {
+		if err := controller.Run(cfg.Controller.Workers); err != nil {
+			logger.WithError(err).Error("main : controller stopped")
+		}
+	}()
+
+	// Changes to the configuration, and to the files it names, are applied without a restart.  Everything is loaded and
+	// checked before anything is replaced, so a bad change leaves the last good configuration running
+	watcher := config.NewWatcher(os.Args[1:], cfg, func(cfg *config.Config) error {
+		settings, subscriptions, err := loadSettings(cfg)
+		if err != nil {
+			return err
+		}
+		if err := controller.Reconfigure(settings); err != nil {
+			return err
+		}
+		webhooks.SetSubscriptions(subscriptions)
+		// The level was checked when the configuration was loaded
+		return logging.SetLevel(cfg.Log.Level)
+	}, handlers.ConfigReloaded)
+	go watcher.Run(controllerCtx)
+
+	authenticator, err := initAuthenticator(cfg, clientSet)
+	if err != nil {
+		return err
+	}
+
+	// The provisioner is ready once it can reach the API server with the permissions it needs and its caches have
+	// synced, and alive while its workers are not stuck
+	prober := k8sprobes.NewProber(cfg.Probes.Timeout)
+	prober.Readiness("apiserver", k8sprobes.APIServer(clientSet))
+	prober.Readiness("permissions", k8sprobes.Cached(cfg.Probes.PermissionsInterval, k8sprobes.Permissions(clientSet, provisioner.RequiredPermissions())))
+	prober.Readiness("informers", controller.CheckSynced)
+	prober.Liveness("workers", controller.CheckWorkers)
+
 	// Get all the routes out
-	routeHandler := handlers.Routes(clientSet)
+	routeHandler := handlers.Routes(cfg, clientSet, controller, authenticator, prober, watcher)
 
 	// App Starting
-	logger.Println("main: started")
-	defer logger.Println("main: completed")
+	logger.Info("main : started")
+	defer logger.Info("main : completed")
 
 	// Create the HTTP server
 	api := http.Server{
@@ -90,6 +307,8 @@ func run() error {
 		Handler:      routeHandler,
 		ReadTimeout:  cfg.Web.ReadTimeout,
 		WriteTimeout: cfg.Web.WriteTimeout,
+		// Progress streams outlive the write timeout, and push it back on their connection
+		ConnContext: provisioner.ConnContext,
 	}
 
 	// Make a channel to listen for errors coming from the listener. Use a
@@ -98,7 +317,7 @@ func run() error {
 
 	// Start the service listening for requests.
 	go func() {
-		logger.Printf("main : API listening on %s", api.Addr)
+		logger.WithField("address", api.Addr).Info("main : API listening")
 		serverErrors <- api.ListenAndServe()
 	}()
 
@@ -107,6 +326,15 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	// A SIGHUP reloads the configuration straight away, rather than when its files are next checked
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			_ = watcher.Reload()
+		}
+	}()
+
 	// =========================================================================
 	// Shutdown
 
@@ -116,7 +344,7 @@ func run() error {
 		return errors.Unwrap(err)
 
 	case <-shutdown:
-		logger.Println("main : Start shutdown")
+		logger.Info("main : Start shutdown")
 
 		// Give outstanding requests a deadline for completion.
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
@@ -125,7 +353,7 @@ func run() error {
 		// Asking listener to shutdown and load shed.
 		err := api.Shutdown(ctx)
 		if err != nil {
-			logger.Printf("main : Graceful shutdown did not complete in %v : %v", cfg.Web.ShutdownTimeout, err)
+			logger.WithError(err).Warnf("main : Graceful shutdown did not complete in %v", cfg.Web.ShutdownTimeout)
 			err = api.Close()
 		}
 
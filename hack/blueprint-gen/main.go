@@ -0,0 +1,48 @@
+// Writes the built in blueprint of pkg/api/blueprint from hack/backend-manifests.yaml, run by go generate:
+//
+//	go run ../../../hack/blueprint-gen ../../../hack/backend-manifests.yaml default.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: blueprint-gen <manifests.yaml> <output.go>")
+		os.Exit(2)
+	}
+	if err := generate(os.Args[1], os.Args[2]); err != nil {
+		fmt.Fprintln(os.Stderr, "blueprint-gen:", err)
+		os.Exit(1)
+	}
+}
+
+func generate(manifestsPath string, outputPath string) error {
+	manifests, err := ioutil.ReadFile(manifestsPath)
+	if err != nil {
+		return err
+	}
+	// The manifests are written as a raw string literal, which can not hold a backquote
+	if bytes.ContainsRune(manifests, '`') {
+		return fmt.Errorf("%s holds a backquote", manifestsPath)
+	}
+
+	var source strings.Builder
+	fmt.Fprintf(&source, "// Code generated by hack/blueprint-gen from hack/%s.  DO NOT EDIT.\n\n", filepath.Base(manifestsPath))
+	source.WriteString("package blueprint\n\n")
+	fmt.Fprintf(&source, "// The built in blueprint, the contents of hack/%s which operators copy to start their own\n", filepath.Base(manifestsPath))
+	source.WriteString("const defaultManifests = `" + string(manifests) + "`\n")
+
+	formatted, err := format.Source([]byte(source.String()))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath, formatted, 0644)
+}
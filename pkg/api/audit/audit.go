@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	"github.com/go-chi/chi/middleware"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A single audit record, written as one line of JSON
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Action     string    `json:"action"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Outcome    string    `json:"outcome"`
+	RequestID  string    `json:"requestId,omitempty"`
+}
+
+// Outcomes of an audited action
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+var (
+	mutex  sync.Mutex
+	writer io.Writer = os.Stdout
+)
+
+// Send audit records to the given writer instead of stdout
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	writer = w
+}
+
+// Open the audit log file, appending to it if it exists.  An empty path keeps writing audit records to stdout
+func OpenFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	SetOutput(file)
+	return nil
+}
+
+// Record an action taken by the caller of a request
+func Record(r *http.Request, action string, tenant string, outcome string) {
+	Write(Entry{
+		Time:       time.Now().UTC(),
+		Actor:      Actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Tenant:     tenant,
+		Outcome:    outcome,
+		RequestID:  middleware.GetReqID(r.Context()),
+	})
+}
+
+// Write a single audit record
+func Write(entry Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, _ = writer.Write(append(line, '\n'))
+}
+
+// Subject of the authenticated caller of a request, such as jwt:alice
+func Actor(r *http.Request) string {
+	if identity := auth.IdentityFrom(r.Context()); identity != nil {
+		return identity.Subject()
+	}
+	return "anonymous"
+}
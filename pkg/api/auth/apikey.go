@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sigs.k8s.io/yaml"
+)
+
+// A static API key read from the API keys file
+type APIKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Role Role   `json:"role"`
+}
+
+// Authenticates callers presenting a static API key in the X-API-Key header or as a bearer token
+type APIKeyAuthenticator struct {
+	keys []APIKey
+}
+
+func NewAPIKeyAuthenticator(keys []APIKey) (*APIKeyAuthenticator, error) {
+	for i, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("api key %d needs a name and a key", i)
+		}
+		role, err := ParseRole(string(key.Role))
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", key.Name, err)
+		}
+		keys[i].Role = role
+	}
+	return &APIKeyAuthenticator{keys: keys}, nil
+}
+
+// Load API keys from a YAML or JSON file holding a list of keys
+func LoadAPIKeys(path string) (*APIKeyAuthenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys file %s: %w", path, err)
+	}
+	return NewAPIKeyAuthenticator(keys)
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	presented := r.Header.Get("X-API-Key")
+	if presented == "" {
+		// A bearer token which is not one of our keys may be meant for another authenticator
+		token, ok := bearerToken(r)
+		if !ok {
+			return nil, ErrNoCredentials
+		}
+		if key := a.find(token); key != nil {
+			return &Identity{Name: key.Name, Role: key.Role, Method: MethodAPIKey}, nil
+		}
+		return nil, ErrNoCredentials
+	}
+
+	if key := a.find(presented); key != nil {
+		return &Identity{Name: key.Name, Role: key.Role, Method: MethodAPIKey}, nil
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Compare against every key so the time taken does not depend on which key matched
+func (a *APIKeyAuthenticator) find(presented string) *APIKey {
+	var found *APIKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(a.keys[i].Key), []byte(presented)) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	authenticator, err := NewAPIKeyAuthenticator([]APIKey{
+		{Name: "ci", Key: "ci-key", Role: "Operator"},
+		{Name: "dashboard", Key: "dashboard-key", Role: RoleViewer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		bearer   string
+		identity *Identity
+		err      error
+	}{
+		{
+			name:     "header",
+			header:   "ci-key",
+			identity: &Identity{Name: "ci", Role: RoleOperator, Method: MethodAPIKey},
+		},
+		{
+			name:     "bearer token",
+			bearer:   "dashboard-key",
+			identity: &Identity{Name: "dashboard", Role: RoleViewer, Method: MethodAPIKey},
+		},
+		{
+			name:     "header over bearer token",
+			header:   "ci-key",
+			bearer:   "some.jwt.token",
+			identity: &Identity{Name: "ci", Role: RoleOperator, Method: MethodAPIKey},
+		},
+		{
+			name:   "unknown header",
+			header: "guess",
+			err:    ErrInvalidCredentials,
+		},
+		{
+			name:   "prefix of a key",
+			header: "ci-",
+			err:    ErrInvalidCredentials,
+		},
+		{
+			name:   "unknown bearer token left to other authenticators",
+			bearer: "some.jwt.token",
+			err:    ErrNoCredentials,
+		},
+		{
+			name: "no credentials",
+			err:  ErrNoCredentials,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/saas", nil)
+			if test.header != "" {
+				r.Header.Set("X-API-Key", test.header)
+			}
+			if test.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+
+			identity, err := authenticator.Authenticate(r)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got identity %v and error %v", test.err, identity, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if *identity != *test.identity {
+				t.Errorf("expected identity %v, got %v", test.identity, identity)
+			}
+		})
+	}
+}
+
+func TestNewAPIKeyAuthenticatorRejectsInvalidKeys(t *testing.T) {
+	tests := map[string]APIKey{
+		"no name":      {Key: "key", Role: RoleViewer},
+		"no key":       {Name: "ci", Role: RoleViewer},
+		"no role":      {Name: "ci", Key: "key"},
+		"unknown role": {Name: "ci", Key: "key", Role: "root"},
+	}
+	for name, key := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewAPIKeyAuthenticator([]APIKey{key}); err == nil {
+				t.Error("expected the key to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Role of an authenticated caller.  Every role is allowed to do everything the roles below it can
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Whether the role grants at least the required role
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[required]
+}
+
+// Parse a role name, returning an error for unknown roles
+func ParseRole(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if roleRank[role] == 0 {
+		return "", errors.New("unknown role " + name)
+	}
+	return role, nil
+}
+
+// The highest of a set of roles, ignoring unknown roles
+func highestRole(names []string) Role {
+	var highest Role
+	for _, name := range names {
+		role, err := ParseRole(name)
+		if err == nil && roleRank[role] > roleRank[highest] {
+			highest = role
+		}
+	}
+	return highest
+}
+
+// Ways a caller can be authenticated
+const (
+	MethodAPIKey      = "apikey"
+	MethodJWT         = "jwt"
+	MethodTokenReview = "tokenreview"
+)
+
+// An authenticated caller
+type Identity struct {
+	Name string
+	Role Role
+	// How the caller was authenticated (apikey, jwt or tokenreview)
+	Method string
+}
+
+// Name of the caller qualified by how it was authenticated, such as jwt:alice.  The same name can belong to different
+// callers under different methods, so tenants are owned by the subject rather than the name
+func (i *Identity) Subject() string {
+	return Subject(i.Method, i.Name)
+}
+
+// Subject of a caller with the given name authenticated with the given method
+func Subject(method string, name string) string {
+	return method + ":" + name
+}
+
+// Whether an owner is a subject, rather than the bare name tenants were owned by before.  Kubernetes user names such
+// as system:serviceaccount:ns:name hold colons too, so the method is looked for
+func IsSubject(owner string) bool {
+	for _, method := range []string{MethodAPIKey, MethodJWT, MethodTokenReview} {
+		if strings.HasPrefix(owner, method+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticates the caller of a request.  Authenticators which do not find their kind of credentials on the request
+// return ErrNoCredentials so the next authenticator can be tried
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Tries each authenticator in turn until one finds credentials on the request
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+type contextKey struct{}
+
+// Store the identity of the caller on a request context
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// The identity of the caller stored on a request context, or nil for unauthenticated requests
+func IdentityFrom(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
+
+// Read a bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
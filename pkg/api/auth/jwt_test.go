@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func (k testKeys) jwks(t *testing.T) []byte {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{
+		{Kid: "rsa", Kty: "RSA", Use: "sig", N: encode(k.rsa.N), E: encode(big.NewInt(int64(k.rsa.E)))},
+		{Kid: "ec", Kty: "EC", Crv: "P-256", X: encode(k.ec.X), Y: encode(k.ec.Y)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func segment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Sign a token with the given algorithm, using the key of the kid.  HS256 signs with the DER encoded RSA public key,
+// as an attacker who knows the public key would
+func (k testKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	signed := segment(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	case "HS256":
+		mac := hmac.New(sha256.New, x509.MarshalPKCS1PublicKey(&k.rsa.PublicKey))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Swap the claims of a signed token for claims granting the admin role, keeping the signature
+func tamper(t *testing.T, token string) string {
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + segment(t, withClaim("role", "admin")) + "." + parts[2]
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":  "alice",
+		"iss":  "https://issuer.example.com",
+		"aud":  []string{"provisioner", "other"},
+		"role": []string{"viewer", "operator"},
+		"exp":  testNow.Add(time.Hour).Unix(),
+		"nbf":  testNow.Add(-time.Hour).Unix(),
+	}
+}
+
+func withClaim(name string, value interface{}) map[string]interface{} {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	keys := newTestKeys(t)
+	authenticator, err := NewJWTAuthenticator(keys.jwks(t), JWTOptions{
+		Issuer:   "https://issuer.example.com",
+		Audience: "provisioner",
+		Leeway:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.now = func() time.Time { return testNow }
+
+	tests := []struct {
+		name     string
+		token    string
+		identity *Identity
+		err      error
+	}{
+		{
+			name:     "rs256",
+			token:    keys.sign(t, "RS256", "rsa", validClaims()),
+			identity: &Identity{Name: "alice", Role: RoleOperator, Method: MethodJWT},
+		},
+		{
+			name:     "es256",
+			token:    keys.sign(t, "ES256", "ec", validClaims()),
+			identity: &Identity{Name: "alice", Role: RoleOperator, Method: MethodJWT},
+		},
+		{
+			name:     "single audience and role",
+			token:    keys.sign(t, "RS256", "rsa", withClaim("aud", "provisioner")),
+			identity: &Identity{Name: "alice", Role: RoleOperator, Method: MethodJWT},
+		},
+		{
+			name:     "expired within leeway",
+			token:    keys.sign(t, "RS256", "rsa", withClaim("exp", testNow.Add(-30*time.Second).Unix())),
+			identity: &Identity{Name: "alice", Role: RoleOperator, Method: MethodJWT},
+		},
+		{
+			name:  "expired",
+			token: keys.sign(t, "RS256", "rsa", withClaim("exp", testNow.Add(-2*time.Minute).Unix())),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "no expiry",
+			token: keys.sign(t, "RS256", "rsa", withClaim("exp", nil)),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "not yet valid",
+			token: keys.sign(t, "RS256", "rsa", withClaim("nbf", testNow.Add(2*time.Minute).Unix())),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "wrong issuer",
+			token: keys.sign(t, "RS256", "rsa", withClaim("iss", "https://attacker.example.com")),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "wrong audience",
+			token: keys.sign(t, "RS256", "rsa", withClaim("aud", "other")),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "no subject",
+			token: keys.sign(t, "RS256", "rsa", withClaim("sub", nil)),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "hs256 signed with the public key",
+			token: keys.sign(t, "HS256", "rsa", validClaims()),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "unsigned",
+			token: keys.sign(t, "none", "rsa", validClaims()),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "es256 header on an rsa key",
+			token: keys.sign(t, "ES256", "rsa", validClaims()),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "rs256 header on an ec key",
+			token: keys.sign(t, "RS256", "ec", validClaims()),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "tampered claims",
+			token: tamper(t, keys.sign(t, "RS256", "rsa", validClaims())),
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:  "unknown key",
+			token: keys.sign(t, "RS256", "other", validClaims()),
+			err:   ErrNoCredentials,
+		},
+		{
+			name:  "not a jwt",
+			token: "an-api-key",
+			err:   ErrNoCredentials,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/saas", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+
+			identity, err := authenticator.Authenticate(r)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got identity %v and error %v", test.err, identity, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if *identity != *test.identity {
+				t.Errorf("expected identity %v, got %v", test.identity, identity)
+			}
+		})
+	}
+}
+
+func TestNewJWTAuthenticatorRejectsUnusableKeys(t *testing.T) {
+	tests := map[string]string{
+		"not json":        `{`,
+		"no keys":         `{"keys": []}`,
+		"encryption only": `{"keys": [{"kid": "a", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`,
+		"unknown type":    `{"keys": [{"kid": "a", "kty": "oct"}]}`,
+		"unknown curve":   `{"keys": [{"kid": "a", "kty": "EC", "crv": "P-384", "x": "AQAB", "y": "AQAB"}]}`,
+	}
+	for name, jwks := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewJWTAuthenticator([]byte(jwks), JWTOptions{}); err == nil {
+				t.Error("expected the jwks to be rejected")
+			}
+		})
+	}
+}
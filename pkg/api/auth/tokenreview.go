@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authenticationv1type "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Most tokens remembered as rejected, a flood of different tokens empties the list rather than growing it
+const maxRejectedTokens = 10000
+
+// Authenticates callers presenting a Kubernetes service account or user token, validated with a TokenReview.  Roles
+// are granted to the groups the token belongs to
+type TokenReviewAuthenticator struct {
+	reviews    authenticationv1type.TokenReviewInterface
+	groupRoles map[string]Role
+	audiences  []string
+	// Tokens the API server rejected, by their hash, and when they may be reviewed again.  Bearer tokens meant for
+	// another authenticator, such as a mistyped API key, reach the TokenReview last and would otherwise cost a request
+	// to the API server every time
+	rejectedTTL time.Duration
+	rejected    map[[sha256.Size]byte]time.Time
+	mutex       sync.Mutex
+	now         func() time.Time
+}
+
+// Create an authenticator mapping Kubernetes groups to roles.  Tokens of users in none of the groups are authenticated
+// without a role, so they are only let through routes which need no role.  Tokens the API server rejects are rejected
+// without another review for rejectedTTL, or reviewed every time when it is zero
+func NewTokenReviewAuthenticator(reviews authenticationv1type.TokenReviewInterface, groupRoles map[string]string, audiences []string, rejectedTTL time.Duration) (*TokenReviewAuthenticator, error) {
+	roles := make(map[string]Role, len(groupRoles))
+	for group, name := range groupRoles {
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", group, err)
+		}
+		roles[group] = role
+	}
+	return &TokenReviewAuthenticator{
+		reviews:     reviews,
+		groupRoles:  roles,
+		audiences:   audiences,
+		rejectedTTL: rejectedTTL,
+		rejected:    map[[sha256.Size]byte]time.Time{},
+		now:         time.Now,
+	}, nil
+}
+
+func (a *TokenReviewAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash := sha256.Sum256([]byte(token))
+	if a.wasRejected(hash) {
+		return nil, ErrInvalidCredentials
+	}
+
+	review, err := a.reviews.Create(r.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		a.reject(hash)
+		return nil, ErrInvalidCredentials
+	}
+
+	identity := &Identity{Name: review.Status.User.Username, Method: MethodTokenReview}
+	for _, group := range review.Status.User.Groups {
+		if role, ok := a.groupRoles[group]; ok && role.Allows(identity.Role) {
+			identity.Role = role
+		}
+	}
+	return identity, nil
+}
+
+func (a *TokenReviewAuthenticator) wasRejected(hash [sha256.Size]byte) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	until, ok := a.rejected[hash]
+	if ok && !a.now().Before(until) {
+		delete(a.rejected, hash)
+		return false
+	}
+	return ok
+}
+
+// Remember a rejected token, dropping the tokens whose time is up when the list is full
+func (a *TokenReviewAuthenticator) reject(hash [sha256.Size]byte) {
+	if a.rejectedTTL <= 0 {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	if len(a.rejected) >= maxRejectedTokens {
+		for rejected, until := range a.rejected {
+			if !now.Before(until) {
+				delete(a.rejected, rejected)
+			}
+		}
+	}
+	if len(a.rejected) >= maxRejectedTokens {
+		a.rejected = map[[sha256.Size]byte]time.Time{}
+	}
+	a.rejected[hash] = now.Add(a.rejectedTTL)
+}
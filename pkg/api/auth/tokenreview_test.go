@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A clientset whose TokenReviews authenticate the tokens of the users, recording the reviews it was sent
+func fakeTokenReviews(users map[string]authenticationv1.UserInfo, reviews *[]authenticationv1.TokenReviewSpec) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		*reviews = append(*reviews, review.Spec)
+		if review.Spec.Token == "unreachable" {
+			return true, nil, errors.New("connection refused")
+		}
+		if user, ok := users[review.Spec.Token]; ok {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: user}
+		}
+		return true, review, nil
+	})
+	return clientset
+}
+
+func TestTokenReviewAuthenticator(t *testing.T) {
+	var reviews []authenticationv1.TokenReviewSpec
+	clientset := fakeTokenReviews(map[string]authenticationv1.UserInfo{
+		"admin-token":  {Username: "system:serviceaccount:ops:deployer", Groups: []string{"ops", "platform-admins"}},
+		"viewer-token": {Username: "bob", Groups: []string{"developers"}},
+		"plain-token":  {Username: "carol", Groups: []string{"system:authenticated"}},
+	}, &reviews)
+	authenticator, err := NewTokenReviewAuthenticator(clientset.AuthenticationV1().TokenReviews(), map[string]string{
+		"platform-admins": "admin",
+		"ops":             "operator",
+		"developers":      "viewer",
+	}, []string{"provisioner"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		identity *Identity
+		err      error
+		// Whether the review itself fails, which is an error other than the credentials being invalid
+		failed bool
+	}{
+		{
+			name:     "highest role of the groups",
+			token:    "admin-token",
+			identity: &Identity{Name: "system:serviceaccount:ops:deployer", Role: RoleAdmin, Method: MethodTokenReview},
+		},
+		{
+			name:     "single group",
+			token:    "viewer-token",
+			identity: &Identity{Name: "bob", Role: RoleViewer, Method: MethodTokenReview},
+		},
+		{
+			name:     "no mapped group",
+			token:    "plain-token",
+			identity: &Identity{Name: "carol", Method: MethodTokenReview},
+		},
+		{
+			name:  "not authenticated",
+			token: "forged-token",
+			err:   ErrInvalidCredentials,
+		},
+		{
+			name:   "review failed",
+			token:  "unreachable",
+			failed: true,
+		},
+		{
+			name: "no token",
+			err:  ErrNoCredentials,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reviews = nil
+			r := httptest.NewRequest("GET", "/v1/saas", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			identity, err := authenticator.Authenticate(r)
+			switch {
+			case test.failed:
+				if err == nil || errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("expected the failed review to be an error, got identity %v and error %v", identity, err)
+				}
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected %v, got identity %v and error %v", test.err, identity, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case *identity != *test.identity:
+				t.Errorf("expected identity %v, got %v", test.identity, identity)
+			}
+
+			if test.token == "" {
+				if len(reviews) != 0 {
+					t.Errorf("expected no token review, got %v", reviews)
+				}
+				return
+			}
+			expected := []authenticationv1.TokenReviewSpec{{Token: test.token, Audiences: []string{"provisioner"}}}
+			if !reflect.DeepEqual(reviews, expected) {
+				t.Errorf("expected token reviews %v, got %v", expected, reviews)
+			}
+		})
+	}
+}
+
+func TestNewTokenReviewAuthenticatorRejectsUnknownRoles(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	_, err := NewTokenReviewAuthenticator(clientset.AuthenticationV1().TokenReviews(), map[string]string{"ops": "root"}, nil, 0)
+	if err == nil {
+		t.Error("expected the unknown role to be rejected")
+	}
+}
+
+// A rejected token is not sent for review again until its time is up, while failed reviews and accepted tokens are
+func TestTokenReviewRejectionsRemembered(t *testing.T) {
+	var reviews []authenticationv1.TokenReviewSpec
+	clientset := fakeTokenReviews(map[string]authenticationv1.UserInfo{"viewer-token": {Username: "bob"}}, &reviews)
+	authenticator, err := NewTokenReviewAuthenticator(clientset.AuthenticationV1().TokenReviews(), nil, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	authenticator.now = func() time.Time { return now }
+
+	authenticate := func(token string) error {
+		r := httptest.NewRequest("GET", "/v1/saas", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := authenticator.Authenticate(r)
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := authenticate("forged-token"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("expected the forged token to be rejected, got %v", err)
+		}
+		if err := authenticate("viewer-token"); err != nil {
+			t.Fatal(err)
+		}
+		if err := authenticate("unreachable"); err == nil {
+			t.Fatal("expected the failed review to be an error")
+		}
+	}
+	if len(reviews) != 7 {
+		t.Errorf("expected the forged token to be reviewed once, got %d reviews", len(reviews))
+	}
+
+	now = now.Add(time.Minute)
+	reviews = nil
+	if err := authenticate("forged-token"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected the forged token to be rejected, got %v", err)
+	}
+	if len(reviews) != 1 {
+		t.Errorf("expected the forged token to be reviewed again once its time was up, got %d reviews", len(reviews))
+	}
+}
@@ -0,0 +1,211 @@
+package blueprint
+
+//go:generate go run ../../../hack/blueprint-gen ../../../hack/backend-manifests.yaml default.go
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"path/filepath"
+	sigsyaml "sigs.k8s.io/yaml"
+	"sort"
+	"text/template"
+)
+
+// Parameters rendered into the blueprint templates of a tenant
+type Params struct {
+	// Name of the tenant namespace
+	Namespace string
+	// Hostnames the frontend and backend ingresses serve
+	FrontendHost string
+	BackendHost  string
+	// PostgreSQL database and the generated credentials the backend connects with
+	PostgresDb       string
+	PostgresUser     string
+	PostgresPassword string
+	// Requests and limits of the containers of each deployment, by the name of the deployment.  They are set over those
+	// in the manifests, which are kept for the deployments and resources left out
+	Resources map[string]corev1.ResourceRequirements
+}
+
+// Identifies a single object of a blueprint
+type Ref struct {
+	Kind string
+	Name string
+}
+
+func (r Ref) String() string {
+	return r.Kind + "/" + r.Name
+}
+
+// A set of YAML manifests, written as Go templates, describing the objects provisioned into every tenant namespace.
+// A manifest may hold several objects separated by "---"
+type Blueprint struct {
+	templates []*template.Template
+}
+
+// Objects rendered from a blueprint for a single tenant
+type Objects struct {
+	objects map[Ref]*unstructured.Unstructured
+}
+
+// Parse a blueprint from a single manifest
+func Parse(name string, manifest string) (*Blueprint, error) {
+	tmpl, err := newTemplate(name, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &Blueprint{templates: []*template.Template{tmpl}}, nil
+}
+
+// Load a blueprint from every .yaml and .yml file in a directory, in file name order.  An empty directory name loads
+// the built in blueprint
+func Load(dir string) (*Blueprint, error) {
+	if dir == "" {
+		return Default()
+	}
+
+	var paths []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no blueprint manifests found in %s", dir)
+	}
+	sort.Strings(paths)
+
+	b := &Blueprint{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := newTemplate(filepath.Base(path), string(data))
+		if err != nil {
+			return nil, err
+		}
+		b.templates = append(b.templates, tmpl)
+	}
+	return b, nil
+}
+
+// The built in blueprint, matching hack/backend-manifests.yaml
+func Default() (*Blueprint, error) {
+	return Parse("default", defaultManifests)
+}
+
+func newTemplate(name string, manifest string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse blueprint manifest %s: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// Render every manifest of the blueprint with the parameters of a tenant
+func (b *Blueprint) Render(params Params) (*Objects, error) {
+	objects := &Objects{objects: map[Ref]*unstructured.Unstructured{}}
+
+	for _, tmpl := range b.templates {
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, params); err != nil {
+			return nil, fmt.Errorf("failed to render blueprint manifest %s: %w", tmpl.Name(), err)
+		}
+
+		reader := yaml.NewYAMLReader(bufio.NewReader(&rendered))
+		for {
+			document, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read blueprint manifest %s: %w", tmpl.Name(), err)
+			}
+			data, err := sigsyaml.YAMLToJSON(document)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode blueprint manifest %s: %w", tmpl.Name(), err)
+			}
+			// Empty documents, such as one holding only comments
+			if data = bytes.TrimSpace(data); len(data) == 0 || string(data) == "null" {
+				continue
+			}
+
+			u := &unstructured.Unstructured{}
+			if err := u.UnmarshalJSON(data); err != nil {
+				return nil, fmt.Errorf("failed to decode blueprint manifest %s: %w", tmpl.Name(), err)
+			}
+			ref := Ref{Kind: u.GetKind(), Name: u.GetName()}
+			if ref.Kind == "" || ref.Name == "" {
+				return nil, fmt.Errorf("object in blueprint manifest %s needs a kind and a name", tmpl.Name())
+			}
+			if _, exists := objects.objects[ref]; exists {
+				return nil, fmt.Errorf("blueprint defines %s more than once", ref)
+			}
+			if requirements, ok := params.Resources[ref.Name]; ok && ref.Kind == "Deployment" {
+				if err := setResources(u, requirements); err != nil {
+					return nil, fmt.Errorf("failed to set the resources of %s in blueprint manifest %s: %w", ref, tmpl.Name(), err)
+				}
+			}
+			objects.objects[ref] = u
+		}
+	}
+
+	return objects, nil
+}
+
+// Set the requests and limits of every container of a deployment, keeping the resources they are not given
+func setResources(deploy *unstructured.Unstructured, requirements corev1.ResourceRequirements) error {
+	containers, _, err := unstructured.NestedSlice(deploy.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
+	}
+	for i := range containers {
+		container, ok := containers[i].(map[string]interface{})
+		if !ok {
+			return errors.New("containers must be objects")
+		}
+		for field, quantities := range map[string]corev1.ResourceList{"requests": requirements.Requests, "limits": requirements.Limits} {
+			for name, quantity := range quantities {
+				if err := unstructured.SetNestedField(container, quantity.String(), "resources", field, string(name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return unstructured.SetNestedSlice(deploy.Object, containers, "spec", "template", "spec", "containers")
+}
+
+// References to every rendered object, sorted by kind and name
+func (o *Objects) Refs() []Ref {
+	refs := make([]Ref, 0, len(o.objects))
+	for ref := range o.objects {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+	return refs
+}
+
+// Decode the object of the given kind and name into a typed object, such as an *appsv1.Deployment
+func (o *Objects) Decode(kind string, name string, into interface{}) error {
+	u, ok := o.objects[Ref{Kind: kind, Name: name}]
+	if !ok {
+		return fmt.Errorf("blueprint has no %s %s", kind, name)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, into); err != nil {
+		return fmt.Errorf("invalid %s %s in blueprint: %w", kind, name, err)
+	}
+	return nil
+}
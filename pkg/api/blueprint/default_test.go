@@ -0,0 +1,91 @@
+package blueprint
+
+import (
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"testing"
+)
+
+// The built in blueprint is generated from the manifests operators copy, run go generate when this fails
+func TestDefaultMatchesManifests(t *testing.T) {
+	manifests, err := ioutil.ReadFile("../../../hack/backend-manifests.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(manifests) != defaultManifests {
+		t.Error("default.go is out of date with hack/backend-manifests.yaml, run go generate ./pkg/api/blueprint")
+	}
+}
+
+func TestDefaultParses(t *testing.T) {
+	if _, err := Default(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Resources given for a deployment are set over the blueprint's, and the deployments left out keep theirs
+func TestRenderSetsResources(t *testing.T) {
+	bp, err := Parse("test", `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: backend
+spec:
+  template:
+    spec:
+      containers:
+        - name: backend
+          resources:
+            requests:
+              cpu: 10m
+              memory: 10Mi
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+spec:
+  template:
+    spec:
+      containers:
+        - name: frontend
+          resources:
+            limits:
+              cpu: 20m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := bp.Render(Params{Resources: map[string]corev1.ResourceRequirements{
+		"backend": {
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]corev1.ResourceRequirements{
+		"backend": {
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("10Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+		"frontend": {
+			Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("20m")},
+		},
+	}
+	for name, requirements := range expected {
+		var deploy appsv1.Deployment
+		if err := objects.Decode("Deployment", name, &deploy); err != nil {
+			t.Fatal(err)
+		}
+		actual := deploy.Spec.Template.Spec.Containers[0].Resources
+		if !apiequality.Semantic.DeepEqual(actual, requirements) {
+			t.Errorf("expected %s to have the resources %v, got %v", name, requirements, actual)
+		}
+	}
+}
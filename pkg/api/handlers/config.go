@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/bennerv/provisioning-api/pkg/config"
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+)
+
+var configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "saas_config_reloads_total",
+	Help: "Configuration reloads, by whether the new configuration was applied or rejected.",
+}, []string{"result"})
+
+// Log and count the outcome of a configuration reload
+func ConfigReloaded(status config.ReloadStatus, err error) {
+	log := logging.Root().WithField("file", status.File)
+	if err != nil {
+		configReloads.WithLabelValues("rejected").Inc()
+		log.WithError(err).Error("Rejected the new configuration, keeping the last good configuration")
+		return
+	}
+
+	configReloads.WithLabelValues("applied").Inc()
+	log.Info("Applied the new configuration")
+	if len(status.RestartRequired) > 0 {
+		log.WithField("settings", status.RestartRequired).Warn("Changed settings are only applied on restart")
+	}
+}
+
+// Outcome of the configuration reloads
+func getConfigReloads(watcher *config.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, watcher.Status())
+	}
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
 	"github.com/bennerv/provisioning-api/pkg/api/k8sprobes"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/bennerv/provisioning-api/pkg/api/metrics"
 	"github.com/bennerv/provisioning-api/pkg/api/provisioner"
+	"github.com/bennerv/provisioning-api/pkg/api/tracing"
+	"github.com/bennerv/provisioning-api/pkg/config"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
@@ -13,12 +18,20 @@ import (
 // Bring together all routes present in any packages.
 // Each package which has routes should have a Routes() function.  This function should be attached to a specific router
 // API mount point here.  They can reference the root path as this will control the location of where things are mounted
-func Routes(clientset *kubernetes.Clientset) *chi.Mux {
+func Routes(cfg *config.Config, clientset kubernetes.Interface, controller *provisioner.Controller, authenticator auth.Authenticator, prober *k8sprobes.Prober, watcher *config.Watcher) *chi.Mux {
 
 	router := chi.NewRouter()
 	router.Use(
 
-		middleware.Logger,
+		// Give every request an id and a logger carrying it, and log every request as JSON
+		middleware.RequestID,
+		logging.Middleware,
+
+		// Count and time every request for the metrics endpoint
+		metrics.Middleware,
+
+		// Trace every request, continuing the trace of callers which send a traceparent header
+		tracing.Middleware,
 
 		// Redirect slashes to the correct endpoint
 		middleware.RedirectSlashes,
@@ -29,15 +42,8 @@ func Routes(clientset *kubernetes.Clientset) *chi.Mux {
 		// Set request header content type Json
 		render.SetContentType(render.ContentTypeJSON),
 
-		// Set response header to always be ContentType: application/json
-		func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-				next.ServeHTTP(w, r)
-			})
-		},
+		// Only allow browsers on the configured origins to call the API
+		cors(cfg.Web.AllowedOrigins),
 
 		func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -49,12 +55,20 @@ func Routes(clientset *kubernetes.Clientset) *chi.Mux {
 
 	// Versioned API routes for provisioner
 	router.Route("/v1", func(r chi.Router) {
-		r.Mount("/", provisioner.Routes(clientset))
+		r.Use(auth.Authenticate(authenticator))
+		r.Mount("/", provisioner.Routes(clientset, controller))
+
+		// Outcome of the configuration reloads
+		r.With(auth.Require(auth.RoleAdmin)).Get("/config/reloads", getConfigReloads(watcher))
+		r.Options("/config/reloads", provisioner.AllowOptions)
 	})
 
+	// Prometheus metrics, scraped without authentication like the probes
+	router.Method(http.MethodGet, "/metrics", metrics.Handler())
+
 	// Liveness and Readiness k8s probes
 	router.Route("/", func(r chi.Router) {
-		r.Mount("/", k8sprobes.Routes())
+		r.Mount("/", k8sprobes.Routes(prober))
 	})
 
 	//router.Get("/swagger/*", httpSwagger.Handler(
@@ -63,3 +77,26 @@ func Routes(clientset *kubernetes.Clientset) *chi.Mux {
 
 	return router
 }
+
+// Set the CORS headers for requests from an allowed origin.  A "*" origin allows any origin
+func cors(allowedOrigins []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			for _, allowed := range allowedOrigins {
+				if allowed == "*" || allowed == origin {
+					if allowed == "*" {
+						w.Header().Set("Access-Control-Allow-Origin", "*")
+					} else {
+						w.Header().Set("Access-Control-Allow-Origin", origin)
+						w.Header().Add("Vary", "Origin")
+					}
+					w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
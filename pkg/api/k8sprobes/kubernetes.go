@@ -0,0 +1,57 @@
+package k8sprobes
+
+import (
+	"context"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// Check the API server can be reached and reports itself healthy
+func APIServer(cs kubernetes.Interface) Check {
+	return func(ctx context.Context) error {
+		_, err := cs.Discovery().RESTClient().Get().AbsPath("/healthz").Do(ctx).Raw()
+		if err != nil {
+			return fmt.Errorf("api server unreachable: %w", err)
+		}
+		return nil
+	}
+}
+
+// Check the provisioner is allowed everything it needs to do, such as creating namespaces, with a
+// SelfSubjectAccessReview for each permission
+func Permissions(cs kubernetes.Interface, permissions []authorizationv1.ResourceAttributes) Check {
+	return func(ctx context.Context) error {
+		var missing []string
+		for _, permission := range permissions {
+			permission := permission
+			review, err := cs.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &permission},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to review permissions: %w", err)
+			}
+			if !review.Status.Allowed {
+				missing = append(missing, describe(permission))
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// A permission as "verb resource.group/subresource", such as "create deployments.apps"
+func describe(permission authorizationv1.ResourceAttributes) string {
+	resource := permission.Resource
+	if permission.Group != "" {
+		resource += "." + permission.Group
+	}
+	if permission.Subresource != "" {
+		resource += "/" + permission.Subresource
+	}
+	return permission.Verb + " " + resource
+}
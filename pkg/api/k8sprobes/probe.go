@@ -1,28 +1,175 @@
 package k8sprobes
 
 import (
+	"context"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func Routes() *chi.Mux {
+// Kinds of check.  Failing readiness checks take the provisioner out of its service, failing liveness checks get it
+// restarted
+const (
+	KindReadiness = "readiness"
+	KindLiveness  = "liveness"
+)
+
+// Statuses of a check and of a probe
+const (
+	StatusOK      = "OK"
+	StatusFailing = "Failing"
+)
+
+// A check of something the provisioner needs to work, returning why it is failing
+type Check func(ctx context.Context) error
+
+// The outcome of a single check
+type Result struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Outcome of a probe, with the result of every check when asked for the details
+type Response struct {
+	Status string   `json:"status"`
+	Failed []string `json:"failed,omitempty"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Runs the checks behind the liveness and readiness probes.  Checks run at the same time, each given the timeout
+type Prober struct {
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	checks []namedCheck
+}
+
+type namedCheck struct {
+	name  string
+	kind  string
+	check Check
+}
+
+func NewProber(timeout time.Duration) *Prober {
+	return &Prober{timeout: timeout}
+}
+
+// Add a check the provisioner must pass to be sent traffic
+func (p *Prober) Readiness(name string, check Check) {
+	p.add(namedCheck{name: name, kind: KindReadiness, check: check})
+}
+
+// Add a check the provisioner must pass to be left running
+func (p *Prober) Liveness(name string, check Check) {
+	p.add(namedCheck{name: name, kind: KindLiveness, check: check})
+}
+
+func (p *Prober) add(check namedCheck) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.checks = append(p.checks, check)
+}
+
+func Routes(p *Prober) *chi.Mux {
 	router := chi.NewRouter()
-	router.Get("/health", GetLiveness)
-	router.Get("/ready", GetReadiness)
+	router.Get("/health", p.GetLiveness)
+	router.Get("/health/details", p.GetDetails)
+	router.Get("/ready", p.GetReadiness)
 	return router
 }
 
-func GetLiveness(w http.ResponseWriter, r *http.Request) {
-	response := make(map[string]string)
-	response["status"] = "OK"
-	w.WriteHeader(http.StatusOK)
-	render.JSON(w, r, response)
+func (p *Prober) GetLiveness(w http.ResponseWriter, r *http.Request) {
+	p.respond(w, r, p.run(r.Context(), KindLiveness), false)
+}
+
+func (p *Prober) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	p.respond(w, r, p.run(r.Context(), KindReadiness), false)
 }
 
-func GetReadiness(w http.ResponseWriter, r *http.Request) {
-	response := make(map[string]string)
-	response["status"] = "OK"
-	w.WriteHeader(http.StatusOK)
+// Result of every check, failing when any readiness or liveness check fails
+func (p *Prober) GetDetails(w http.ResponseWriter, r *http.Request) {
+	p.respond(w, r, p.run(r.Context(), KindLiveness, KindReadiness), true)
+}
+
+func (p *Prober) respond(w http.ResponseWriter, r *http.Request, results []Result, details bool) {
+	response := Response{Status: StatusOK}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			response.Status = StatusFailing
+			response.Failed = append(response.Failed, result.Name)
+		}
+	}
+	if details {
+		response.Checks = results
+	}
+
+	if response.Status == StatusOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	render.JSON(w, r, response)
 }
+
+// Run the checks of the given kinds, returning their results in the order they were added
+func (p *Prober) run(ctx context.Context, kinds ...string) []Result {
+	p.mutex.Lock()
+	var checks []namedCheck
+	for _, check := range p.checks {
+		for _, kind := range kinds {
+			if check.kind == kind {
+				checks = append(checks, check)
+			}
+		}
+	}
+	p.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			result := Result{Name: check.name, Kind: check.kind, Status: StatusOK}
+			if err := check.check(ctx); err != nil {
+				result.Status = StatusFailing
+				result.Error = err.Error()
+			}
+			result.Duration = time.Since(start).String()
+			results[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// Remember the outcome of a check for a while, for checks too costly to run on every probe
+func Cached(ttl time.Duration, check Check) Check {
+	var (
+		mutex   sync.Mutex
+		checked time.Time
+		last    error
+	)
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return last
+		}
+		last = check(ctx)
+		// A check cut short by the probe timing out is run again on the next probe
+		if ctx.Err() == nil {
+			checked = time.Now()
+		}
+		return last
+	}
+}
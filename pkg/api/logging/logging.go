@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"context"
+	"github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Fields every log line about a request or a tenant carries when they are known
+const (
+	FieldRequestID = "request_id"
+	FieldTenant    = "tenant"
+	FieldStep      = "step"
+)
+
+var root = newRoot()
+
+type contextKey struct{}
+
+func newRoot() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+	logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	return logger
+}
+
+// Set the lowest level logged, such as "debug", "info" or "warn"
+func SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	root.SetLevel(parsed)
+	return nil
+}
+
+// Logger without any fields, for work which is not about a single request or tenant
+func Root() *logrus.Entry {
+	return logrus.NewEntry(root)
+}
+
+// Context carrying a logger, so work done for a request logs with the request's fields
+func WithLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, log)
+}
+
+// Logger carried by a context, the root logger when it carries none
+func FromContext(ctx context.Context) *logrus.Entry {
+	if log, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return log
+	}
+	return Root()
+}
+
+// Give every request a logger carrying its request id, and log each request once it has been served.  The request id
+// is taken from the X-Request-Id header when the caller sent one, and is sent back in the same header.  Must come after
+// chi's RequestID middleware
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := middleware.GetReqID(r.Context())
+		log := Root().WithField(FieldRequestID, requestID)
+		w.Header().Set(middleware.RequestIDHeader, requestID)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(WithLogger(r.Context(), log)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := log.WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   status,
+			"bytes":    ww.BytesWritten(),
+			"duration": time.Since(start).String(),
+			"remote":   r.RemoteAddr,
+		})
+		if status >= http.StatusInternalServerError {
+			entry.Warn("request served")
+			return
+		}
+		entry.Info("request served")
+	})
+}
@@ -0,0 +1,17 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Buckets in seconds for the latency of API requests
+var RequestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Buckets in seconds for work which waits on the cluster, such as a deployment becoming ready
+var StepBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1200}
+
+// Serve every metric of the default Prometheus registry, which also holds the Go runtime and process metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
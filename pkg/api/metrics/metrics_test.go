@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Requests are counted by the route they matched rather than their path, and those which matched no route together
+func TestMiddleware(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Middleware)
+	router.Get("/v1/saas/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	router.Delete("/v1/saas/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	counted := func(route string, method string, code string) float64 {
+		return testutil.ToFloat64(httpRequests.WithLabelValues(route, method, code))
+	}
+	before := []float64{
+		counted("/v1/saas/{name}", "GET", "200"),
+		counted("/v1/saas/{name}", "DELETE", "404"),
+		counted("unmatched", "GET", "404"),
+	}
+
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/v1/saas/team-a"},
+		{"GET", "/v1/saas/team-b"},
+		{"DELETE", "/v1/saas/team-a"},
+		{"GET", "/v1/missing"},
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, request.path, nil))
+	}
+
+	after := []float64{
+		counted("/v1/saas/{name}", "GET", "200"),
+		counted("/v1/saas/{name}", "DELETE", "404"),
+		counted("unmatched", "GET", "404"),
+	}
+	for i, expected := range []float64{2, 1, 1} {
+		if after[i]-before[i] != expected {
+			t.Errorf("expected %v more requests in series %d, got %v", expected, i, after[i]-before[i])
+		}
+	}
+	if count := testutil.CollectAndCount(httpDuration); count < 2 {
+		t.Errorf("expected the requests to be timed by route and method, got %d series", count)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	counter := httpRequests.WithLabelValues("/handler-test", "GET", "200")
+	counter.Inc()
+	served := fmt.Sprintf(`http_requests_total{code="200",method="GET",route="/handler-test"} %v`, testutil.ToFloat64(counter))
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, expected := range []string{served, "go_goroutines "} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the metrics to contain %q, got\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+)
+
+// Field manager the provisioner applies tenant objects as
+const fieldManager = "saas-provisioner"
+
+// Create or update an object in the tenant namespace with a server side apply.  Missing objects are created, and the
+// fields the provisioner sets are patched back when they have drifted.  Fields only set by others, such as defaults
+// filled in by the API server, are left alone
+func (t *tenant) apply(obj metav1.Object) error {
+	obj.SetNamespace(t.name)
+	obj.SetResourceVersion("")
+
+	ctx := t.callContext()
+	name := obj.GetName()
+	// Forcing the apply takes over fields last written by anyone else, such as a kubectl edit
+	opts := metav1.PatchOptions{FieldManager: fieldManager, Force: pointer.BoolPtr(true)}
+
+	var err error
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+		_, err = t.clientset.AppsV1().Deployments(t.name).Patch(ctx, name, types.ApplyPatchType, applyPatch(o), opts)
+	case *corev1.Service:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+		_, err = t.clientset.CoreV1().Services(t.name).Patch(ctx, name, types.ApplyPatchType, applyPatch(o), opts)
+	case *netv1beta1.Ingress:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "networking.k8s.io/v1beta1", Kind: "Ingress"}
+		_, err = t.clientset.NetworkingV1beta1().Ingresses(t.name).Patch(ctx, name, types.ApplyPatchType, applyPatch(o), opts)
+	case *corev1.PersistentVolumeClaim:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+		_, err = t.clientset.CoreV1().PersistentVolumeClaims(t.name).Patch(ctx, name, types.ApplyPatchType, applyPatch(o), opts)
+	case *corev1.Secret:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+		_, err = t.clientset.CoreV1().Secrets(t.name).Patch(ctx, name, types.ApplyPatchType, applyPatch(o), opts)
+	default:
+		return fmt.Errorf("can not apply objects of type %T", obj)
+	}
+	return err
+}
+
+// Switch a live deployment to the Recreate strategy when the blueprint asks for it, so its old pods are stopped before
+// new ones start.  An apply can not make the switch, the API server refuses Recreate alongside the rollingUpdate it
+// filled in when the deployment was made, which a strategic merge patch clears
+func (t *tenant) recreateStrategy(live *appsv1.Deployment, desired *appsv1.Deployment) error {
+	if desired.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType || live.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		return nil
+	}
+
+	strategyPatch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"strategy": map[string]interface{}{
+				"type":          appsv1.RecreateDeploymentStrategyType,
+				"rollingUpdate": nil,
+			},
+		},
+	})
+	_, err := t.clientset.AppsV1().Deployments(t.name).Patch(t.callContext(), live.Name, types.StrategicMergePatchType, strategyPatch, metav1.PatchOptions{})
+	return err
+}
+
+// Switch the live deployment made from a blueprint deployment to its strategy, when the deployment already exists
+func (t *tenant) recreateStrategyOf(desired *appsv1.Deployment) error {
+	live, err := t.clientset.AppsV1().Deployments(t.name).Get(t.callContext(), desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return t.recreateStrategy(live, desired)
+}
+
+func applyPatch(obj interface{}) []byte {
+	data, _ := json.Marshal(obj)
+	return data
+}
@@ -0,0 +1,109 @@
+package provisioner
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"testing"
+)
+
+func databaseSecret(namespace string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: databaseSecretName, Namespace: namespace},
+		Data:       map[string][]byte{"username": []byte(postgresUser), "password": []byte("password")},
+	}
+}
+
+// A deployment as the API server defaults it, rolling out with a surge of one pod
+func rollingDeployment(namespace string, name string) *appsv1.Deployment {
+	surge := intstr.FromInt(1)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: appsv1.DeploymentSpec{
+			Strategy: appsv1.DeploymentStrategy{
+				Type:          appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{MaxSurge: &surge, MaxUnavailable: &surge},
+			},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: name, Image: name + ":old"}}},
+			},
+		},
+	}
+}
+
+// Two postgresql pods must never share the data directory, so the deployment is recreated whether it is new or was
+// made by a provisioner which rolled it
+func TestPostgresDeploymentRecreated(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{name: "new deployment"},
+		{name: "rolling deployment", existing: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := []runtime.Object{databaseSecret("team-a")}
+			if test.existing {
+				objects = append(objects, rollingDeployment("team-a", "postgresql"))
+			}
+			c, cs, _ := newTestController(t, objects...)
+
+			if err := createPostgresDeployment(c.tenantFor(newSaaSInstance("team-a"))); err != nil {
+				t.Fatal(err)
+			}
+
+			// An apply can not clear the rollingUpdate the API server filled in, so the switch is patched before it
+			var patches []types.PatchType
+			for _, action := range cs.Actions() {
+				if patch, ok := action.(k8stesting.PatchAction); ok {
+					patches = append(patches, patch.GetPatchType())
+				}
+			}
+			expected := []types.PatchType{types.ApplyPatchType}
+			if test.existing {
+				expected = []types.PatchType{types.StrategicMergePatchType, types.ApplyPatchType}
+			}
+			if !reflect.DeepEqual(patches, expected) {
+				t.Errorf("expected %v patches, got %v", expected, patches)
+			}
+
+			deploy, err := cs.AppsV1().Deployments("team-a").Get(context.Background(), "postgresql", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deploy.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType || deploy.Spec.Strategy.RollingUpdate != nil {
+				t.Errorf("expected the postgresql deployment to be recreated, got %+v", deploy.Spec.Strategy)
+			}
+		})
+	}
+}
+
+// Deployments the blueprint rolls out are left to roll
+func TestRollingDeploymentKept(t *testing.T) {
+	c, cs, _ := newTestController(t, databaseSecret("team-a"), rollingDeployment("team-a", "backend"))
+
+	if err := createBackendDeployment(c.tenantFor(newSaaSInstance("team-a"))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range cs.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && patch.GetPatchType() != types.ApplyPatchType {
+			t.Errorf("expected the backend deployment only to be applied, got a %s patch", patch.GetPatchType())
+		}
+	}
+	deploy, err := cs.AppsV1().Deployments("team-a").Get(context.Background(), "backend", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.Spec.Strategy.Type != appsv1.RollingUpdateDeploymentStrategyType {
+		t.Errorf("expected the backend deployment to keep rolling, got %+v", deploy.Spec.Strategy)
+	}
+}
@@ -0,0 +1,372 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"time"
+)
+
+// Group, version and resource of the UpgradeCampaign custom resource (deploy/00-upgradecampaign-crd.yaml)
+var upgradeCampaignGVR = schema.GroupVersionResource{
+	Group:    "saas.bennerv.com",
+	Version:  "v1alpha1",
+	Resource: "upgradecampaigns",
+}
+
+const upgradeCampaignKind = "UpgradeCampaign"
+
+// How often the tenants of a running batch are checked
+const campaignPollInterval = 10 * time.Second
+
+// Phase of an UpgradeCampaign
+type CampaignPhase string
+
+const (
+	CampaignPending   CampaignPhase = "Pending"
+	CampaignRunning   CampaignPhase = "Running"
+	CampaignCompleted CampaignPhase = "Completed"
+	CampaignHalted    CampaignPhase = "Halted"
+)
+
+// Result of the upgrade of a single tenant of a campaign
+const (
+	CampaignTenantPending   = "Pending"
+	CampaignTenantUpgrading = "Upgrading"
+	CampaignTenantSucceeded = "Succeeded"
+	CampaignTenantFailed    = "Failed"
+	CampaignTenantSkipped   = "Skipped"
+)
+
+// An UpgradeCampaign upgrades every tenant to a release in batches, halting once too many upgrades have failed.  It is
+// cluster scoped and its name is the campaign id
+type UpgradeCampaign struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UpgradeCampaignSpec   `json:"spec,omitempty"`
+	Status UpgradeCampaignStatus `json:"status,omitempty"`
+}
+
+type UpgradeCampaignSpec struct {
+	Release string `json:"release"`
+	// Number of tenants upgraded at once, one when not set
+	BatchSize int `json:"batchSize,omitempty"`
+	// Time waited after a batch has finished before the next batch starts
+	Pause metav1.Duration `json:"pause,omitempty"`
+	// Percentage of failed upgrades the campaign tolerates before it halts.  Any failure halts the campaign when zero
+	MaxFailurePercent int `json:"maxFailurePercent,omitempty"`
+}
+
+type UpgradeCampaignStatus struct {
+	Phase   CampaignPhase `json:"phase,omitempty"`
+	Message string        `json:"message,omitempty"`
+	// Number of batches started
+	Batch          int          `json:"batch,omitempty"`
+	NextBatchTime  *metav1.Time `json:"nextBatchTime,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Succeeded      int          `json:"succeeded"`
+	Failed         int          `json:"failed"`
+	// Every tenant managed when the campaign started
+	Tenants []CampaignTenant `json:"tenants,omitempty"`
+}
+
+type CampaignTenant struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	// Batch the tenant was upgraded in
+	Batch     int          `json:"batch,omitempty"`
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	Message   string       `json:"message,omitempty"`
+}
+
+func newUpgradeCampaign(spec UpgradeCampaignSpec) *UpgradeCampaign {
+	return &UpgradeCampaign{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: upgradeCampaignGVR.GroupVersion().String(),
+			Kind:       upgradeCampaignKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "campaign-"},
+		Spec:       spec,
+	}
+}
+
+// Whether the campaign has stopped, successfully or not
+func (c *UpgradeCampaign) Finished() bool {
+	return c.Status.Phase == CampaignCompleted || c.Status.Phase == CampaignHalted
+}
+
+// Whether enough upgrades have failed to halt the campaign
+func (s *UpgradeCampaignStatus) failureThresholdCrossed(maxFailurePercent int) bool {
+	return s.Failed > 0 && s.Failed*100 > maxFailurePercent*(s.Succeeded+s.Failed)
+}
+
+// Bring a single campaign forward.  Campaigns only ever move forward from their recorded status, so a campaign picks up
+// where it was when the provisioner restarts.  The returned duration is how long to wait before looking at the
+// campaign again, zero once it has finished
+func (c *Controller) reconcileCampaign(name string) (time.Duration, error) {
+	obj, err := c.campaigns.Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	campaign, err := campaignFromUnstructured(obj)
+	if err != nil {
+		return 0, err
+	}
+	if campaign.Finished() {
+		return 0, nil
+	}
+
+	requeue := c.advanceCampaign(campaign)
+	return requeue, c.updateCampaignStatus(campaign)
+}
+
+// Move the campaign on by one step, returning how long to wait before the next one
+func (c *Controller) advanceCampaign(campaign *UpgradeCampaign) time.Duration {
+	status := &campaign.Status
+	now := metav1.Now()
+
+	if status.Phase == "" {
+		if err := c.startCampaign(campaign); err != nil {
+			c.finishCampaign(campaign, CampaignHalted, err.Error())
+			return 0
+		}
+		return campaignPollInterval
+	}
+
+	// Wait for every upgrade of the running batch to finish
+	upgrading := false
+	for i := range status.Tenants {
+		if status.Tenants[i].Result == CampaignTenantUpgrading {
+			c.checkCampaignTenant(campaign, &status.Tenants[i])
+			upgrading = upgrading || status.Tenants[i].Result == CampaignTenantUpgrading
+		}
+	}
+	c.countCampaignResults(campaign)
+	if upgrading {
+		status.Message = fmt.Sprintf("Upgrading batch %d", status.Batch)
+		return campaignPollInterval
+	}
+
+	if status.failureThresholdCrossed(campaign.Spec.MaxFailurePercent) {
+		c.finishCampaign(campaign, CampaignHalted, fmt.Sprintf("Halted after batch %d, %d of %d upgrades failed", status.Batch, status.Failed, status.Succeeded+status.Failed))
+		return 0
+	}
+
+	pending := pendingCampaignTenants(campaign)
+	if len(pending) == 0 {
+		c.finishCampaign(campaign, CampaignCompleted, fmt.Sprintf("%d tenants upgraded, %d failed", status.Succeeded, status.Failed))
+		return 0
+	}
+
+	// Pause between batches
+	if status.Batch > 0 && status.NextBatchTime == nil {
+		next := metav1.NewTime(now.Add(campaign.Spec.Pause.Duration))
+		status.NextBatchTime = &next
+	}
+	if status.NextBatchTime != nil && now.Before(status.NextBatchTime) {
+		status.Message = fmt.Sprintf("Waiting to start batch %d", status.Batch+1)
+		return status.NextBatchTime.Sub(now.Time)
+	}
+
+	batchSize := campaign.Spec.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if len(pending) > batchSize {
+		pending = pending[:batchSize]
+	}
+
+	status.Batch++
+	status.NextBatchTime = nil
+	status.Message = fmt.Sprintf("Upgrading batch %d", status.Batch)
+	for _, i := range pending {
+		c.startCampaignTenant(campaign, &status.Tenants[i])
+	}
+	c.countCampaignResults(campaign)
+	return campaignPollInterval
+}
+
+// Record every managed tenant on a new campaign
+func (c *Controller) startCampaign(campaign *UpgradeCampaign) error {
+	if _, ok := c.current().Releases.Find(campaign.Spec.Release); !ok || campaign.Spec.Release == "" {
+		return fmt.Errorf("unknown release %s", campaign.Spec.Release)
+	}
+
+	instances, err := c.listInstances()
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	campaign.Status.Phase = CampaignRunning
+	campaign.Status.StartTime = &now
+	campaign.Status.Message = "Started"
+	campaign.Status.Tenants = nil
+	for _, instance := range instances {
+		if instance.CurrentPhase() == PhaseDeleting {
+			continue
+		}
+		campaign.Status.Tenants = append(campaign.Status.Tenants, CampaignTenant{
+			Name:   instance.TenantName(),
+			Result: CampaignTenantPending,
+		})
+	}
+	return nil
+}
+
+// Ask for a tenant to be upgraded to the release of the campaign.  Tenants which already run the release, or are not
+// ready, are skipped
+func (c *Controller) startCampaignTenant(campaign *UpgradeCampaign, member *CampaignTenant) {
+	now := metav1.Now()
+	member.Batch = campaign.Status.Batch
+	member.StartTime = &now
+
+	instance, exists, err := c.instanceForTenant(member.Name)
+	if err == nil && exists {
+		// Read the latest version so the upgrade request is not rejected as a conflict
+		instance, err = c.getInstance(instance.Name)
+	}
+	switch {
+	case err != nil:
+		member.Result, member.Message = CampaignTenantFailed, err.Error()
+	case !exists || instance.CurrentPhase() == PhaseDeleting:
+		member.Result, member.Message = CampaignTenantSkipped, "tenant has been deleted"
+	case instance.Status.Release == campaign.Spec.Release:
+		member.Result, member.Message = CampaignTenantSkipped, "tenant already runs release "+campaign.Spec.Release
+	case instance.Spec.Release == campaign.Spec.Release:
+		// Requested before the provisioner restarted
+		member.Result, member.Message = CampaignTenantUpgrading, ""
+	case instance.CurrentPhase() != PhaseReady || (instance.Spec.Release != "" && instance.Spec.Release != instance.Status.Release):
+		member.Result, member.Message = CampaignTenantSkipped, fmt.Sprintf("tenant is %s", instance.CurrentPhase())
+	default:
+		if err := c.requestUpgrade(context.Background(), instance, campaign.Spec.Release, ""); err != nil {
+			member.Result, member.Message = CampaignTenantFailed, err.Error()
+			return
+		}
+		member.Result, member.Message = CampaignTenantUpgrading, ""
+	}
+}
+
+// Look at the upgrade history of a tenant being upgraded by the campaign for the result of its upgrade
+func (c *Controller) checkCampaignTenant(campaign *UpgradeCampaign, member *CampaignTenant) {
+	instance, exists, err := c.instanceForTenant(member.Name)
+	if err != nil {
+		return
+	}
+	if !exists {
+		member.Result, member.Message = CampaignTenantFailed, "tenant was deleted while being upgraded"
+		return
+	}
+	if instance.CurrentPhase() == PhaseFailed {
+		member.Result, member.Message = CampaignTenantFailed, instance.Status.Error
+		return
+	}
+
+	for i := len(instance.Status.Upgrades) - 1; i >= 0; i-- {
+		upgrade := instance.Status.Upgrades[i]
+		if upgrade.To != campaign.Spec.Release || (member.StartTime != nil && upgrade.StartTime.Before(member.StartTime)) {
+			continue
+		}
+		switch upgrade.Result {
+		case UpgradeSucceeded:
+			member.Result, member.Message = CampaignTenantSucceeded, ""
+		case UpgradeRolledBack, UpgradeFailed:
+			member.Result, member.Message = CampaignTenantFailed, upgrade.Message
+		}
+		return
+	}
+}
+
+// Indexes of the tenants the campaign has not got to yet
+func pendingCampaignTenants(campaign *UpgradeCampaign) []int {
+	var pending []int
+	for i, tenant := range campaign.Status.Tenants {
+		if tenant.Result == CampaignTenantPending {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+func (c *Controller) countCampaignResults(campaign *UpgradeCampaign) {
+	campaign.Status.Succeeded, campaign.Status.Failed = 0, 0
+	for _, tenant := range campaign.Status.Tenants {
+		switch tenant.Result {
+		case CampaignTenantSucceeded:
+			campaign.Status.Succeeded++
+		case CampaignTenantFailed:
+			campaign.Status.Failed++
+		}
+	}
+}
+
+func (c *Controller) finishCampaign(campaign *UpgradeCampaign, phase CampaignPhase, message string) {
+	now := metav1.Now()
+	campaign.Status.Phase = phase
+	campaign.Status.Message = message
+	campaign.Status.NextBatchTime = nil
+	campaign.Status.CompletionTime = &now
+}
+
+// Create a campaign, returning it with the name it was given
+func (c *Controller) createCampaign(ctx context.Context, campaign *UpgradeCampaign) (*UpgradeCampaign, error) {
+	obj, err := campaignToUnstructured(campaign)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err = c.campaigns.Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return campaignFromUnstructured(obj)
+}
+
+// Look up a campaign by its id
+func (c *Controller) campaignByID(id string) (*UpgradeCampaign, bool, error) {
+	obj, exists, err := c.campaignInformer.GetIndexer().GetByKey(id)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	campaign, err := campaignFromUnstructured(obj)
+	return campaign, err == nil, err
+}
+
+func (c *Controller) updateCampaignStatus(campaign *UpgradeCampaign) error {
+	obj, err := campaignToUnstructured(campaign)
+	if err != nil {
+		return err
+	}
+	_, err = c.campaigns.UpdateStatus(context.Background(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+func campaignFromUnstructured(obj interface{}) (*UpgradeCampaign, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errNotUnstructured
+	}
+
+	campaign := &UpgradeCampaign{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, campaign)
+	return campaign, err
+}
+
+func campaignToUnstructured(campaign *UpgradeCampaign) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(campaign)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,228 @@
+package provisioner
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+	"time"
+)
+
+func TestFailureThresholdCrossed(t *testing.T) {
+	tests := []struct {
+		succeeded         int
+		failed            int
+		maxFailurePercent int
+		crossed           bool
+	}{
+		{succeeded: 0, failed: 0, maxFailurePercent: 0, crossed: false},
+		{succeeded: 4, failed: 0, maxFailurePercent: 0, crossed: false},
+		{succeeded: 9, failed: 1, maxFailurePercent: 0, crossed: true},
+		{succeeded: 9, failed: 1, maxFailurePercent: 10, crossed: false},
+		{succeeded: 8, failed: 2, maxFailurePercent: 10, crossed: true},
+		{succeeded: 1, failed: 1, maxFailurePercent: 50, crossed: false},
+		{succeeded: 0, failed: 1, maxFailurePercent: 100, crossed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d of %d under %d%%", test.failed, test.succeeded+test.failed, test.maxFailurePercent), func(t *testing.T) {
+			status := UpgradeCampaignStatus{Succeeded: test.succeeded, Failed: test.failed}
+			if crossed := status.failureThresholdCrossed(test.maxFailurePercent); crossed != test.crossed {
+				t.Errorf("expected the threshold to be crossed %t, got %t", test.crossed, crossed)
+			}
+		})
+	}
+}
+
+// A controller under test holding ready tenants on release 0.1 of a catalogue which also has release 0.2
+func newCampaignController(t *testing.T, tenants ...*SaaSInstance) *Controller {
+	var objects []runtime.Object
+	for _, instance := range tenants {
+		obj, err := instanceToUnstructured(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, obj)
+	}
+	c, _, _ := newTestController(t, objects...)
+	for _, obj := range objects {
+		if err := c.instanceInformer.GetIndexer().Add(obj.DeepCopyObject()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := testSettings(t)
+	settings.Releases = &ReleaseCatalogue{Default: "0.1", Releases: []Release{{Name: "0.1"}, {Name: "0.2"}}}
+	c.settings.Store(&settings)
+	return c
+}
+
+func readyTenant(name string, release string) *SaaSInstance {
+	instance := newSaaSInstance(name)
+	instance.Spec.Release = release
+	instance.Status.Phase = PhaseReady
+	instance.Status.Release = release
+	return instance
+}
+
+// Finish the upgrades of the tenants the campaign is upgrading, failing those named
+func finishCampaignUpgrades(t *testing.T, c *Controller, campaign *UpgradeCampaign, failed ...string) {
+	for _, member := range campaign.Status.Tenants {
+		if member.Result != CampaignTenantUpgrading {
+			continue
+		}
+		instance, _, err := c.instanceForTenant(member.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upgrade := Upgrade{From: "0.1", To: campaign.Spec.Release, StartTime: metav1.Now(), Result: UpgradeSucceeded}
+		for _, name := range failed {
+			if name == member.Name {
+				upgrade.Result, upgrade.Message = UpgradeRolledBack, "backend deployment was not ready"
+			}
+		}
+		instance.Status.Upgrades = append(instance.Status.Upgrades, upgrade)
+		obj, err := instanceToUnstructured(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.instanceInformer.GetIndexer().Update(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Move a campaign on by one step and read it back as it was recorded, as the next reconcile would
+func advance(t *testing.T, c *Controller, campaign *UpgradeCampaign) *UpgradeCampaign {
+	c.advanceCampaign(campaign)
+	obj, err := campaignToUnstructured(campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := campaignFromUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recorded
+}
+
+// Names of the tenants of a campaign with the given result
+func campaignTenants(campaign *UpgradeCampaign, result string) []string {
+	var names []string
+	for _, member := range campaign.Status.Tenants {
+		if member.Result == result {
+			names = append(names, member.Name)
+		}
+	}
+	return names
+}
+
+// Tenants are upgraded a batch at a time, skipping those which can not be upgraded, until every tenant has been
+func TestCampaignBatches(t *testing.T) {
+	deleting := readyTenant("team-e", "0.1")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	failed := readyTenant("team-f", "0.1")
+	failed.Status.Phase = PhaseFailed
+	c := newCampaignController(t,
+		readyTenant("team-a", "0.1"),
+		readyTenant("team-b", "0.1"),
+		readyTenant("team-c", "0.1"),
+		readyTenant("team-d", "0.2"),
+		deleting,
+		failed,
+	)
+	campaign := newUpgradeCampaign(UpgradeCampaignSpec{Release: "0.2", BatchSize: 2})
+
+	campaign = advance(t, c, campaign)
+	if campaign.Status.Phase != CampaignRunning || len(campaign.Status.Tenants) != 5 {
+		t.Fatalf("expected the campaign to start with every tenant not being deleted, got %s with %+v", campaign.Status.Phase, campaign.Status.Tenants)
+	}
+
+	for batch := 1; len(pendingCampaignTenants(campaign)) > 0; batch++ {
+		pending := len(pendingCampaignTenants(campaign))
+		campaign = advance(t, c, campaign)
+		if campaign.Status.Batch != batch {
+			t.Fatalf("expected batch %d to start, got batch %d", batch, campaign.Status.Batch)
+		}
+		started := 0
+		for _, member := range campaign.Status.Tenants {
+			if member.Batch == batch {
+				started++
+			}
+		}
+		if expected := min(2, pending); started != expected {
+			t.Errorf("expected %d tenants in batch %d, got %d", expected, batch, started)
+		}
+		finishCampaignUpgrades(t, c, campaign)
+	}
+	// Each step collects the results of the running batch and, without a pause, starts the next.  The last completes
+	campaign = advance(t, c, campaign)
+
+	if campaign.Status.Phase != CampaignCompleted {
+		t.Errorf("expected the campaign to complete, got %s: %s", campaign.Status.Phase, campaign.Status.Message)
+	}
+	if succeeded := campaignTenants(campaign, CampaignTenantSucceeded); len(succeeded) != 3 || campaign.Status.Succeeded != 3 {
+		t.Errorf("expected the three tenants on 0.1 to be upgraded, got %v", succeeded)
+	}
+	if skipped := campaignTenants(campaign, CampaignTenantSkipped); len(skipped) != 2 {
+		t.Errorf("expected the tenant already on 0.2 and the failed tenant to be skipped, got %v", skipped)
+	}
+	for _, name := range []string{"team-a", "team-b", "team-c"} {
+		instance, err := c.getInstance(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance.Spec.Release != "0.2" {
+			t.Errorf("expected %s to be asked to upgrade to 0.2, got %q", name, instance.Spec.Release)
+		}
+	}
+}
+
+// A campaign halts once the share of failed upgrades is above its threshold, leaving the tenants it has not got to
+func TestCampaignHalts(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxFailurePercent int
+		phase             CampaignPhase
+	}{
+		{name: "any failure", maxFailurePercent: 0, phase: CampaignHalted},
+		{name: "within the threshold", maxFailurePercent: 50, phase: CampaignRunning},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newCampaignController(t,
+				readyTenant("team-a", "0.1"),
+				readyTenant("team-b", "0.1"),
+				readyTenant("team-c", "0.1"),
+				readyTenant("team-d", "0.1"),
+			)
+			campaign := newUpgradeCampaign(UpgradeCampaignSpec{Release: "0.2", BatchSize: 2, MaxFailurePercent: test.maxFailurePercent})
+			campaign.Spec.Pause = metav1.Duration{Duration: time.Hour}
+
+			campaign = advance(t, c, campaign)
+			campaign = advance(t, c, campaign)
+			upgrading := campaignTenants(campaign, CampaignTenantUpgrading)
+			finishCampaignUpgrades(t, c, campaign, upgrading[0])
+			campaign = advance(t, c, campaign)
+
+			if campaign.Status.Phase != test.phase || campaign.Status.Failed != 1 || campaign.Status.Succeeded != 1 {
+				t.Errorf("expected the campaign to be %s after one of two upgrades failed, got %s: %s", test.phase, campaign.Status.Phase, campaign.Status.Message)
+			}
+			if pending := campaignTenants(campaign, CampaignTenantPending); len(pending) != 2 {
+				t.Errorf("expected the second batch not to have started, got %v pending", pending)
+			}
+			if test.phase == CampaignRunning && campaign.Status.NextBatchTime == nil {
+				t.Error("expected the campaign to pause before the next batch")
+			}
+		})
+	}
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,629 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/bennerv/provisioning-api/pkg/api/tracing"
+	"github.com/bennerv/provisioning-api/pkg/api/webhook"
+	"github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sync/atomic"
+	"time"
+)
+
+// Index of SaaSInstances by the name of their tenant namespace
+const tenantIndex = "tenant"
+
+var errNotUnstructured = errors.New("object is not unstructured")
+
+// Reconciles SaaSInstance custom resources into a provisioned tenant namespace.  Changes to the namespace or the
+// deployments inside it re-queue the owning SaaSInstance so drift from the desired state is corrected
+type Controller struct {
+	clientset  kubernetes.Interface
+	instances  dynamic.NamespaceableResourceInterface
+	campaigns  dynamic.NamespaceableResourceInterface
+	operations dynamic.NamespaceableResourceInterface
+	// Holds the *Settings in use, replaced when the configuration is reloaded
+	settings atomic.Value
+	webhooks *webhook.Dispatcher
+	// Method the bare owners of tenants created before owners were subjects are qualified with, if any
+	legacyOwnerMethod string
+	events            record.EventBroadcaster
+	recorder          record.EventRecorder
+	// Context the controller runs in, cancelled when it stops.  Set once when the controller is made, as the handlers
+	// read it while the controller runs
+	ctx context.Context
+
+	instanceInformer  cache.SharedIndexInformer
+	campaignInformer  cache.SharedIndexInformer
+	operationInformer cache.SharedIndexInformer
+	namespaceInformer cache.SharedIndexInformer
+	dynamicFactory    dynamicinformer.DynamicSharedInformerFactory
+	factory           informers.SharedInformerFactory
+
+	queue          workqueue.RateLimitingInterface
+	campaignQueue  workqueue.RateLimitingInterface
+	operationQueue workqueue.RateLimitingInterface
+	provisioning   *provisionQueue
+	progress       *progressHub
+	// Items the workers are busy with, and whether the informer caches have synced, for the probes
+	heartbeats *heartbeats
+	synced     int32
+}
+
+// Make a controller which runs until the context is cancelled
+func NewController(ctx context.Context, cs kubernetes.Interface, dc dynamic.Interface, settings Settings, webhooks *webhook.Dispatcher, legacyOwnerMethod string, resync time.Duration) *Controller {
+	c := &Controller{
+		ctx:               ctx,
+		clientset:         cs,
+		legacyOwnerMethod: legacyOwnerMethod,
+		instances:         dc.Resource(saasInstanceGVR),
+		campaigns:         dc.Resource(upgradeCampaignGVR),
+		operations:        dc.Resource(operationGVR),
+		dynamicFactory:    dynamicinformer.NewDynamicSharedInformerFactory(dc, resync),
+		factory:           informers.NewSharedInformerFactory(cs, resync),
+		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "saasinstances"),
+		campaignQueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "upgradecampaigns"),
+		operationQueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "operations"),
+		webhooks:          webhooks,
+		progress:          newProgressHub(),
+		heartbeats:        newHeartbeats(),
+		events:            newEventBroadcaster(cs),
+	}
+	c.recorder = newEventRecorder(c.events)
+	c.settings.Store(&settings)
+	c.provisioning = newProvisionQueue(settings.Jobs.Workers, settings.Jobs.QueueSize, func(name string) { c.queue.Add(name) })
+	c.registerMetrics()
+
+	c.instanceInformer = c.dynamicFactory.ForResource(saasInstanceGVR).Informer()
+	_ = c.instanceInformer.AddIndexers(cache.Indexers{
+		tenantIndex: func(obj interface{}) ([]string, error) {
+			instance, err := instanceFromUnstructured(obj)
+			if err != nil {
+				return nil, err
+			}
+			return []string{instance.TenantName()}, nil
+		},
+	})
+	c.instanceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	// Clients streaming the progress of a tenant are sent every transition of its instance
+	c.instanceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.publishProgress,
+		UpdateFunc: func(_, obj interface{}) { c.publishProgress(obj) },
+		DeleteFunc: c.publishDeleted,
+	})
+	// Lifecycle events of tenants, such as a tenant becoming ready, are sent to the webhooks
+	c.instanceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.notifyLifecycle,
+		DeleteFunc: c.notifyDeleted,
+	})
+	// Operations follow their tenant, so any change to an instance re-queues the operations acting on it
+	c.instanceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueOperations,
+		UpdateFunc: func(_, obj interface{}) { c.enqueueOperations(obj) },
+		DeleteFunc: c.enqueueOperations,
+	})
+
+	// Campaigns re-queue themselves until they finish, so only new campaigns need queueing
+	c.campaignInformer = c.dynamicFactory.ForResource(upgradeCampaignGVR).Informer()
+	c.campaignInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+				c.campaignQueue.Add(key)
+			}
+		},
+	})
+
+	// Operations re-queue themselves until they have finished and expired
+	c.operationInformer = c.dynamicFactory.ForResource(operationGVR).Informer()
+	_ = c.operationInformer.AddIndexers(cache.Indexers{
+		operationTenantIndex: func(obj interface{}) ([]string, error) {
+			operation, err := operationFromUnstructured(obj)
+			if err != nil {
+				return nil, err
+			}
+			return []string{operation.Spec.Tenant}, nil
+		},
+	})
+	c.operationInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+				c.operationQueue.Add(key)
+			}
+		},
+	})
+
+	// Anything changing inside a tenant namespace re-queues the SaaSInstance owning it
+	tenantHandler := cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) { c.enqueueTenant(obj) },
+		DeleteFunc: c.enqueueTenant,
+	}
+	c.namespaceInformer = c.factory.Core().V1().Namespaces().Informer()
+	c.namespaceInformer.AddEventHandler(tenantHandler)
+	c.factory.Apps().V1().Deployments().Informer().AddEventHandler(tenantHandler)
+
+	return c
+}
+
+// Start the informers and workers, blocking until the context of the controller is cancelled
+func (c *Controller) Run(workers int) error {
+	ctx := c.ctx
+	defer c.queue.ShutDown()
+	defer c.campaignQueue.ShutDown()
+	defer c.operationQueue.ShutDown()
+	defer c.events.Shutdown()
+
+	c.dynamicFactory.Start(ctx.Done())
+	c.factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.instanceInformer.HasSynced, c.namespaceInformer.HasSynced, c.campaignInformer.HasSynced, c.operationInformer.HasSynced) {
+		return errors.New("timed out waiting for caches to sync")
+	}
+	atomic.StoreInt32(&c.synced, 1)
+
+	// Namespaces provisioned before the SaaSInstance resource existed get one created for them
+	if err := c.adoptNamespaces(ctx); err != nil {
+		logging.Root().WithError(err).Error("Failed to adopt existing namespaces")
+	}
+	if err := c.migrateOwners(ctx); err != nil {
+		logging.Root().WithError(err).Error("Failed to migrate the owners of tenants")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx.Done())
+	}
+	go wait.Until(c.runCampaignWorker, time.Second, ctx.Done())
+	go wait.Until(c.runOperationWorker, time.Second, ctx.Done())
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logging.Root().WithError(err).Error("Failed to queue object")
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Queue the SaaSInstance owning a namespace, or the namespace an object is in
+func (c *Controller) enqueueTenant(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+
+	tenantName := object.GetNamespace()
+	if _, isNamespace := obj.(*corev1.Namespace); isNamespace {
+		tenantName = object.GetName()
+	}
+
+	instances, err := c.instanceInformer.GetIndexer().ByIndex(tenantIndex, tenantName)
+	if err != nil {
+		return
+	}
+	for _, instance := range instances {
+		c.enqueue(instance)
+	}
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	c.heartbeats.start(instanceItem(key.(string)))
+	defer c.heartbeats.stop(instanceItem(key.(string)))
+
+	if err := c.reconcile(key.(string)); err != nil {
+		logging.Root().WithField("instance", key).WithError(err).Error("Failed to reconcile SaaSInstance")
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) runCampaignWorker() {
+	for c.processNextCampaign() {
+	}
+}
+
+func (c *Controller) processNextCampaign() bool {
+	key, quit := c.campaignQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.campaignQueue.Done(key)
+	c.heartbeats.start("upgradecampaign/" + key.(string))
+	defer c.heartbeats.stop("upgradecampaign/" + key.(string))
+
+	requeue, err := c.reconcileCampaign(key.(string))
+	if err != nil {
+		logging.Root().WithField("campaign", key).WithError(err).Error("Failed to reconcile UpgradeCampaign")
+		c.campaignQueue.AddRateLimited(key)
+		return true
+	}
+
+	c.campaignQueue.Forget(key)
+	if requeue > 0 {
+		c.campaignQueue.AddAfter(key, requeue)
+	}
+	return true
+}
+
+func (c *Controller) runOperationWorker() {
+	for c.processNextOperation() {
+	}
+}
+
+func (c *Controller) processNextOperation() bool {
+	key, quit := c.operationQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.operationQueue.Done(key)
+	c.heartbeats.start("operation/" + key.(string))
+	defer c.heartbeats.stop("operation/" + key.(string))
+
+	requeue, err := c.reconcileOperation(key.(string))
+	if err != nil {
+		logging.Root().WithField("operation", key).WithError(err).Error("Failed to reconcile Operation")
+		c.operationQueue.AddRateLimited(key)
+		return true
+	}
+
+	c.operationQueue.Forget(key)
+	if requeue > 0 {
+		c.operationQueue.AddAfter(key, requeue)
+	}
+	return true
+}
+
+// Bring a single SaaSInstance to its desired state.  The instance is read from the API server rather than the informer
+// cache so a stale status never causes a completed step to be run twice
+func (c *Controller) reconcile(name string) error {
+	obj, err := c.instances.Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		c.provisioning.forget(name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	t := c.tenantFor(instance)
+	if instance.DeletionTimestamp != nil {
+		c.provisioning.forget(name)
+		return t.finalize()
+	}
+	if !hasFinalizer(instance) {
+		// Adding the finalizer re-queues the instance
+		return t.setFinalizers(append(instance.Finalizers, namespaceFinalizer))
+	}
+
+	switch instance.Status.Phase {
+	case "":
+		// Updating the status re-queues the instance
+		return t.initializeStatus()
+	case PhaseFailed:
+		c.provisioning.forget(name)
+		if instance.Status.NextRetryTime == nil {
+			return nil
+		}
+		if wait := time.Until(instance.Status.NextRetryTime.Time); wait > 0 {
+			c.queue.AddAfter(name, wait)
+			return nil
+		}
+		// Updating the status re-queues the instance
+		return t.recordRetry()
+	}
+
+	if instance.Status.Phase == PhaseReady || instance.Status.Phase == PhaseUpgrading {
+		c.provisioning.forget(name)
+		if err := t.ensureNamespace(); err != nil {
+			return err
+		}
+		if instance.Status.Release == "" && instance.Status.Phase == PhaseReady {
+			// Tenants provisioned before releases were recorded run the release in their spec.  Updating the status
+			// re-queues the instance
+			return t.recordRelease()
+		}
+		if t.upgradePending() {
+			span := t.startTrace("upgrade")
+			defer span.End()
+			err := t.upgrade()
+			tracing.RecordError(span, err)
+			return err
+		}
+		err := t.repair()
+		var notReady *notReadyError
+		if errors.As(err, &notReady) {
+			t.log.WithError(err).Debug("Repaired tenant is not ready yet")
+			c.queue.AddAfter(name, repairRecheckInterval)
+			return nil
+		}
+		return err
+	}
+
+	// Only a bounded number of tenants are provisioned at once, the others wait until a slot frees up for them
+	if !c.provisioning.start(instance) {
+		return t.recordQueued()
+	}
+	defer c.provisioning.done(name)
+
+	span := t.startTrace("provision")
+	defer span.End()
+	if err := t.ensureNamespace(); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	err = t.provision(instance.Status.Step)
+	tracing.RecordError(span, err)
+	return err
+}
+
+// Position of a tenant waiting to be provisioned starting from one, or zero if it is not waiting
+func (c *Controller) queuePosition(instance *SaaSInstance) int {
+	return c.provisioning.position(instance.Name)
+}
+
+// Reserve a place in the provisioning queue for a new instance, or say why it can not be accepted.  The error is
+// ErrQueueFull when the provisioning queue is full and ErrOwnerQueueFull when the owner already has too many tenants
+// waiting.  An admitted instance which is not created has its place given back by withdraw
+func (c *Controller) admit(instance *SaaSInstance) error {
+	return c.provisioning.admit(instance.Name, instance.Spec.Owner, c.current().Jobs.QueuedPerOwner)
+}
+
+// Give back the place in the provisioning queue of an instance which was admitted but could not be created
+func (c *Controller) withdraw(instance *SaaSInstance) {
+	c.provisioning.release(instance.Name)
+}
+
+func (c *Controller) tenantFor(instance *SaaSInstance) *tenant {
+	settings := c.current()
+	return &tenant{
+		name:      instance.TenantName(),
+		clientset: c.clientset,
+		instances: c.instances,
+		instance:  instance,
+		blueprint: settings.Blueprint,
+		settings:  settings.Tenants,
+		releases:  settings.Releases,
+		retry:     settings.Retry,
+		readiness: settings.Readiness,
+		recorder:  c.recorder,
+		log:       instanceLogger(instance),
+		heartbeat: func() { c.heartbeats.beat(instanceItem(instance.Name)) },
+		ctx:       c.ctx,
+	}
+}
+
+// Item a worker reconciling an instance is busy with
+func instanceItem(name string) string {
+	return "saasinstance/" + name
+}
+
+// Logger for the work done on an instance, carrying the id of the request which asked for it
+func instanceLogger(instance *SaaSInstance) *logrus.Entry {
+	log := logging.Root().WithField(logging.FieldTenant, instance.TenantName())
+	if requestID := instance.Annotations[requestIDAnnotation]; requestID != "" {
+		log = log.WithField(logging.FieldRequestID, requestID)
+	}
+	return log
+}
+
+// Look up a SaaSInstance by the name of its tenant namespace
+func (c *Controller) instanceForTenant(tenantName string) (*SaaSInstance, bool, error) {
+	objs, err := c.instanceInformer.GetIndexer().ByIndex(tenantIndex, tenantName)
+	if err != nil || len(objs) == 0 {
+		return nil, false, err
+	}
+
+	instance, err := instanceFromUnstructured(objs[0])
+	return instance, err == nil, err
+}
+
+// Read the latest version of a SaaSInstance from the API server
+func (c *Controller) getInstance(name string) (*SaaSInstance, error) {
+	obj, err := c.instances.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return instanceFromUnstructured(obj)
+}
+
+// List every SaaSInstance known to the controller
+func (c *Controller) listInstances() ([]*SaaSInstance, error) {
+	var instances []*SaaSInstance
+	for _, obj := range c.instanceInformer.GetIndexer().List() {
+		instance, err := instanceFromUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// Create a SaaSInstance for a new tenant
+func (c *Controller) createInstance(ctx context.Context, instance *SaaSInstance) error {
+	for key, value := range requestAnnotations(ctx) {
+		if value, ok := value.(string); ok {
+			if instance.Annotations == nil {
+				instance.Annotations = map[string]string{}
+			}
+			instance.Annotations[key] = value
+		}
+	}
+
+	obj, err := instanceToUnstructured(instance)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.instances.Create(ctx, obj, metav1.CreateOptions{})
+	return err
+}
+
+// Ask for a tenant to be upgraded to a release, for the operation with the given id if there is one.  The resource
+// version is part of the patch so an instance which has changed since it was read is not upgraded.  Image tag
+// overrides are dropped, the tenant runs the release images, and are kept in an annotation for the upgrade to restore
+// if it is rolled back
+func (c *Controller) requestUpgrade(ctx context.Context, instance *SaaSInstance, release string, operation string) error {
+	annotations := requestAnnotations(ctx)
+	previous, _ := json.Marshal(previousVersions{Release: release, Versions: instance.Spec.Versions})
+	annotations[previousVersionsAnnotation] = string(previous)
+	annotations[operationAnnotation] = nil
+	if operation != "" {
+		annotations[operationAnnotation] = operation
+	}
+	upgradePatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": instance.ResourceVersion, "annotations": annotations},
+		"spec":     map[string]interface{}{"release": release, "versions": nil},
+	})
+	_, err := c.instances.Patch(ctx, instance.Name, types.MergePatchType, upgradePatch, metav1.PatchOptions{})
+	return err
+}
+
+// Retry provisioning a failed tenant from its failed step
+func (c *Controller) retryInstance(ctx context.Context, instance *SaaSInstance) error {
+	if err := c.annotateRequest(ctx, instance.Name); err != nil {
+		return err
+	}
+	return c.tenantFor(instance).recordManualRetry()
+}
+
+// Delete the SaaSInstance of a tenant, the instance is kept in the Deleting phase until its namespace has been deleted
+func (c *Controller) deleteInstance(ctx context.Context, name string) error {
+	if err := c.annotateRequest(ctx, name); err != nil {
+		return err
+	}
+	return c.instances.Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+// Record the id of the request in the context on an instance, so the work the controller does for the request logs
+// with the same request id
+func (c *Controller) annotateRequest(ctx context.Context, name string) error {
+	annotationsPatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": requestAnnotations(ctx)},
+	})
+	_, err := c.instances.Patch(ctx, name, types.MergePatchType, annotationsPatch, metav1.PatchOptions{})
+	return err
+}
+
+// Annotations patched onto an instance for the request in the context, its id and the traceparent of its span.  Work
+// which is not done for a request, such as a campaign, removes the annotations of an earlier request
+func requestAnnotations(ctx context.Context) map[string]interface{} {
+	annotations := map[string]interface{}{requestIDAnnotation: nil, traceParentAnnotation: nil}
+	if requestID := middleware.GetReqID(ctx); requestID != "" {
+		annotations[requestIDAnnotation] = requestID
+	}
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		annotations[traceParentAnnotation] = traceParent
+	}
+	return annotations
+}
+
+// Qualify the bare owners of instances and requesters of operations, recorded before they were subjects, with the
+// legacy owner method.  The owner label and annotation of a tenant namespace follow once its instance is reconciled.
+// Without a legacy method they are left alone, and only admins can reach those tenants
+func (c *Controller) migrateOwners(ctx context.Context) error {
+	unqualified := 0
+	migrate := func(resource dynamic.NamespaceableResourceInterface, name string, field string, owner string) error {
+		if owner == "" || auth.IsSubject(owner) {
+			return nil
+		}
+		if c.legacyOwnerMethod == "" {
+			unqualified++
+			return nil
+		}
+		ownerPatch, _ := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{field: auth.Subject(c.legacyOwnerMethod, owner)},
+		})
+		_, err := resource.Patch(ctx, name, types.MergePatchType, ownerPatch, metav1.PatchOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, obj := range c.instanceInformer.GetIndexer().List() {
+		if instance, err := instanceFromUnstructured(obj); err == nil {
+			if err := migrate(c.instances, instance.Name, "owner", instance.Spec.Owner); err != nil {
+				return err
+			}
+		}
+	}
+	for _, obj := range c.operationInformer.GetIndexer().List() {
+		if operation, err := operationFromUnstructured(obj); err == nil {
+			if err := migrate(c.operations, operation.Name, "requester", operation.Spec.Requester); err != nil {
+				return err
+			}
+		}
+	}
+
+	if unqualified > 0 {
+		logging.Root().WithField("count", unqualified).Warn("Tenants and operations have owners without an authentication method, only admins can reach them until Auth.LegacyOwnerMethod is set")
+	}
+	return nil
+}
+
+// Create a SaaSInstance for every managed namespace which does not have one, carrying over the progress recorded in
+// the namespace annotations
+func (c *Controller) adoptNamespaces(ctx context.Context) error {
+	for _, obj := range c.namespaceInformer.GetIndexer().List() {
+		namespace := obj.(*corev1.Namespace)
+		annotations := namespace.GetAnnotations()
+		if annotations == nil || annotations["manager"] != "saas" || namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+
+		if _, exists, _ := c.instanceForTenant(namespace.Name); exists {
+			continue
+		}
+
+		// The progress recorded on the namespace is carried over when the instance status is initialized
+		logging.Root().WithFields(logrus.Fields{logging.FieldTenant: namespace.Name, logging.FieldStep: annotations["step"]}).Info("Adopting namespace")
+		if err := c.createInstance(ctx, newSaaSInstance(namespace.Name)); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+
+	return nil
+}
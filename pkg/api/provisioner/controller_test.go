@@ -0,0 +1,170 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/blueprint"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A controller working against fake clients which hold the given objects.  Custom resources are given as unstructured
+// objects, everything else is served by the fake clientset
+func newTestController(t *testing.T, objects ...runtime.Object) (*Controller, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	var kubeObjects, customObjects []runtime.Object
+	for _, obj := range objects {
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			customObjects = append(customObjects, obj)
+		} else {
+			kubeObjects = append(kubeObjects, obj)
+		}
+	}
+	cs := fake.NewSimpleClientset(kubeObjects...)
+	serveApplies(cs)
+	serveDeleteCollections(cs)
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), customObjects...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := NewController(ctx, cs, dc, testSettings(t), nil, "", 0)
+	// Events of the fake clientset are recorded in the wrong namespace, and are not what these tests look at
+	c.recorder = &record.FakeRecorder{}
+	return c, cs, dc
+}
+
+// Serve the server side applies of the provisioner from the objects of a fake clientset, which only serves the other
+// kinds of patch.  Missing objects are created and existing ones strategic merge patched, which is close enough to an
+// apply for the fields the provisioner sets
+func serveApplies(cs *fake.Clientset) {
+	decoder := scheme.Codecs.UniversalDeserializer()
+	cs.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		applied, _, err := decoder.Decode(patch.GetPatch(), nil, nil)
+		if err != nil {
+			return true, nil, err
+		}
+
+		tracker := cs.Tracker()
+		existing, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if apierrors.IsNotFound(err) {
+			return true, applied, tracker.Create(patch.GetResource(), applied, patch.GetNamespace())
+		} else if err != nil {
+			return true, nil, err
+		}
+
+		original, err := json.Marshal(existing)
+		if err != nil {
+			return true, nil, err
+		}
+		merged, err := strategicpatch.StrategicMergePatch(original, patch.GetPatch(), applied)
+		if err != nil {
+			return true, nil, err
+		}
+		updated, _, err := decoder.Decode(merged, nil, nil)
+		if err != nil {
+			return true, nil, err
+		}
+		return true, updated, tracker.Update(patch.GetResource(), updated, patch.GetNamespace())
+	})
+}
+
+// Serve the collection deletes of a fake clientset, which has no reaction for them, by deleting every object of the
+// resource in the namespace
+func serveDeleteCollections(cs *fake.Clientset) {
+	cs.PrependReactor("delete-collection", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gvr := action.GetResource()
+		for gvk := range scheme.Scheme.AllKnownTypes() {
+			if gvk.GroupVersion() != gvr.GroupVersion() || strings.HasSuffix(gvk.Kind, "List") {
+				continue
+			}
+			if plural, _ := meta.UnsafeGuessKindToResource(gvk); plural != gvr {
+				continue
+			}
+
+			list, err := cs.Tracker().List(gvr, gvk, action.GetNamespace())
+			if err != nil {
+				return true, nil, err
+			}
+			objects, err := meta.ExtractList(list)
+			if err != nil {
+				return true, nil, err
+			}
+			for _, obj := range objects {
+				accessor, err := meta.Accessor(obj)
+				if err != nil {
+					return true, nil, err
+				}
+				if err := cs.Tracker().Delete(gvr, action.GetNamespace(), accessor.GetName()); err != nil {
+					return true, nil, err
+				}
+			}
+			return true, nil, nil
+		}
+		return true, nil, fmt.Errorf("no kind found for %s", gvr)
+	})
+}
+
+// Settings of a controller under test, provisioning from the built in blueprint and release catalogue
+func testSettings(t *testing.T) Settings {
+	bp, err := blueprint.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases, err := LoadReleases("", ComponentImages{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Settings{
+		Blueprint: bp,
+		Tenants:   TenantSettings{Domain: "example.com"},
+		Releases:  releases,
+		Retry:     RetryPolicy{OnFailure: FailurePolicyKeep},
+		Readiness: ReadinessTimeouts{Default: time.Second},
+		Jobs:      JobLimits{Workers: 1},
+	}
+}
+
+func unstructuredOperation(t *testing.T, operation *Operation) *unstructured.Unstructured {
+	obj, err := operationToUnstructured(operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// Handlers make tenants while the controller starts, which must not race with the controller starting.  Run with -race
+func TestTenantsMadeWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewController(ctx, fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), testSettings(t), nil, "", 0)
+	instance := newSaaSInstance("team-a")
+
+	stopped := make(chan error)
+	go func() { stopped <- c.Run(1) }()
+	for c.CheckSynced(ctx) != nil {
+		if c.tenantFor(instance).ctx != ctx {
+			t.Fatal("expected tenants to work in the context of the controller")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+}
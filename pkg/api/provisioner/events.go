@@ -0,0 +1,78 @@
+package provisioner
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component events are reported as coming from
+const eventSource = "saas-provisioner"
+
+// Reasons of the events recorded against tenants
+const (
+	EventQueued         = "Queued"
+	EventStepStarted    = "StepStarted"
+	EventStepCompleted  = "StepCompleted"
+	EventStepFailed     = "StepFailed"
+	EventCleanupFailed  = "CleanupFailed"
+	EventProvisioned    = "Provisioned"
+	EventRetrying       = "Retrying"
+	EventRepairFailed   = "RepairFailed"
+	EventUpgradeStarted = "UpgradeStarted"
+	EventUpgraded       = "Upgraded"
+	EventRolledBack     = "UpgradeRolledBack"
+	EventUpgradeFailed  = "UpgradeFailed"
+	EventDeleting       = "Deleting"
+)
+
+// Broadcaster sending the events recorded by the controller to the API server
+func newEventBroadcaster(cs kubernetes.Interface) record.EventBroadcaster {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	return broadcaster
+}
+
+func newEventRecorder(broadcaster record.EventBroadcaster) record.EventRecorder {
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSource})
+}
+
+// Record an event against the SaaSInstance of the tenant and its namespace, so it shows up when describing either
+func (t *tenant) event(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if t.recorder == nil {
+		return
+	}
+
+	t.recorder.Eventf(&corev1.ObjectReference{
+		APIVersion: saasInstanceGVR.GroupVersion().String(),
+		Kind:       saasInstanceKind,
+		Name:       t.instance.Name,
+		UID:        t.instance.UID,
+	}, eventType, reason, messageFmt, args...)
+
+	if namespace := t.namespaceReference(); namespace != nil {
+		t.recorder.Eventf(namespace, eventType, reason, messageFmt, args...)
+	}
+}
+
+// Reference to the tenant namespace, nil when it does not exist.  Describing a namespace finds its events by its uid,
+// so the uid is looked up the first time it is needed
+func (t *tenant) namespaceReference() *corev1.ObjectReference {
+	if t.namespaceUID == "" {
+		namespace, err := t.clientset.CoreV1().Namespaces().Get(t.callContext(), t.name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		t.namespaceUID = namespace.UID
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       t.name,
+		UID:        t.namespaceUID,
+	}
+}
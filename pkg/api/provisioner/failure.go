@@ -0,0 +1,143 @@
+package provisioner
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+// What is left of a tenant when one of its provisioning steps fails
+type FailurePolicy string
+
+const (
+	// Keep everything created so far for debugging, a retry carries on from the failed step
+	FailurePolicyKeep FailurePolicy = "keep"
+	// Delete everything created inside the namespace, a retry starts again from an empty namespace
+	FailurePolicyRollback FailurePolicy = "rollback"
+	// Delete the namespace, a retry starts again from nothing
+	FailurePolicyDelete FailurePolicy = "delete"
+)
+
+// Longest wait between two provisioning attempts
+const maxRetryBackoff = 30 * time.Minute
+
+// How failed tenants are cleaned up and retried
+type RetryPolicy struct {
+	OnFailure FailurePolicy
+	// Provisioning attempts made before a tenant is left failed, a tenant is never retried automatically when one
+	MaxAttempts int
+	// Wait before the first retry, doubled for every attempt after that
+	Backoff time.Duration
+}
+
+// Parse the name of a failure policy, returning an error for unknown policies
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	switch policy := FailurePolicy(name); policy {
+	case FailurePolicyKeep, FailurePolicyRollback, FailurePolicyDelete:
+		return policy, nil
+	case "":
+		return FailurePolicyKeep, nil
+	}
+	return "", fmt.Errorf("unknown failure policy %s", name)
+}
+
+// Time to wait before retrying a tenant which has failed the given number of attempts, or zero if it is not retried
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	if attempts >= p.MaxAttempts {
+		return 0
+	}
+
+	backoff := p.Backoff
+	for i := 1; i < attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// Record a failed step and clean up after it as the failure policy says.  Nothing is cleaned up when the failure can not
+// be recorded, as the requeued tenant carries on from the last step recorded and runs the failed step again
+func (t *tenant) fail(s step, stepErr error) error {
+	policy := t.retry.OnFailure
+	if err := t.recordFailure(s, stepErr, policy != FailurePolicyKeep); err != nil {
+		return err
+	}
+
+	var err error
+	switch policy {
+	case FailurePolicyRollback:
+		err = t.emptyNamespace()
+	case FailurePolicyDelete:
+		err = t.clientset.CoreV1().Namespaces().Delete(t.callContext(), t.name, metav1.DeleteOptions{})
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		t.log.WithField("policy", policy).WithError(err).Error("Failed to clean up after a failed step")
+		t.event(corev1.EventTypeWarning, EventCleanupFailed, "Cleaning up with the %s failure policy failed: %v", policy, err)
+	}
+	return nil
+}
+
+// Delete every object provisioned into the tenant namespace, leaving the namespace itself
+func (t *tenant) emptyNamespace() error {
+	ctx := t.callContext()
+	everything := metav1.ListOptions{}
+
+	if err := t.clientset.NetworkingV1beta1().Ingresses(t.name).DeleteCollection(ctx, metav1.DeleteOptions{}, everything); err != nil {
+		return err
+	}
+	// Services can not be deleted as a collection
+	services, err := t.clientset.CoreV1().Services(t.name).List(ctx, everything)
+	if err != nil {
+		return err
+	}
+	for _, service := range services.Items {
+		err := t.clientset.CoreV1().Services(t.name).Delete(ctx, service.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	if err := t.clientset.AppsV1().Deployments(t.name).DeleteCollection(ctx, metav1.DeleteOptions{}, everything); err != nil {
+		return err
+	}
+	if err := t.clientset.CoreV1().PersistentVolumeClaims(t.name).DeleteCollection(ctx, metav1.DeleteOptions{}, everything); err != nil {
+		return err
+	}
+	// Only the tenant credentials, the namespace holds service account secrets too
+	for _, secretName := range []string{databaseSecretName, backendSecretName} {
+		err := t.clientset.CoreV1().Secrets(t.name).Delete(ctx, secretName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move a failed tenant back to provisioning straight away, giving it a fresh set of attempts
+func (t *tenant) recordManualRetry() error {
+	t.event(corev1.EventTypeNormal, EventRetrying, "Retrying on request")
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		if status.Phase != PhaseFailed {
+			return
+		}
+		status.Phase = PhaseProvisioning
+		status.Attempts = 0
+		status.NextRetryTime = nil
+		status.Message = "Retrying"
+		status.Error = ""
+	})
+}
+
+// Move a failed tenant whose retry is due back to provisioning
+func (t *tenant) recordRetry() error {
+	t.event(corev1.EventTypeNormal, EventRetrying, "Retrying, attempt %d", t.instance.Status.Attempts+1)
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseProvisioning
+		status.NextRetryTime = nil
+		status.Message = fmt.Sprintf("Retrying, attempt %d", status.Attempts+1)
+		status.Error = ""
+	})
+}
@@ -0,0 +1,175 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+		backoff  time.Duration
+	}{
+		{name: "never retried", policy: RetryPolicy{Backoff: time.Minute}, attempts: 1, backoff: 0},
+		{name: "first retry", policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Minute}, attempts: 1, backoff: time.Minute},
+		{name: "doubled", policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Minute}, attempts: 2, backoff: 2 * time.Minute},
+		{name: "out of attempts", policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Minute}, attempts: 3, backoff: 0},
+		{name: "capped", policy: RetryPolicy{MaxAttempts: 100, Backoff: time.Minute}, attempts: 10, backoff: maxRetryBackoff},
+		{name: "capped first retry", policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}, attempts: 1, backoff: maxRetryBackoff},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if backoff := test.policy.backoff(test.attempts); backoff != test.backoff {
+				t.Errorf("expected a backoff of %v, got %v", test.backoff, backoff)
+			}
+		})
+	}
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for name, expected := range map[string]FailurePolicy{"": FailurePolicyKeep, "keep": FailurePolicyKeep, "rollback": FailurePolicyRollback, "delete": FailurePolicyDelete} {
+		if policy, err := ParseFailurePolicy(name); err != nil || policy != expected {
+			t.Errorf("expected %q to parse as %s, got %s, %v", name, expected, policy, err)
+		}
+	}
+	if _, err := ParseFailurePolicy("ignore"); err == nil {
+		t.Error("expected an unknown policy to be refused")
+	}
+}
+
+// Everything the pipeline provisions into a tenant namespace up to the backend, along with the service account secret
+// the namespace is given
+func provisionedObjects(namespace string) []runtime.Object {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace}
+	}
+	return []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+		databaseSecret(namespace),
+		&corev1.Secret{ObjectMeta: meta("default-token-x7k2p")},
+		&corev1.PersistentVolumeClaim{ObjectMeta: meta("volume")},
+		&appsv1.Deployment{ObjectMeta: meta("postgresql")},
+		&corev1.Service{ObjectMeta: meta("postgresql")},
+		&appsv1.Deployment{ObjectMeta: meta("backend")},
+		&corev1.Service{ObjectMeta: meta("backend")},
+		&netv1beta1.Ingress{ObjectMeta: meta("backend")},
+	}
+}
+
+// What is left of a tenant whose step failed depends on the failure policy, and a retry only carries on from the failed
+// step when everything before it was kept
+func TestFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy    FailurePolicy
+		namespace bool
+		objects   bool
+		step      string
+	}{
+		{policy: FailurePolicyKeep, namespace: true, objects: true, step: "backend-deployment"},
+		{policy: FailurePolicyRollback, namespace: true},
+		{policy: FailurePolicyDelete},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			instance := newSaaSInstance("team-a")
+			instance.Status.Phase = PhaseProvisioning
+			instance.Status.Step = "backend-deployment"
+			instance.Status.SetCondition(Condition{Type: ConditionPostgreSQL, Status: ConditionTrue, Reason: "Provisioned"})
+			tn, cs, dc := newTestTenant(t, instance, provisionedObjects("team-a")...)
+			tn.retry = RetryPolicy{OnFailure: test.policy, MaxAttempts: 3, Backoff: time.Minute}
+
+			if err := tn.fail(pipeline[stepIndex("backend-ready")], errors.New("backend deployment was not ready")); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			_, err := cs.CoreV1().Namespaces().Get(ctx, "team-a", metav1.GetOptions{})
+			if exists := !apierrors.IsNotFound(err); exists != test.namespace {
+				t.Errorf("expected the namespace to exist %t, got %t", test.namespace, exists)
+			}
+			if test.namespace {
+				kept := map[string]error{}
+				_, kept["postgresql deployment"] = cs.AppsV1().Deployments("team-a").Get(ctx, "postgresql", metav1.GetOptions{})
+				_, kept["backend service"] = cs.CoreV1().Services("team-a").Get(ctx, "backend", metav1.GetOptions{})
+				_, kept["backend ingress"] = cs.NetworkingV1beta1().Ingresses("team-a").Get(ctx, "backend", metav1.GetOptions{})
+				_, kept["postgresql claim"] = cs.CoreV1().PersistentVolumeClaims("team-a").Get(ctx, "volume", metav1.GetOptions{})
+				_, kept["database credentials"] = cs.CoreV1().Secrets("team-a").Get(ctx, databaseSecretName, metav1.GetOptions{})
+				for object, err := range kept {
+					if exists := !apierrors.IsNotFound(err); exists != test.objects {
+						t.Errorf("expected the %s to exist %t, got %t", object, test.objects, exists)
+					}
+				}
+				if _, err := cs.CoreV1().Secrets("team-a").Get(ctx, "default-token-x7k2p", metav1.GetOptions{}); err != nil {
+					t.Errorf("expected secrets the provisioner did not make to be left alone: %v", err)
+				}
+			}
+
+			stored := storedInstance(t, dc, "team-a")
+			if stored.Status.Phase != PhaseFailed || stored.Status.Attempts != 1 || stored.Status.NextRetryTime == nil {
+				t.Errorf("expected a failed tenant with a retry scheduled, got %s after %d attempts", stored.Status.Phase, stored.Status.Attempts)
+			}
+			if stored.Status.Step != test.step {
+				t.Errorf("expected a retry to carry on after %q, got %q", test.step, stored.Status.Step)
+			}
+			postgres := stored.Status.GetCondition(ConditionPostgreSQL)
+			if provisioned := postgres.Status == ConditionTrue; provisioned != test.objects {
+				t.Errorf("expected postgresql to be provisioned %t, got %s %s", test.objects, postgres.Status, postgres.Reason)
+			}
+		})
+	}
+}
+
+// A tenant rolled back after a failure is provisioned again from the first step once its retry is due, with new
+// credentials as the old ones were removed along with everything else
+func TestRetryAfterRollback(t *testing.T) {
+	registered := registerAdminUsers(t)
+	instance := newSaaSInstance("team-a")
+	instance.Status.Phase = PhaseProvisioning
+	instance.Status.Step = "backend-deployment"
+	obj, err := instanceToUnstructured(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cs, dc := newTestController(t, append(provisionedObjects("team-a"), obj)...)
+	readyDeployments(cs)
+	settings := testSettings(t)
+	settings.Retry = RetryPolicy{OnFailure: FailurePolicyRollback, MaxAttempts: 3, Backoff: time.Nanosecond}
+	c.settings.Store(&settings)
+
+	if err := c.tenantFor(instance).fail(pipeline[stepIndex("backend-ready")], errors.New("backend deployment was not ready")); err != nil {
+		t.Fatal(err)
+	}
+	// Moving the tenant back to provisioning, then provisioning it
+	for i := 0; i < 2; i++ {
+		if err := c.reconcile("team-a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseReady {
+		t.Fatalf("expected the retried tenant to be ready, got %s: %s", stored.Status.Phase, stored.Status.Error)
+	}
+	database, err := cs.CoreV1().Secrets("team-a").Get(context.Background(), databaseSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(database.Data["password"]) == "password" {
+		t.Error("expected new database credentials after a rollback")
+	}
+	if len(registered.users) != 1 {
+		t.Errorf("expected the admin user to be registered once, got %d", len(registered.users))
+	}
+}
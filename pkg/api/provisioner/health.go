@@ -0,0 +1,137 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time a worker may go without a heartbeat on top of the longest readiness timeout before it is considered stuck
+const stallMargin = 5 * time.Minute
+
+// Resources the provisioner works with and what it does with them, checked by the readiness probe
+var requiredPermissions = []struct {
+	group    string
+	resource string
+	verbs    []string
+}{
+	{"", "namespaces", []string{"get", "list", "watch", "create", "patch", "delete"}},
+	{"", "secrets", []string{"get", "patch", "delete"}},
+	{"", "services", []string{"list", "patch", "delete"}},
+	{"", "persistentvolumeclaims", []string{"patch", "deletecollection"}},
+	{"", "pods", []string{"list"}},
+	{"", "events", []string{"create", "patch"}},
+	{"apps", "deployments", []string{"get", "list", "watch", "patch", "update", "deletecollection"}},
+	{"apps", "replicasets", []string{"list"}},
+	{"networking.k8s.io", "ingresses", []string{"patch", "deletecollection"}},
+	{saasInstanceGVR.Group, saasInstanceGVR.Resource, []string{"get", "list", "watch", "create", "patch", "delete"}},
+	{saasInstanceGVR.Group, saasInstanceGVR.Resource + "/status", []string{"update"}},
+	{upgradeCampaignGVR.Group, upgradeCampaignGVR.Resource, []string{"get", "list", "watch", "create", "patch"}},
+	{upgradeCampaignGVR.Group, upgradeCampaignGVR.Resource + "/status", []string{"update"}},
+	{operationGVR.Group, operationGVR.Resource, []string{"get", "list", "watch", "create", "delete"}},
+	{operationGVR.Group, operationGVR.Resource + "/status", []string{"update"}},
+}
+
+// Permissions the provisioner needs on the cluster
+func RequiredPermissions() []authorizationv1.ResourceAttributes {
+	var permissions []authorizationv1.ResourceAttributes
+	for _, required := range requiredPermissions {
+		resource, subresource := required.resource, ""
+		if i := strings.Index(resource, "/"); i >= 0 {
+			resource, subresource = resource[:i], resource[i+1:]
+		}
+		for _, verb := range required.verbs {
+			permissions = append(permissions, authorizationv1.ResourceAttributes{
+				Group:       required.group,
+				Resource:    resource,
+				Subresource: subresource,
+				Verb:        verb,
+			})
+		}
+	}
+	return permissions
+}
+
+// Fails until the informer caches have synced, the controller works from them so it can not serve requests before
+func (c *Controller) CheckSynced(_ context.Context) error {
+	if atomic.LoadInt32(&c.synced) == 0 {
+		return errors.New("informer caches have not synced")
+	}
+	return nil
+}
+
+// Fails when a worker has been busy with the same item without a heartbeat for longer than any provisioning step may
+// wait, such as a call which never returns
+func (c *Controller) CheckWorkers(_ context.Context) error {
+	limit := c.current().Readiness.longest() + stallMargin
+	if stalled := c.heartbeats.stalled(limit); len(stalled) > 0 {
+		return fmt.Errorf("workers stuck for over %s on %s", limit, strings.Join(stalled, ", "))
+	}
+	return nil
+}
+
+// Longest time a component is given to become ready
+func (r ReadinessTimeouts) longest() time.Duration {
+	longest := r.Default
+	for _, timeout := range r.Components {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// When each item being worked on last showed signs of progress.  Items are keyed by their queue, such as
+// saasinstance/<name>
+type heartbeats struct {
+	mutex sync.Mutex
+	busy  map[string]time.Time
+}
+
+func newHeartbeats() *heartbeats {
+	return &heartbeats{busy: map[string]time.Time{}}
+}
+
+// Record a worker picking up an item
+func (h *heartbeats) start(item string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.busy[item] = time.Now()
+}
+
+// Record progress on an item being worked on, such as a provisioning step starting to wait on a deployment
+func (h *heartbeats) beat(item string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.busy[item]; ok {
+		h.busy[item] = time.Now()
+	}
+}
+
+// Record a worker being done with an item
+func (h *heartbeats) stop(item string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.busy, item)
+}
+
+// Items without a heartbeat for longer than the limit
+func (h *heartbeats) stalled(limit time.Duration) []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var stalled []string
+	for item, last := range h.busy {
+		if time.Since(last) > limit {
+			stalled = append(stalled, item)
+		}
+	}
+	sort.Strings(stalled)
+	return stalled
+}
@@ -0,0 +1,81 @@
+package provisioner
+
+import (
+	"github.com/bennerv/provisioning-api/pkg/api/webhook"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"time"
+)
+
+// Send the lifecycle events a change to an instance amounts to, such as the tenant becoming ready, to the webhooks
+// Only changes seen by the informer are sent, a change made while the provisioner was not running sends no event
+func (c *Controller) notifyLifecycle(oldObj, newObj interface{}) {
+	old, err := instanceFromUnstructured(oldObj)
+	if err != nil {
+		return
+	}
+	instance, err := instanceFromUnstructured(newObj)
+	if err != nil {
+		return
+	}
+
+	oldPhase, phase := old.Status.Phase, instance.Status.Phase
+	switch {
+	case oldPhase == "" && phase != "":
+		// The status is initialized once for every new instance
+		c.notify(webhook.TenantCreated, instance, nil)
+	case phase == PhaseReady && (oldPhase == PhasePending || oldPhase == PhaseProvisioning):
+		c.notify(webhook.TenantReady, instance, map[string]string{"url": instance.Status.URLs.Frontend})
+	case phase == PhaseFailed && oldPhase != PhaseFailed:
+		data := map[string]string{
+			"error":    instance.Status.Error,
+			"attempts": strconv.Itoa(instance.Status.Attempts),
+		}
+		if instance.Status.NextRetryTime != nil {
+			data["nextRetryTime"] = instance.Status.NextRetryTime.UTC().Format(time.RFC3339)
+		}
+		c.notify(webhook.TenantFailed, instance, data)
+	}
+
+	if upgrade := latestUpgrade(instance); upgrade != nil && upgrade.Result == UpgradeSucceeded {
+		if previous := latestUpgrade(old); previous == nil || previous.Result != UpgradeSucceeded || !previous.StartTime.Equal(&upgrade.StartTime) {
+			c.notify(webhook.TenantUpgraded, instance, map[string]string{"from": upgrade.From, "to": upgrade.To})
+		}
+	}
+}
+
+// Send the deletion of an instance to the webhooks
+func (c *Controller) notifyDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		return
+	}
+	c.notify(webhook.TenantDeleted, instance, nil)
+}
+
+func (c *Controller) notify(eventType string, instance *SaaSInstance, data map[string]string) {
+	if data == nil {
+		data = map[string]string{}
+	}
+	data["owner"] = instance.Spec.Owner
+	data["release"] = instance.Status.Release
+	if data["release"] == "" {
+		data["release"] = instance.Spec.Release
+	}
+
+	c.webhooks.Send(webhook.Event{
+		Type:   eventType,
+		Tenant: instance.TenantName(),
+		Data:   data,
+	})
+}
+
+func latestUpgrade(instance *SaaSInstance) *Upgrade {
+	if len(instance.Status.Upgrades) == 0 {
+		return nil
+	}
+	return &instance.Status.Upgrades[len(instance.Status.Upgrades)-1]
+}
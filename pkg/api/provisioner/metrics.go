@@ -0,0 +1,105 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"github.com/bennerv/provisioning-api/pkg/api/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	stepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "saas_provisioning_step_duration_seconds",
+		Help:    "Time taken by each completed provisioning step.",
+		Buckets: metrics.StepBuckets,
+	}, []string{"step"})
+	provisioned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "saas_provisioning_succeeded_total",
+		Help: "Tenants provisioned successfully.",
+	})
+	provisioningFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "saas_provisioning_failed_total",
+		Help: "Failed provisioning attempts, by the step which failed and why.",
+	}, []string{"step", "reason"})
+)
+
+// Reasons a provisioning step failed, kept to a fixed set so the failures metric has a bounded number of series
+const (
+	reasonTimeout          = "timeout"
+	reasonProgressDeadline = "progress_deadline"
+	reasonImagePull        = "image_pull"
+	reasonCrashLoop        = "crash_loop"
+	reasonAPIError         = "api_error"
+	reasonOther            = "other"
+)
+
+// Why a step failed.  The reasons pods are not ready come first as they say what went wrong, then whether the
+// deployment timed out or passed its progress deadline, then whether the API server refused a call
+func failureReason(err error) string {
+	var problems *podProblemsError
+	if errors.As(err, &problems) {
+		switch {
+		case problems.has("ImagePullBackOff", "ErrImagePull", "InvalidImageName"):
+			return reasonImagePull
+		case problems.has("CrashLoopBackOff"):
+			return reasonCrashLoop
+		}
+	}
+
+	var status apierrors.APIStatus
+	switch {
+	case errors.Is(err, errProgressDeadline):
+		return reasonProgressDeadline
+	case errors.Is(err, errReadinessTimeout), errors.Is(err, context.DeadlineExceeded):
+		return reasonTimeout
+	case errors.As(err, &status):
+		return reasonAPIError
+	}
+	return reasonOther
+}
+
+// Phases reported by the tenants gauge, so a phase without any tenant is reported as zero rather than missing
+var phases = []Phase{PhasePending, PhaseProvisioning, PhaseReady, PhaseUpgrading, PhaseFailed, PhaseDeleting}
+
+var (
+	tenantsDesc    = prometheus.NewDesc("saas_tenants", "Tenants known to the provisioner, by phase.", []string{"phase"}, nil)
+	queueDepthDesc = prometheus.NewDesc("saas_provisioning_queue_depth", "Tenants waiting for a provisioning worker.", nil, nil)
+	runningDesc    = prometheus.NewDesc("saas_provisioning_running", "Tenants being provisioned.", nil, nil)
+)
+
+// Gauges read from the controller's caches and queue when the metrics are scraped, so they never drift from what they
+// measure
+type controllerCollector struct {
+	controller *Controller
+}
+
+func (cc controllerCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- tenantsDesc
+	descs <- queueDepthDesc
+	descs <- runningDesc
+}
+
+func (cc controllerCollector) Collect(collected chan<- prometheus.Metric) {
+	counts := map[Phase]int{}
+	for _, obj := range cc.controller.instanceInformer.GetIndexer().List() {
+		if instance, err := instanceFromUnstructured(obj); err == nil {
+			counts[instance.CurrentPhase()]++
+		}
+	}
+	for _, phase := range phases {
+		collected <- prometheus.MustNewConstMetric(tenantsDesc, prometheus.GaugeValue, float64(counts[phase]), string(phase))
+	}
+
+	running, waiting := cc.controller.provisioning.depth()
+	collected <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(waiting))
+	collected <- prometheus.MustNewConstMetric(runningDesc, prometheus.GaugeValue, float64(running))
+}
+
+// Register the gauges of the controller, replacing those of any controller created before it
+func (c *Controller) registerMetrics() {
+	collector := controllerCollector{controller: c}
+	prometheus.Unregister(collector)
+	prometheus.MustRegister(collector)
+}
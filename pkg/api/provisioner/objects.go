@@ -1,290 +1,113 @@
 package provisioner
 
 import (
-	appsv1 "k8s.io/api/apps/v1"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/blueprint"
 	corev1 "k8s.io/api/core/v1"
-	netv1beta1 "k8s.io/api/networking/v1beta1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/intstr"
-	"k8s.io/utils/pointer"
 	"strings"
 )
 
-const tld string = ".gcp.bennerv.com"
+// Database and user the tenant's postgresql is created with
+const (
+	postgresDb   = "postgresdb"
+	postgresUser = "postgresuser"
+)
 
-// Generic postgres deployment object
-func getPostgresDeploy() *appsv1.Deployment {
-	return &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "postgresql",
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: pointer.Int32Ptr(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": "postgresql",
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "postgresql",
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "postgresql",
-							Image: "postgres:12.3-alpine",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "POSTGRES_DB",
-									Value: "postgresdb",
-								},
-								{
-									Name:  "POSTGRES_USER",
-									Value: "postgresuser",
-								},
-								{
-									Name:  "POSTGRES_PASSWORD",
-									Value: "",
-								},
-								{
-									Name: "PGDATA",
-									Value: "/var/lib/postgresql/data/pgdata",
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"memory": resource.MustParse("50Mi"),
-									"cpu":    resource.MustParse("50m"),
-								},
-								Limits: corev1.ResourceList{
-									"memory": resource.MustParse("250Mi"),
-									"cpu":    resource.MustParse("1000m"),
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "volume",
-									MountPath: "/var/lib/postgresql/data",
-								},
-							},
-						},
-					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "volume",
-							VolumeSource: corev1.VolumeSource{
-								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-									ClaimName: "volume",
-									ReadOnly:  false,
-								},
-							},
-						},
-					},
-				},
-			},
-			Strategy:             appsv1.DeploymentStrategy{},
-			MinReadySeconds:      0,
-			RevisionHistoryLimit: pointer.Int32Ptr(2),
-		},
-	}
+// Objects of the blueprint which the provisioning pipeline creates.  A blueprint must define each of them and nothing
+// else
+var blueprintObjects = []blueprint.Ref{
+	{Kind: "PersistentVolumeClaim", Name: "volume"},
+	{Kind: "Deployment", Name: "postgresql"},
+	{Kind: "Service", Name: "postgresql"},
+	{Kind: "Deployment", Name: "backend"},
+	{Kind: "Service", Name: "backend"},
+	{Kind: "Ingress", Name: "backend"},
+	{Kind: "Deployment", Name: "frontend"},
+	{Kind: "Service", Name: "frontend"},
+	{Kind: "Ingress", Name: "frontend"},
 }
 
-// PVC object
-func getPersistentVolumeClaim() *corev1.PersistentVolumeClaim {
-	return &corev1.PersistentVolumeClaim{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "volume",
-		},
-		Spec: corev1.PersistentVolumeClaimSpec{
-			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteOnce,
-			},
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					"storage": resource.MustParse("5Gi"),
-				},
-			},
-		},
-	}
+// Settings of the tenants provisioned, from the configuration
+type TenantSettings struct {
+	// Domain tenants are served under, the frontend of tenant "foo" is served at foo.<domain>
+	Domain string
+	// Size of the postgresql volume of tenants which do not ask for one, the size in the blueprint when empty
+	Storage string
+	// Requests and limits of the containers of each component, over those in the blueprint
+	Resources map[string]corev1.ResourceRequirements
 }
 
-// Backend deployment object
-func getBackendDeploy() *appsv1.Deployment {
-	return &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "backend",
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: pointer.Int32Ptr(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": "backend",
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "backend",
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "backend",
-							Image: "bennerv/order-meow-api:0.1.0",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "SPRING_DATASOURCE_URL",
-									Value: "jdbc:postgresql://postgresql:5432/postgresdb",
-								},
-								{
-									Name:  "SPRING_DATASOURCE_USERNAME",
-									Value: "postgresuser",
-								},
-								{
-									Name:  "SPRING_DATASOURCE_PASSWORD",
-									Value: "",
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"memory": resource.MustParse("250Mi"),
-									"cpu":    resource.MustParse("100m"),
-								},
-								Limits: corev1.ResourceList{
-									"memory": resource.MustParse("2Gi"),
-									"cpu":    resource.MustParse("2000m"),
-								},
-							},
-						},
-					},
-				},
-			},
-			Strategy:             appsv1.DeploymentStrategy{},
-			MinReadySeconds:      0,
-			RevisionHistoryLimit: pointer.Int32Ptr(2),
-		},
+// Settings the blueprint is checked with when it is loaded
+var blueprintCheckSettings = TenantSettings{Domain: "example.com"}
+
+// Load the blueprint tenants are provisioned from, checking it defines exactly the objects the pipeline creates.  An
+// empty directory loads the built in blueprint
+func LoadBlueprint(dir string) (*blueprint.Blueprint, error) {
+	bp, err := blueprint.Load(dir)
+	if err != nil {
+		return nil, err
 	}
-}
 
-// Frontend deployment object
-func getFrontendDeploy() *appsv1.Deployment {
-	return &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "frontend",
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: pointer.Int32Ptr(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": "frontend",
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "frontend",
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "frontend",
-							Image: "bennerv/order-meow-ui:0.1.2",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "REACT_APP_API_URL",
-									Value: "",
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"memory": resource.MustParse("50Mi"),
-									"cpu":    resource.MustParse("50m"),
-								},
-								Limits: corev1.ResourceList{
-									"memory": resource.MustParse("1Gi"),
-									"cpu":    resource.MustParse("1000m"),
-								},
-							},
-							ReadinessProbe: &corev1.Probe{
-								Handler: corev1.Handler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path: "/",
-										Port: intstr.IntOrString{
-											Type:   intstr.Int,
-											IntVal: int32(3000),
-										},
-									},
-								},
-								InitialDelaySeconds: 0,
-								TimeoutSeconds:      0,
-								PeriodSeconds:       0,
-								SuccessThreshold:    0,
-								FailureThreshold:    0,
-							},
-						},
-					},
-				},
-			},
-			Strategy:             appsv1.DeploymentStrategy{},
-			MinReadySeconds:      0,
-			RevisionHistoryLimit: pointer.Int32Ptr(2),
-		},
+	objects, err := bp.Render(blueprint.Params{
+		Namespace:        "blueprint-check",
+		FrontendHost:     blueprintCheckSettings.frontendHost("blueprint-check"),
+		BackendHost:      blueprintCheckSettings.backendHost("blueprint-check"),
+		PostgresDb:       postgresDb,
+		PostgresUser:     postgresUser,
+		PostgresPassword: "password",
+	})
+	if err != nil {
+		return nil, err
 	}
-}
 
-// Create a pointer to a service with the following params
-func createService(name string, matcher string, port int) *corev1.Service {
-	return &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-		},
-		Spec: corev1.ServiceSpec{
-			Ports: []corev1.ServicePort{
-				{
-					Name: name,
-					Port: int32(port),
-				},
-			},
-			Selector: map[string]string{
-				"app": matcher,
-			},
-			Type: corev1.ServiceTypeClusterIP,
-		},
+	defined := map[blueprint.Ref]bool{}
+	for _, ref := range objects.Refs() {
+		defined[ref] = true
+	}
+	var problems []string
+	for _, ref := range blueprintObjects {
+		if !defined[ref] {
+			problems = append(problems, "missing "+ref.String())
+		}
+		delete(defined, ref)
+	}
+	for _, ref := range objects.Refs() {
+		if defined[ref] {
+			problems = append(problems, "unsupported "+ref.String())
+		}
 	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid blueprint: %s", strings.Join(problems, ", "))
+	}
+
+	return bp, nil
 }
 
-// Create a pointer to an ingress with the following params
-func createIngress(service string, port int, namespace string) *netv1beta1.Ingress {
-	var host string
-	if strings.ToLower(service) == "backend" {
-		host = namespace + "-backend" + tld
-	} else {
-		host = namespace + tld
-	}
+// Hostname of the frontend of a tenant (namespace.domain)
+func (s TenantSettings) frontendHost(namespace string) string {
+	return namespace + "." + s.Domain
+}
 
-	return &netv1beta1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: service,
-		},
-		Spec: netv1beta1.IngressSpec{
-			Backend: &netv1beta1.IngressBackend{
-				ServiceName: service,
-				ServicePort: intstr.IntOrString{
-					Type:   intstr.Int,
-					IntVal: int32(port),
-				},
-			},
-			Rules: []netv1beta1.IngressRule{
-				{
-					Host: host,
-				},
-			},
-		},
+// Hostname of the backend of a tenant (namespace-backend.domain)
+func (s TenantSettings) backendHost(namespace string) string {
+	return namespace + "-backend." + s.Domain
+}
+
+// Render the blueprint with the parameters of the tenant.  The database password is read back out of the tenant
+// secret, so rendering needs the database credentials step to have run
+func (t *tenant) objects() (*blueprint.Objects, error) {
+	password, err := t.password(databaseSecretName)
+	if err != nil {
+		return nil, err
 	}
+
+	return t.blueprint.Render(blueprint.Params{
+		Namespace:        t.name,
+		FrontendHost:     t.settings.frontendHost(t.name),
+		BackendHost:      t.settings.backendHost(t.name),
+		PostgresDb:       postgresDb,
+		PostgresUser:     postgresUser,
+		PostgresPassword: password,
+		Resources:        t.settings.Resources,
+	})
 }
@@ -0,0 +1,378 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"time"
+)
+
+// Group, version and resource of the Operation custom resource (deploy/00-operation-crd.yaml)
+var operationGVR = schema.GroupVersionResource{
+	Group:    "saas.bennerv.com",
+	Version:  "v1alpha1",
+	Resource: "operations",
+}
+
+const operationKind = "Operation"
+
+// Path operations are served on, the operation id is appended to it
+const operationsPath = "/v1/operations/"
+
+// Number of random characters in an operation id
+const operationIDLength = 10
+
+// Index of Operations by the name of the tenant they act on
+const operationTenantIndex = "tenant"
+
+// Operations are looked at again whenever their tenant changes, and every poll interval in case a change was missed.
+// Finished operations are kept for the retention period before they are deleted
+const (
+	operationPollInterval = 30 * time.Second
+	operationRetention    = 24 * time.Hour
+)
+
+// What an operation does to its tenant
+type OperationType string
+
+const (
+	OperationCreate  OperationType = "Create"
+	OperationDelete  OperationType = "Delete"
+	OperationUpgrade OperationType = "Upgrade"
+	OperationRetry   OperationType = "Retry"
+)
+
+// State of an Operation
+type OperationState string
+
+const (
+	OperationPending   OperationState = "Pending"
+	OperationRunning   OperationState = "Running"
+	OperationSucceeded OperationState = "Succeeded"
+	OperationFailed    OperationState = "Failed"
+)
+
+// An Operation follows a single asynchronous request against a tenant, such as creating or upgrading it, until the
+// controller has finished with it.  It is cluster scoped and its name is the operation id
+type Operation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   OperationSpec   `json:"spec,omitempty"`
+	Status OperationStatus `json:"status,omitempty"`
+}
+
+type OperationSpec struct {
+	Type   OperationType `json:"type"`
+	Tenant string        `json:"tenant"`
+	// Release an upgrade is to
+	Release string `json:"release,omitempty"`
+	// Subject of the authenticated caller which asked for the operation, such as jwt:alice, and the id of the request
+	Requester string `json:"requester,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type OperationStatus struct {
+	State   OperationState `json:"state,omitempty"`
+	Step    string         `json:"step,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	// When the controller started and finished working on the operation
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// A new operation.  Its id is chosen up front rather than by the API server, so it can be handed to the work the
+// operation follows before the operation is recorded
+func newOperation(spec OperationSpec) *Operation {
+	return &Operation{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: operationGVR.GroupVersion().String(),
+			Kind:       operationKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: "op-" + utilrand.String(operationIDLength)},
+		Spec:       spec,
+	}
+}
+
+// Whether the operation has finished, successfully or not
+func (o *Operation) Finished() bool {
+	return o.Status.State == OperationSucceeded || o.Status.State == OperationFailed
+}
+
+// Whether an operation can be seen by an identity.  Admins see every operation, other callers only their own
+func (o *Operation) AccessibleBy(identity *auth.Identity) bool {
+	if identity == nil {
+		return false
+	}
+	return identity.Role.Allows(auth.RoleAdmin) || (o.Spec.Requester != "" && o.Spec.Requester == identity.Subject())
+}
+
+// Bring the status of a single operation up to date with its tenant.  The returned duration is how long to wait before
+// looking at the operation again
+func (c *Controller) reconcileOperation(name string) (time.Duration, error) {
+	obj, err := c.operations.Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	operation, err := operationFromUnstructured(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	// Finished operations are only kept around for their caller to read
+	if operation.Finished() {
+		if expiry := time.Until(operation.Status.CompletionTime.Add(operationRetention)); expiry > 0 {
+			return expiry, nil
+		}
+		err := c.operations.Delete(context.Background(), name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	status := operation.Status
+	if err := c.observeOperation(operation); err != nil {
+		return 0, err
+	}
+	if !reflect.DeepEqual(status, operation.Status) {
+		if err := c.updateOperationStatus(operation); err != nil {
+			return 0, err
+		}
+	}
+
+	if operation.Finished() {
+		return operationRetention, nil
+	}
+	return operationPollInterval, nil
+}
+
+// Work out the state of an operation from its tenant.  The tenant is read from the API server so an operation created
+// straight after its request is not judged on a stale instance
+func (c *Controller) observeOperation(operation *Operation) error {
+	var instance *SaaSInstance
+	cached, exists, err := c.instanceForTenant(operation.Spec.Tenant)
+	if err != nil {
+		return err
+	}
+	if exists {
+		instance, err = c.getInstance(cached.Name)
+		if apierrors.IsNotFound(err) {
+			instance, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	status := &operation.Status
+	switch operation.Spec.Type {
+	case OperationCreate, OperationRetry:
+		observeProvisioning(status, instance)
+	case OperationDelete:
+		c.observeDeletion(status, operation.Spec.Tenant, instance)
+	case OperationUpgrade:
+		observeUpgrade(status, operation, instance)
+	default:
+		finishOperation(status, OperationFailed, "", fmt.Sprintf("unknown operation type %s", operation.Spec.Type))
+	}
+	return nil
+}
+
+// An operation provisioning a tenant runs until the tenant is ready, or has failed and will not be retried
+func observeProvisioning(status *OperationStatus, instance *SaaSInstance) {
+	if instance == nil || instance.CurrentPhase() == PhaseDeleting {
+		finishOperation(status, OperationFailed, "", "tenant was deleted")
+		return
+	}
+
+	switch instance.CurrentPhase() {
+	case PhaseReady, PhaseUpgrading:
+		finishOperation(status, OperationSucceeded, "Provisioned", "")
+	case PhaseFailed:
+		if instance.Status.NextRetryTime == nil {
+			finishOperation(status, OperationFailed, instance.Status.Message, instance.Status.Error)
+			return
+		}
+		runOperation(status, "", fmt.Sprintf("Retrying at %s", instance.Status.NextRetryTime.Format(time.RFC3339)))
+		status.Error = instance.Status.Error
+	default:
+		if instance.Status.Message == queuedMessage {
+			status.State, status.Message = OperationPending, queuedMessage
+			return
+		}
+		runOperation(status, instance.Status.CurrentStep, instance.Status.Message)
+	}
+}
+
+// An operation deleting a tenant runs until both its instance and its namespace have gone.  Namespaces without an
+// instance are deleted directly, so the namespace is checked as well
+func (c *Controller) observeDeletion(status *OperationStatus, tenantName string, instance *SaaSInstance) {
+	if instance != nil {
+		runOperation(status, "delete", instance.Status.Message)
+		return
+	}
+	if _, exists, _ := c.namespaceInformer.GetIndexer().GetByKey(tenantName); exists {
+		runOperation(status, "delete", "Deleting namespace")
+		return
+	}
+	finishOperation(status, OperationSucceeded, "Deleted", "")
+}
+
+// An operation upgrading a tenant follows the upgrade recorded with its id
+func observeUpgrade(status *OperationStatus, operation *Operation, instance *SaaSInstance) {
+	if instance == nil || instance.CurrentPhase() == PhaseDeleting {
+		finishOperation(status, OperationFailed, "", "tenant was deleted")
+		return
+	}
+
+	for i := len(instance.Status.Upgrades) - 1; i >= 0; i-- {
+		upgrade := instance.Status.Upgrades[i]
+		if upgrade.Operation != operation.Name {
+			continue
+		}
+		switch upgrade.Result {
+		case UpgradeSucceeded:
+			finishOperation(status, OperationSucceeded, "Upgraded to release "+upgrade.To, "")
+		case UpgradeRolledBack, UpgradeFailed:
+			finishOperation(status, OperationFailed, "", upgrade.Message)
+		default:
+			step := "upgrade"
+			if len(upgrade.Components) > 0 {
+				step += " " + upgrade.Components[len(upgrade.Components)-1].Component
+			}
+			runOperation(status, step, instance.Status.Message)
+		}
+		return
+	}
+
+	// The upgrade has not started yet, or never will because another request changed the tenant first
+	if instance.CurrentPhase() == PhaseFailed {
+		finishOperation(status, OperationFailed, "", instance.Status.Error)
+		return
+	}
+	if instance.Annotations[operationAnnotation] != operation.Name && instance.Status.runningUpgrade() == nil {
+		finishOperation(status, OperationFailed, "", "the upgrade was replaced by another request")
+	}
+}
+
+func runOperation(status *OperationStatus, step string, message string) {
+	if status.StartTime == nil {
+		now := metav1.Now()
+		status.StartTime = &now
+	}
+	status.State = OperationRunning
+	status.Step = step
+	status.Message = message
+	status.Error = ""
+}
+
+func finishOperation(status *OperationStatus, state OperationState, message string, errStr string) {
+	now := metav1.Now()
+	if status.StartTime == nil {
+		status.StartTime = &now
+	}
+	status.CompletionTime = &now
+	status.State = state
+	status.Step = ""
+	status.Message = message
+	status.Error = errStr
+}
+
+// Queue the operations of the tenant of a SaaSInstance which have not finished
+func (c *Controller) enqueueOperations(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		return
+	}
+
+	operations, err := c.operationInformer.GetIndexer().ByIndex(operationTenantIndex, instance.TenantName())
+	if err != nil {
+		return
+	}
+	for _, obj := range operations {
+		if operation, err := operationFromUnstructured(obj); err == nil && !operation.Finished() {
+			c.operationQueue.Add(operation.Name)
+		}
+	}
+}
+
+// Create an operation, returning it with the id it was given
+func (c *Controller) createOperation(ctx context.Context, operation *Operation) (*Operation, error) {
+	obj, err := operationToUnstructured(operation)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err = c.operations.Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return operationFromUnstructured(obj)
+}
+
+// Look up an operation by its id.  An operation missing from the informer cache is read from the API server, as a
+// caller following the Location of an accepted request can ask for it before the cache has caught up
+func (c *Controller) operationByID(id string) (*Operation, bool, error) {
+	obj, exists, err := c.operationInformer.GetIndexer().GetByKey(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if !exists {
+		obj, err = c.operations.Get(context.Background(), id, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	operation, err := operationFromUnstructured(obj)
+	return operation, err == nil, err
+}
+
+func (c *Controller) updateOperationStatus(operation *Operation) error {
+	obj, err := operationToUnstructured(operation)
+	if err != nil {
+		return err
+	}
+	_, err = c.operations.UpdateStatus(context.Background(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+func operationFromUnstructured(obj interface{}) (*Operation, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errNotUnstructured
+	}
+
+	operation := &Operation{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, operation)
+	return operation, err
+}
+
+func operationToUnstructured(operation *Operation) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(operation)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
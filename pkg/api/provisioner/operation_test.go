@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestObserveUpgrade(t *testing.T) {
+	created := metav1.NewTime(time.Unix(1600000010, 0))
+	operation := newOperation(OperationSpec{Type: OperationUpgrade, Tenant: "team-a", Release: "0.2"})
+	operation.CreationTimestamp = created
+	// The upgrade can be recorded in the second before the operation, which is created after the upgrade is requested
+	earlier := metav1.NewTime(created.Add(-time.Second))
+
+	upgrading := func(upgrades ...Upgrade) *SaaSInstance {
+		instance := newSaaSInstance("team-a")
+		instance.Annotations = map[string]string{operationAnnotation: operation.Name}
+		instance.Status.Phase = PhaseUpgrading
+		instance.Status.Message = "Upgrading to release 0.2"
+		instance.Status.Upgrades = upgrades
+		return instance
+	}
+	ready := func(instance *SaaSInstance) *SaaSInstance {
+		instance.Status.Phase = PhaseReady
+		return instance
+	}
+
+	tests := []struct {
+		name     string
+		instance *SaaSInstance
+		state    OperationState
+		step     string
+		errStr   string
+	}{
+		{
+			name:     "running upgrade recorded before the operation",
+			instance: upgrading(Upgrade{To: "0.2", StartTime: earlier, Operation: operation.Name, Components: []ComponentUpgrade{{Component: "backend"}}}),
+			state:    OperationRunning,
+			step:     "upgrade backend",
+		},
+		{
+			name:     "succeeded",
+			instance: ready(upgrading(Upgrade{To: "0.2", StartTime: earlier, Operation: operation.Name, Result: UpgradeSucceeded})),
+			state:    OperationSucceeded,
+		},
+		{
+			name:     "rolled back",
+			instance: ready(upgrading(Upgrade{To: "0.2", StartTime: created, Operation: operation.Name, Result: UpgradeRolledBack, Message: "backend rollout failed"})),
+			state:    OperationFailed,
+			errStr:   "backend rollout failed",
+		},
+		{
+			name: "earlier upgrade of another operation to the same release",
+			instance: upgrading(
+				Upgrade{To: "0.2", StartTime: metav1.NewTime(created.Add(time.Minute)), Operation: "op-other", Result: UpgradeRolledBack},
+			),
+			state: "",
+		},
+		{
+			name:     "not started yet",
+			instance: ready(upgrading()),
+			state:    "",
+		},
+		{
+			name: "replaced by another request",
+			instance: func() *SaaSInstance {
+				instance := ready(upgrading())
+				instance.Annotations[operationAnnotation] = "op-other"
+				return instance
+			}(),
+			state:  OperationFailed,
+			errStr: "the upgrade was replaced by another request",
+		},
+		{
+			name:     "deleted",
+			instance: nil,
+			state:    OperationFailed,
+			errStr:   "tenant was deleted",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := &OperationStatus{}
+			observeUpgrade(status, operation, test.instance)
+			if status.State != test.state || status.Step != test.step || status.Error != test.errStr {
+				t.Errorf("expected %q at step %q with error %q, got %q at step %q with error %q",
+					test.state, test.step, test.errStr, status.State, status.Step, status.Error)
+			}
+		})
+	}
+}
+
+func TestOperationByIDReadsThroughTheCache(t *testing.T) {
+	operation := newOperation(OperationSpec{Type: OperationCreate, Tenant: "team-a"})
+	c, _, _ := newTestController(t, unstructuredOperation(t, operation))
+
+	// The informer has not seen the operation, as straight after the request which created it
+	found, exists, err := c.operationByID(operation.Name)
+	if err != nil || !exists {
+		t.Fatalf("expected the operation to be found, got %v and %v", exists, err)
+	}
+	if found.Spec.Tenant != "team-a" {
+		t.Errorf("unexpected operation %+v", found)
+	}
+
+	if _, exists, err := c.operationByID("op-missing"); err != nil || exists {
+		t.Errorf("expected a missing operation not to be found, got %v and %v", exists, err)
+	}
+}
+
+func TestOperationIDs(t *testing.T) {
+	first, second := newOperation(OperationSpec{}), newOperation(OperationSpec{})
+	if first.Name == second.Name || len(first.Name) != len("op-")+operationIDLength {
+		t.Errorf("expected distinct operation ids, got %s and %s", first.Name, second.Name)
+	}
+}
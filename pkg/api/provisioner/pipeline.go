@@ -0,0 +1,822 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/blueprint"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/bennerv/provisioning-api/pkg/api/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const queuedMessage = "Queued: waiting to be provisioned"
+
+// Client for calls to the tenant backend, carrying the span of the step making the call
+var backendClient = &http.Client{Transport: tracing.Transport(http.DefaultTransport)}
+
+// Names of the secrets holding the generated credentials for a tenant
+const (
+	databaseSecretName = "postgresql-creds"
+	backendSecretName  = "backend-creds"
+)
+
+// A tenant being provisioned from its SaaSInstance.  All the state needed to resume provisioning lives in the cluster
+// (the instance status and the tenant secrets) so a tenant can be picked up again after a restart of the provisioner
+type tenant struct {
+	name      string
+	clientset kubernetes.Interface
+	instances dynamic.NamespaceableResourceInterface
+	instance  *SaaSInstance
+	blueprint *blueprint.Blueprint
+	settings  TenantSettings
+	releases  *ReleaseCatalogue
+	retry     RetryPolicy
+	readiness ReadinessTimeouts
+	recorder  record.EventRecorder
+	// Logs with the tenant name and the id of the request which asked for the work
+	log *logrus.Entry
+	// Uid of the tenant namespace once it has been looked up for an event
+	namespaceUID types.UID
+	// Tells the probes the worker provisioning the tenant is making progress
+	heartbeat func()
+	// Deployments are checked once rather than waited on, when repairing a ready tenant
+	checkOnly bool
+	// Cancelled when the provisioner shuts down
+	ctx context.Context
+}
+
+// A single named step of the provisioning pipeline.  Steps must be safe to re-run, as a step which was running when the
+// provisioner stopped will be run again when the tenant is resumed.  Steps creating objects apply them, so re-running a
+// step also repairs its objects, apart from the postgresql claim which is only created when it is missing
+type step struct {
+	name   string
+	status string
+	run    func(t *tenant) error
+	// Condition type of the component the step provisions
+	component string
+	// Steps which must only ever run once are skipped when repairing a ready tenant
+	once bool
+	// Steps skipped when repairing a ready tenant, as their objects are only ever created
+	noRepair bool
+}
+
+// The ordered provisioning pipeline.  The name of the last completed step is persisted in the instance status, the
+// status is what is shown to users once the step has completed
+var pipeline = []step{
+	{name: "database-credentials", status: "Working: created postgresql credentials", run: createDatabaseCredentials, component: ConditionPostgreSQL, once: true},
+	{name: "postgresql-pvc", status: "Working: created postgresql pvc", run: createPostgresPVC, component: ConditionPostgreSQL, noRepair: true},
+	{name: "postgresql-deployment", status: "Working: created postgresql deployment", run: createPostgresDeployment, component: ConditionPostgreSQL},
+	{name: "postgresql-ready", status: "Working: postgresql deployment ready", run: waitOnPostgres, component: ConditionPostgreSQL},
+	{name: "postgresql-service", status: "Working: created postgresql service", run: createPostgresService, component: ConditionPostgreSQL},
+	{name: "backend-deployment", status: "Working: created backend deployment", run: createBackendDeployment, component: ConditionBackend},
+	{name: "backend-ready", status: "Working: backend deployment ready", run: waitOnBackend, component: ConditionBackend},
+	{name: "backend-service", status: "Working: created backend service", run: createBackendService, component: ConditionBackend},
+	{name: "backend-ingress", status: "Working: created backend ingress", run: createBackendIngress, component: ConditionIngress},
+	{name: "frontend-deployment", status: "Working: created frontend deployment", run: createFrontendDeployment, component: ConditionFrontend},
+	{name: "frontend-ready", status: "Working: frontend deployment ready", run: waitOnFrontend, component: ConditionFrontend},
+	{name: "frontend-service", status: "Working: created frontend service", run: createFrontendService, component: ConditionFrontend},
+	{name: "frontend-ingress", status: "Working: created frontend ingress", run: createFrontendIngress, component: ConditionIngress},
+	{name: "admin-credentials", status: "Working: created backend admin credentials", run: createAdminCredentials, component: ConditionAdminUser, once: true},
+	{name: "admin-user", status: "Working: created backend admin user", run: registerAdminUser, component: ConditionAdminUser, once: true},
+}
+
+func (t *tenant) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// Show the worker the tenant is on is not stuck, before work which may take a while
+func (t *tenant) beat() {
+	if t.heartbeat != nil {
+		t.heartbeat()
+	}
+}
+
+// Context for calls to the API server, carrying the span of the work being done.  It is never cancelled, so a failure
+// is still recorded while the provisioner shuts down
+func (t *tenant) callContext() context.Context {
+	return tracing.WithoutCancel(t.context())
+}
+
+// Start a trace for work on the tenant, such as provisioning it.  The work runs long after the request which asked for
+// it has been answered, so it is a trace of its own linked to the span of the request
+func (t *tenant) startTrace(name string) trace.Span {
+	options := []trace.SpanOption{trace.WithNewRoot()}
+	if request, ok := tracing.ParseTraceParent(t.instance.Annotations[traceParentAnnotation]); ok {
+		options = append(options, trace.WithLinks(trace.Link{SpanContext: request}))
+	}
+	ctx, span := tracing.Start(t.context(), name+" "+t.name, options...)
+	span.SetAttributes(attribute.String(logging.FieldTenant, t.name))
+	if requestID := t.instance.Annotations[requestIDAnnotation]; requestID != "" {
+		span.SetAttributes(attribute.String(logging.FieldRequestID, requestID))
+	}
+	t.ctx = ctx
+	return span
+}
+
+// Run a step in a span of its own, so the calls the step makes show up under it
+func (t *tenant) runStep(s step) error {
+	parent := t.ctx
+	ctx, span := tracing.Start(t.context(), s.name)
+	t.ctx = ctx
+	defer func() { t.ctx = parent }()
+	defer span.End()
+
+	span.SetAttributes(attribute.String(logging.FieldStep, s.name))
+	err := s.run(t)
+	tracing.RecordError(span, err)
+	return err
+}
+
+// Run every step after the one named by lastStep.  An empty lastStep starts from the beginning of the pipeline.  When
+// resuming, the repeatable steps which have already completed are run again first, so objects which exist and are
+// healthy are reused and anything missing since, such as after a failure, is recreated.  Failed steps are recorded on
+// the instance, the error returned is for progress which could not be recorded: the tenant is then requeued to carry
+// on from the last step recorded
+func (t *tenant) provision(lastStep string) error {
+	start := 0
+	if lastStep != "" {
+		start = stepIndex(lastStep) + 1
+		if start == 0 {
+			t.log.WithField(logging.FieldStep, lastStep).Error("Unknown step recorded")
+			return t.fail(step{name: lastStep, component: ConditionReady}, fmt.Errorf("Unknown provisioning step %s", lastStep))
+		}
+	}
+
+	for _, s := range pipeline[:start] {
+		if s.once {
+			continue
+		}
+		if err := t.runStep(s); err != nil {
+			t.log.WithField(logging.FieldStep, s.name).WithError(err).Error("Completed step failed")
+			return t.fail(s, err)
+		}
+	}
+
+	for i := start; i < len(pipeline); i++ {
+		s := pipeline[i]
+		if err := t.recordStepStarted(s); err != nil {
+			return err
+		}
+		started := time.Now()
+		if err := t.runStep(s); err != nil {
+			t.log.WithField(logging.FieldStep, s.name).WithError(err).Error("Step failed")
+			return t.fail(s, err)
+		}
+		stepDuration.WithLabelValues(s.name).Observe(time.Since(started).Seconds())
+		if err := t.recordStep(s, componentCompleted(i)); err != nil {
+			return err
+		}
+	}
+
+	return t.recordCompleted()
+}
+
+// Re-run every repeatable step of a ready tenant, recreating anything which has been removed since it was provisioned.
+// Deployments are not waited on: one which is still rolling out does not stop the repair, which returns a
+// notReadyError once every step has run so the tenant is looked at again later
+func (t *tenant) repair() error {
+	t.checkOnly = true
+	defer func() { t.checkOnly = false }()
+
+	var notReady error
+	for _, s := range pipeline {
+		if s.once || s.noRepair {
+			continue
+		}
+		err := s.run(t)
+		var notReadyErr *notReadyError
+		if errors.As(err, &notReadyErr) {
+			notReady = err
+			continue
+		}
+		if err != nil {
+			t.event(corev1.EventTypeWarning, EventRepairFailed, "Repairing step %s failed: %v", s.name, err)
+			return err
+		}
+	}
+	return notReady
+}
+
+// A component is provisioned once the last of its steps has completed
+func componentCompleted(i int) bool {
+	for _, s := range pipeline[i+1:] {
+		if s.component == pipeline[i].component {
+			return false
+		}
+	}
+	return true
+}
+
+// Find the position of a step in the pipeline, or -1 if there is no such step
+func stepIndex(name string) int {
+	for i, s := range pipeline {
+		if s.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Create the tenant namespace, owned by the SaaSInstance so deleting the instance deletes the tenant.  Namespaces
+// adopted from before the SaaSInstance resource existed are given the owner reference, and the tenant owner label is
+// kept in line with the owner of the instance
+func (t *tenant) ensureNamespace() error {
+	owner := metav1.NewControllerRef(t.instance, saasInstanceGVR.GroupVersion().WithKind(saasInstanceKind))
+	labels := map[string]string{}
+	if t.instance.Spec.Owner != "" {
+		labels[ownerLabel] = ownerLabelValue(t.instance.Spec.Owner)
+	}
+
+	namespace, err := t.clientset.CoreV1().Namespaces().Get(t.callContext(), t.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = t.clientset.CoreV1().Namespaces().Create(t.callContext(), &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   t.name,
+				Labels: labels,
+				Annotations: map[string]string{
+					"manager":       "saas",
+					"status":        "Working: created namespace",
+					ownerAnnotation: t.instance.Spec.Owner,
+				},
+				OwnerReferences: []metav1.OwnerReference{*owner},
+			},
+		}, metav1.CreateOptions{})
+		return ignoreAlreadyExists(err)
+	}
+	if err != nil {
+		return err
+	}
+	// A namespace deleted by the failure policy has to be gone before the tenant can be provisioned again
+	if namespace.DeletionTimestamp != nil {
+		return fmt.Errorf("namespace %s is still being deleted", t.name)
+	}
+
+	metadata := map[string]interface{}{}
+	if metav1.GetControllerOf(namespace) == nil {
+		metadata["ownerReferences"] = []metav1.OwnerReference{*owner}
+	}
+	if t.instance.Spec.Owner != "" && namespace.Labels[ownerLabel] != labels[ownerLabel] {
+		metadata["labels"] = labels
+		metadata["annotations"] = map[string]string{ownerAnnotation: t.instance.Spec.Owner}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	namespacePatch, _ := json.Marshal(map[string]interface{}{"metadata": metadata})
+	_, err = t.clientset.CoreV1().Namespaces().Patch(t.callContext(), t.name, types.MergePatchType, namespacePatch, metav1.PatchOptions{})
+	return err
+}
+
+// Delete the namespace of an instance being deleted, then release the instance by removing its finalizer.  Deleting
+// the namespace re-queues the instance, so this is called again once the namespace has gone
+func (t *tenant) finalize() error {
+	if !hasFinalizer(t.instance) {
+		return nil
+	}
+
+	if t.instance.Status.Phase != PhaseDeleting {
+		t.recordDeleting()
+	}
+
+	err := t.clientset.CoreV1().Namespaces().Delete(t.callContext(), t.name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	_, err = t.clientset.CoreV1().Namespaces().Get(t.callContext(), t.name, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		// Still terminating
+		return err
+	}
+
+	var finalizers []string
+	for _, finalizer := range t.instance.Finalizers {
+		if finalizer != namespaceFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	return t.setFinalizers(finalizers)
+}
+
+func hasFinalizer(instance *SaaSInstance) bool {
+	for _, finalizer := range instance.Finalizers {
+		if finalizer == namespaceFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the finalizers of the instance.  The resource version is part of the patch so a concurrent change to the
+// finalizers is not overwritten
+func (t *tenant) setFinalizers(finalizers []string) error {
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+
+	finalizerPatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": t.instance.ResourceVersion,
+		},
+	})
+	_, err := t.instances.Patch(t.callContext(), t.instance.Name, types.MergePatchType, finalizerPatch, metav1.PatchOptions{})
+	return err
+}
+
+// Give a new instance its first status.  Instances adopted from an existing namespace carry over the progress
+// recorded in the namespace annotations
+func (t *tenant) initializeStatus() error {
+	annotations := map[string]string{}
+	namespace, err := t.clientset.CoreV1().Namespaces().Get(t.callContext(), t.name, metav1.GetOptions{})
+	if err == nil && namespace.Annotations != nil {
+		annotations = namespace.Annotations
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		if status.Phase != "" {
+			return
+		}
+
+		status.Step = annotations["step"]
+		status.Message = annotations["status"]
+		status.Error = annotations["error"]
+		switch {
+		case annotations["manager"] != "saas":
+			status.Phase = PhasePending
+		case strings.ToLower(annotations["status"]) == "completed":
+			status.Phase = PhaseReady
+		case strings.ToLower(annotations["status"]) == "failed":
+			status.Phase = PhaseFailed
+		default:
+			status.Phase = PhaseProvisioning
+		}
+	})
+}
+
+// Record a tenant waiting in the provisioning queue.  The position is not recorded as it changes with every tenant
+// ahead in the queue
+func (t *tenant) recordQueued() error {
+	if t.instance.Status.Message == queuedMessage {
+		return nil
+	}
+	t.event(corev1.EventTypeNormal, EventQueued, "Waiting to be provisioned")
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Message = queuedMessage
+		status.SetCondition(Condition{Type: ConditionReady, Status: ConditionFalse, Reason: "Queued", Message: queuedMessage})
+	})
+}
+
+// Record the step about to run as the current step of the instance
+func (t *tenant) recordStepStarted(s step) error {
+	t.log.WithField(logging.FieldStep, s.name).Info("Step started")
+	t.event(corev1.EventTypeNormal, EventStepStarted, "Step %s started", s.name)
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseProvisioning
+		status.CurrentStep = s.name
+		status.SetCondition(Condition{Type: s.component, Status: ConditionFalse, Reason: "Provisioning", Message: s.name})
+		status.SetCondition(Condition{Type: ConditionReady, Status: ConditionFalse, Reason: "Provisioning", Message: s.name})
+	})
+}
+
+// Record a completed step on the instance status and the namespace annotations.  The condition of the step's
+// component becomes true when componentDone is set
+func (t *tenant) recordStep(s step, componentDone bool) error {
+	t.annotate(map[string]string{"step": s.name, "status": s.status, "manager": "saas"})
+	t.log.WithField(logging.FieldStep, s.name).Info("Step completed")
+	t.event(corev1.EventTypeNormal, EventStepCompleted, "Step %s completed", s.name)
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseProvisioning
+		status.Step = s.name
+		status.CurrentStep = ""
+		status.Message = s.status
+		if componentDone {
+			status.SetCondition(Condition{Type: s.component, Status: ConditionTrue, Reason: "Provisioned", Message: s.status})
+		}
+	})
+}
+
+// Record a failed step on the instance status and the namespace annotations, scheduling a retry if the tenant has
+// attempts left.  When restart is set everything provisioned so far is being removed, so a retry starts from the
+// first step
+func (t *tenant) recordFailure(s step, stepErr error, restart bool) error {
+	errStr := stepErr.Error()
+	annotations := map[string]string{"status": "Failed", "manager": "saas", "error": errStr}
+	if restart {
+		annotations["step"] = ""
+	}
+	t.annotate(annotations)
+	provisioningFailures.WithLabelValues(s.name, failureReason(stepErr)).Inc()
+	err := t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseFailed
+		status.CurrentStep = ""
+		status.Message = "Failed"
+		status.Error = errStr
+		status.Attempts++
+		status.NextRetryTime = nil
+		if backoff := t.retry.backoff(status.Attempts); backoff > 0 {
+			next := metav1.NewTime(time.Now().Add(backoff))
+			status.NextRetryTime = &next
+			status.Message = fmt.Sprintf("Failed, retrying at %s", next.Format(time.RFC3339))
+		}
+		status.SetCondition(Condition{Type: s.component, Status: ConditionFalse, Reason: "StepFailed", Message: errStr})
+		status.SetCondition(Condition{Type: ConditionReady, Status: ConditionFalse, Reason: "ProvisioningFailed", Message: errStr})
+
+		if restart {
+			status.Step = ""
+			for i := range status.Conditions {
+				if status.Conditions[i].Type != ConditionReady && status.Conditions[i].Status == ConditionTrue {
+					status.Conditions[i].Status = ConditionFalse
+					status.Conditions[i].Reason = "RolledBack"
+					status.Conditions[i].LastTransitionTime = metav1.Now()
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if next := t.instance.Status.NextRetryTime; next != nil {
+		t.event(corev1.EventTypeWarning, EventStepFailed, "Step %s failed, retrying at %s: %s", s.name, next.Format(time.RFC3339), errStr)
+	} else {
+		t.event(corev1.EventTypeWarning, EventStepFailed, "Step %s failed: %s", s.name, errStr)
+	}
+	return nil
+}
+
+// Record a fully provisioned tenant on the instance status and the namespace annotations
+func (t *tenant) recordCompleted() error {
+	t.annotate(map[string]string{"status": "Completed", "manager": "saas"})
+	err := t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseReady
+		status.CurrentStep = ""
+		status.Message = "Completed"
+		status.Error = ""
+		status.Release = t.releaseName()
+		status.URLs = InstanceURLs{
+			Frontend: "http://" + t.settings.frontendHost(t.name),
+			Backend:  "http://" + t.settings.backendHost(t.name),
+		}
+		status.SetCondition(Condition{Type: ConditionReady, Status: ConditionTrue, Reason: "Provisioned"})
+	})
+	if err != nil {
+		return err
+	}
+	provisioned.Inc()
+	t.log.WithField("release", t.releaseName()).Info("Tenant provisioned")
+	t.event(corev1.EventTypeNormal, EventProvisioned, "Tenant provisioned with release %s", t.releaseName())
+	return nil
+}
+
+// Record the release a tenant provisioned before releases were recorded runs
+func (t *tenant) recordRelease() error {
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		if status.Release == "" {
+			status.Release = t.releaseName()
+		}
+	})
+}
+
+// Name of the release in the spec, resolving an empty release to the default release
+func (t *tenant) releaseName() string {
+	if release, ok := t.releases.Find(t.instance.Spec.Release); ok {
+		return release.Name
+	}
+	return t.instance.Spec.Release
+}
+
+// Record an instance being deleted
+func (t *tenant) recordDeleting() {
+	t.log.Info("Deleting tenant")
+	t.event(corev1.EventTypeNormal, EventDeleting, "Deleting tenant namespace")
+	_ = t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseDeleting
+		status.CurrentStep = ""
+		status.Message = "Deleting"
+		status.SetCondition(Condition{Type: ConditionReady, Status: ConditionFalse, Reason: "Deleting"})
+	})
+}
+
+// Update namespace with annotations to be read later
+func (t *tenant) annotate(annotations map[string]string) {
+	annotationsPatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+
+	_, err := t.clientset.CoreV1().Namespaces().Patch(t.callContext(), t.name, types.MergePatchType, annotationsPatch, metav1.PatchOptions{})
+	if err != nil {
+		t.log.WithError(err).Error("Failed to annotate namespace")
+	}
+}
+
+// Apply a change to the status of the latest version of the instance, retrying on conflicts
+func (t *tenant) updateStatus(update func(status *SaaSInstanceStatus)) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := t.instances.Get(t.callContext(), t.instance.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		instance, err := instanceFromUnstructured(obj)
+		if err != nil {
+			return err
+		}
+		update(&instance.Status)
+
+		obj, err = instanceToUnstructured(instance)
+		if err != nil {
+			return err
+		}
+		obj, err = t.instances.UpdateStatus(t.callContext(), obj, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+
+		t.instance, err = instanceFromUnstructured(obj)
+		return err
+	})
+	if err != nil {
+		t.log.WithError(err).Error("Failed to update instance status")
+	}
+	return err
+}
+
+// Treat an AlreadyExists error as success so steps can be re-run after a restart
+func ignoreAlreadyExists(err error) error {
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// Read a generated password back out of one of the tenant's secrets
+func (t *tenant) password(secretName string) (string, error) {
+	secret, err := t.clientset.CoreV1().Secrets(t.name).Get(t.callContext(), secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", secretName, err)
+	}
+	return string(secret.Data["password"]), nil
+}
+
+// Apply a secret with a freshly generated password, keeping the existing password if it was created by an earlier run
+func (t *tenant) createCredentials(secretName string, username string) error {
+	password := generatePassword()
+	existing, err := t.clientset.CoreV1().Secrets(t.name).Get(t.callContext(), secretName, metav1.GetOptions{})
+	if err == nil && len(existing.Data["password"]) > 0 {
+		password = string(existing.Data["password"])
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return t.apply(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName},
+		Data:       map[string][]byte{"username": []byte(username), "password": []byte(password)},
+	})
+}
+
+func createDatabaseCredentials(t *tenant) error {
+	if err := t.createCredentials(databaseSecretName, postgresUser); err != nil {
+		return fmt.Errorf("Failed to create postgresql credentials: %w", err)
+	}
+	return nil
+}
+
+// Create the postgresql claim when it does not exist yet.  An existing claim is left alone: its storage request can
+// only grow, and only on an expandable storage class, so applying a changed default size would fail on every tenant
+func createPostgresPVC(t *tenant) error {
+	postgresPVC := &corev1.PersistentVolumeClaim{}
+	if err := t.decode("PersistentVolumeClaim", "volume", postgresPVC); err != nil {
+		return fmt.Errorf("Failed to create postgresql pvc: %w", err)
+	}
+	_, err := t.clientset.CoreV1().PersistentVolumeClaims(t.name).Get(t.callContext(), postgresPVC.Name, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("Failed to create postgresql pvc: %w", err)
+	}
+
+	size := t.instance.Spec.Sizes.Storage
+	if size == "" {
+		size = t.settings.Storage
+	}
+	if size != "" {
+		storage, err := resource.ParseQuantity(size)
+		if err != nil {
+			return fmt.Errorf("Invalid postgresql storage size %s: %w", size, err)
+		}
+		if postgresPVC.Spec.Resources.Requests == nil {
+			postgresPVC.Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		postgresPVC.Spec.Resources.Requests[corev1.ResourceStorage] = storage
+	}
+
+	if err := t.apply(postgresPVC); err != nil {
+		return fmt.Errorf("Failed to create postgresql pvc: %w", err)
+	}
+	return nil
+}
+
+func createPostgresDeployment(t *tenant) error {
+	return t.createDeployment("postgresql", t.instance.Spec.Versions.PostgreSQL)
+}
+
+func waitOnPostgres(t *tenant) error {
+	if err := t.waitOnDeployment("postgresql"); err != nil {
+		return fmt.Errorf("Postgresql deployment not ready: %w", err)
+	}
+	return nil
+}
+
+func createPostgresService(t *tenant) error {
+	return t.createService("postgresql")
+}
+
+func createBackendDeployment(t *tenant) error {
+	return t.createDeployment("backend", t.instance.Spec.Versions.Backend)
+}
+
+func waitOnBackend(t *tenant) error {
+	if err := t.waitOnDeployment("backend"); err != nil {
+		return fmt.Errorf("Backend deployment not ready: %w", err)
+	}
+	return nil
+}
+
+func createBackendService(t *tenant) error {
+	return t.createService("backend")
+}
+
+// Create backend ingress (namespace-backend.domain)
+func createBackendIngress(t *tenant) error {
+	return t.createIngress("backend")
+}
+
+func createFrontendDeployment(t *tenant) error {
+	return t.createDeployment("frontend", t.instance.Spec.Versions.Frontend)
+}
+
+func waitOnFrontend(t *tenant) error {
+	if err := t.waitOnDeployment("frontend"); err != nil {
+		return fmt.Errorf("Frontend deployment not ready: %w", err)
+	}
+	return nil
+}
+
+func createFrontendService(t *tenant) error {
+	return t.createService("frontend")
+}
+
+// Create frontend ingress (namespace.domain)
+func createFrontendIngress(t *tenant) error {
+	return t.createIngress("frontend")
+}
+
+// The admin password is stored before the user is registered so a resumed tenant registers with the same password
+func createAdminCredentials(t *tenant) error {
+	if err := t.createCredentials(backendSecretName, "admin"); err != nil {
+		return fmt.Errorf("Failed to create backend secret: %w", err)
+	}
+	return nil
+}
+
+func registerAdminUser(t *tenant) error {
+	t.beat()
+	password, err := t.password(backendSecretName)
+	if err != nil {
+		return fmt.Errorf("Failed to create backend admin user: %w", err)
+	}
+
+	userJson, _ := json.Marshal(BackendUser{
+		Username: "admin",
+		Password: password,
+	})
+	req, err := http.NewRequestWithContext(t.context(), http.MethodPost, "http://"+t.settings.backendHost(t.name)+"/register", bytes.NewReader(userJson))
+	if err != nil {
+		return fmt.Errorf("Failed to create backend admin user: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to create backend admin user: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return fmt.Errorf("Failed to create backend admin user: status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Render the blueprint and decode one of its objects
+func (t *tenant) decode(kind string, name string, into interface{}) error {
+	objects, err := t.objects()
+	if err != nil {
+		return err
+	}
+	return objects.Decode(kind, name, into)
+}
+
+// Create a deployment from the blueprint, running the image of the tenant's release with the given image tag in the
+// container of the same name
+func (t *tenant) createDeployment(name string, tag string) error {
+	release, ok := t.releases.Find(t.instance.Spec.Release)
+	if !ok {
+		return fmt.Errorf("Failed to create %s deployment: unknown release %s", name, t.instance.Spec.Release)
+	}
+
+	deploy := &appsv1.Deployment{}
+	if err := t.decode("Deployment", name, deploy); err != nil {
+		return fmt.Errorf("Failed to create %s deployment: %w", name, err)
+	}
+	setContainerImage(deploy.Spec.Template.Spec.Containers, name, release.Images.image(name))
+	setContainerTag(deploy.Spec.Template.Spec.Containers, name, tag)
+
+	if err := t.recreateStrategyOf(deploy); err != nil {
+		return fmt.Errorf("Failed to create %s deployment: %w", name, err)
+	}
+	if err := t.apply(deploy); err != nil {
+		return fmt.Errorf("Failed to create %s deployment: %w", name, err)
+	}
+	return nil
+}
+
+func (t *tenant) createService(name string) error {
+	service := &corev1.Service{}
+	if err := t.decode("Service", name, service); err != nil {
+		return fmt.Errorf("Failed to create %s service: %w", name, err)
+	}
+
+	if err := t.apply(service); err != nil {
+		return fmt.Errorf("Failed to create %s service: %w", name, err)
+	}
+	return nil
+}
+
+func (t *tenant) createIngress(name string) error {
+	ingress := &netv1beta1.Ingress{}
+	if err := t.decode("Ingress", name, ingress); err != nil {
+		return fmt.Errorf("Failed to create %s ingress: %w", name, err)
+	}
+
+	if err := t.apply(ingress); err != nil {
+		return fmt.Errorf("Failed to create %s ingress: %w", name, err)
+	}
+	return nil
+}
+
+// Replace the image of the named container.  An empty image keeps the image in the blueprint
+func setContainerImage(containers []corev1.Container, container string, image string) {
+	if image == "" {
+		return
+	}
+	for i := range containers {
+		if containers[i].Name == container {
+			containers[i].Image = image
+			return
+		}
+	}
+}
+
+// Replace the image tag of the named container.  An empty tag keeps the default image
+func setContainerTag(containers []corev1.Container, container string, tag string) {
+	if tag == "" {
+		return
+	}
+	for i := range containers {
+		if containers[i].Name == container {
+			image := containers[i].Image
+			if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+				image = image[:idx]
+			}
+			containers[i].Image = image + ":" + tag
+			return
+		}
+	}
+}
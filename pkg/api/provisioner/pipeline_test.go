@@ -0,0 +1,301 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A tenant worked on by a controller under test, for an instance held by the fake dynamic client
+func newTestTenant(t *testing.T, instance *SaaSInstance, objects ...runtime.Object) (*tenant, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	obj, err := instanceToUnstructured(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cs, dc := newTestController(t, append(objects, obj)...)
+	return c.tenantFor(instance), cs, dc
+}
+
+// Read an instance back from the fake dynamic client, with everything recorded on it
+func storedInstance(t *testing.T, dc *dynamicfake.FakeDynamicClient, name string) *SaaSInstance {
+	obj, err := dc.Resource(saasInstanceGVR).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+// Report every deployment of a fake clientset as rolled out and available, as the deployment controller would, apart
+// from those running one of the failing images which are reported past their progress deadline.  Lists are filtered
+// by name, which the fake clientset ignores
+func readyDeployments(cs *fake.Clientset, failingImages ...string) {
+	cs.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		list, err := cs.Tracker().List(action.GetResource(), appsv1.SchemeGroupVersion.WithKind("Deployment"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		deployments := list.(*appsv1.DeploymentList)
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		items := deployments.Items[:0]
+		for _, deploy := range deployments.Items {
+			if selector.Matches(fields.Set{"metadata.name": deploy.Name}) {
+				items = append(items, deploy)
+			}
+		}
+		deployments.Items = items
+
+		for i := range deployments.Items {
+			deploy := &deployments.Items[i]
+			deploy.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: deploy.Generation,
+				Replicas:           1,
+				UpdatedReplicas:    1,
+				ReadyReplicas:      1,
+				AvailableReplicas:  1,
+			}
+			for _, container := range deploy.Spec.Template.Spec.Containers {
+				for _, image := range failingImages {
+					if container.Image == image {
+						deploy.Status = appsv1.DeploymentStatus{
+							ObservedGeneration: deploy.Generation,
+							Conditions: []appsv1.DeploymentCondition{{
+								Type:   appsv1.DeploymentProgressing,
+								Status: corev1.ConditionFalse,
+								Reason: "ProgressDeadlineExceeded",
+							}},
+						}
+					}
+				}
+			}
+		}
+		return true, deployments, nil
+	})
+}
+
+// Backend admin users registered by the pipeline, served in place of tenant backends
+type registrations struct {
+	mutex sync.Mutex
+	users []BackendUser
+}
+
+func (r *registrations) RoundTrip(req *http.Request) (*http.Response, error) {
+	var user BackendUser
+	if err := json.NewDecoder(req.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	r.users = append(r.users, user)
+	r.mutex.Unlock()
+	return &http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func registerAdminUsers(t *testing.T) *registrations {
+	registered := &registrations{}
+	client := backendClient
+	backendClient = &http.Client{Transport: registered}
+	t.Cleanup(func() { backendClient = client })
+	return registered
+}
+
+// Replace the provisioning pipeline with steps which only record that they ran
+func recordingPipeline(t *testing.T, steps ...step) *[]string {
+	var ran []string
+	original := pipeline
+	pipeline = nil
+	for _, s := range steps {
+		s.status = "Working: " + s.name
+		name := s.name
+		s.run = func(t *tenant) error {
+			ran = append(ran, name)
+			return nil
+		}
+		pipeline = append(pipeline, s)
+	}
+	t.Cleanup(func() { pipeline = original })
+	return &ran
+}
+
+// Make every status update of an instance fail, as when the API server can not be reached
+func failStatusUpdates(dc *dynamicfake.FakeDynamicClient) {
+	dc.PrependReactor("update", "saasinstances", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		return true, nil, errors.New("connection refused")
+	})
+}
+
+// Progress which can not be recorded is returned so the tenant is requeued, rather than carrying on from a step the
+// instance does not know about
+func TestProvisionStopsWhenProgressIsNotRecorded(t *testing.T) {
+	tn, cs, dc := newTestTenant(t, newSaaSInstance("team-a"))
+	failStatusUpdates(dc)
+
+	if err := tn.provision(""); err == nil {
+		t.Fatal("expected provisioning to stop when the started step can not be recorded")
+	}
+	for _, action := range cs.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("expected no step to run, got %s of %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+// A failure which can not be recorded is not cleaned up, the requeued tenant runs the failed step again
+func TestFailureNotCleanedUpUntilRecorded(t *testing.T) {
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "postgresql", Namespace: "team-a"}}
+	tn, cs, dc := newTestTenant(t, newSaaSInstance("team-a"), deploy)
+	tn.retry.OnFailure = FailurePolicyRollback
+	failStatusUpdates(dc)
+
+	if err := tn.fail(pipeline[stepIndex("postgresql-ready")], errors.New("postgresql is not ready")); err == nil {
+		t.Fatal("expected the failure to be returned when it can not be recorded")
+	}
+	if _, err := cs.AppsV1().Deployments("team-a").Get(context.Background(), "postgresql", metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		t.Error("expected the namespace to be left alone until the failure is recorded")
+	}
+}
+
+func TestStepIndex(t *testing.T) {
+	for i, s := range pipeline {
+		if index := stepIndex(s.name); index != i {
+			t.Errorf("expected step %s at %d, got %d", s.name, i, index)
+		}
+	}
+	if index := stepIndex("no-such-step"); index != -1 {
+		t.Errorf("expected -1 for an unknown step, got %d", index)
+	}
+}
+
+// A component is provisioned by its last step, whether or not its steps follow each other
+func TestComponentCompleted(t *testing.T) {
+	completing := map[string]bool{
+		"postgresql-service": true,
+		"backend-service":    true,
+		"frontend-service":   true,
+		"frontend-ingress":   true,
+		"admin-user":         true,
+	}
+	for i, s := range pipeline {
+		if completed := componentCompleted(i); completed != completing[s.name] {
+			t.Errorf("expected step %s to complete its component %t, got %t", s.name, completing[s.name], completed)
+		}
+	}
+}
+
+// Resuming runs the repeatable steps which already completed, then carries on after the last recorded step
+func TestProvisionResumesFromLastStep(t *testing.T) {
+	tests := []struct {
+		lastStep string
+		ran      []string
+	}{
+		{lastStep: "", ran: []string{"credentials", "claim", "register", "deployment"}},
+		{lastStep: "credentials", ran: []string{"claim", "register", "deployment"}},
+		{lastStep: "claim", ran: []string{"claim", "register", "deployment"}},
+		{lastStep: "register", ran: []string{"claim", "deployment"}},
+		{lastStep: "deployment", ran: []string{"claim", "deployment"}},
+	}
+
+	for _, test := range tests {
+		t.Run("after "+test.lastStep, func(t *testing.T) {
+			ran := recordingPipeline(t,
+				step{name: "credentials", component: ConditionPostgreSQL, once: true},
+				step{name: "claim", component: ConditionPostgreSQL, noRepair: true},
+				step{name: "register", component: ConditionAdminUser, once: true},
+				step{name: "deployment", component: ConditionBackend},
+			)
+			instance := newSaaSInstance("team-a")
+			instance.Status.Phase = PhaseProvisioning
+			instance.Status.Step = test.lastStep
+			tn, _, dc := newTestTenant(t, instance)
+
+			if err := tn.provision(test.lastStep); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*ran, test.ran) {
+				t.Errorf("expected steps %v to run, got %v", test.ran, *ran)
+			}
+			stored := storedInstance(t, dc, "team-a")
+			if stored.Status.Phase != PhaseReady || stored.Status.Step != "deployment" {
+				t.Errorf("expected the tenant to be ready after the last step, got %s after %q", stored.Status.Phase, stored.Status.Step)
+			}
+		})
+	}
+}
+
+// A step unknown to this version of the provisioner fails the tenant rather than guessing where to carry on
+func TestProvisionFailsOnUnknownStep(t *testing.T) {
+	ran := recordingPipeline(t, step{name: "deployment", component: ConditionBackend})
+	instance := newSaaSInstance("team-a")
+	instance.Status.Phase = PhaseProvisioning
+	tn, _, dc := newTestTenant(t, instance)
+
+	if err := tn.provision("removed-step"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*ran) > 0 {
+		t.Errorf("expected no step to run, got %v", *ran)
+	}
+	if stored := storedInstance(t, dc, "team-a"); stored.Status.Phase != PhaseFailed {
+		t.Errorf("expected the tenant to fail, got %s", stored.Status.Phase)
+	}
+}
+
+// A provisioner which restarted part way through a tenant finishes it with the credentials it already made, and
+// recreates objects which went missing while it was down
+func TestProvisionResumesAfterRestart(t *testing.T) {
+	registered := registerAdminUsers(t)
+	instance := newSaaSInstance("team-a")
+	instance.Status.Phase = PhaseProvisioning
+	instance.Status.Step = "backend-deployment"
+	tn, cs, dc := newTestTenant(t, instance, databaseSecret("team-a"), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+	readyDeployments(cs)
+
+	if err := tn.provision(instance.Status.Step); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseReady || stored.Status.Step != "admin-user" {
+		t.Fatalf("expected the tenant to be ready, got %s after %q: %s", stored.Status.Phase, stored.Status.Step, stored.Status.Error)
+	}
+	ctx := context.Background()
+	database, err := cs.CoreV1().Secrets("team-a").Get(ctx, databaseSecretName, metav1.GetOptions{})
+	if err != nil || string(database.Data["password"]) != "password" {
+		t.Errorf("expected the database credentials made before the restart to be kept, got %v", err)
+	}
+	for _, name := range []string{"postgresql", "backend", "frontend"} {
+		if _, err := cs.AppsV1().Deployments("team-a").Get(ctx, name, metav1.GetOptions{}); err != nil {
+			t.Errorf("expected the %s deployment: %v", name, err)
+		}
+	}
+	if _, err := cs.CoreV1().PersistentVolumeClaims("team-a").Get(ctx, "volume", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the postgresql claim to be recreated: %v", err)
+	}
+	admin, err := cs.CoreV1().Secrets("team-a").Get(ctx, backendSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered.users) != 1 || registered.users[0].Password != string(admin.Data["password"]) {
+		t.Errorf("expected the admin user to be registered once with the stored password, got %+v", registered.users)
+	}
+}
@@ -0,0 +1,216 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of progress events.  A stream ends after a completed, failed or deleted event
+const (
+	ProgressStep      = "progress"
+	ProgressCompleted = "completed"
+	ProgressFailed    = "failed"
+	ProgressDeleted   = "deleted"
+)
+
+// Progress events kept for each tenant, so a client which reconnects gets the events it missed
+const progressHistoryLimit = 50
+
+// Events buffered for a subscriber which is not keeping up.  A subscriber whose buffer is full is dropped, and picks up
+// the events it missed when it reconnects
+const progressBuffer = 16
+
+// Time between keep-alive comments on an idle stream
+const progressKeepAlive = 15 * time.Second
+
+// A transition of a tenant, such as a step starting or completing
+type ProgressEvent struct {
+	ID     string `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Tenant string `json:"tenant"`
+	Phase  Phase  `json:"phase"`
+	// Last completed step and the step currently running
+	Step        string      `json:"step,omitempty"`
+	CurrentStep string      `json:"currentStep,omitempty"`
+	Status      string      `json:"status,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Time        metav1.Time `json:"time"`
+}
+
+// Whether nothing more happens to the tenant after the event, unless someone asks for it
+func (e ProgressEvent) Final() bool {
+	return e.Type == ProgressCompleted || e.Type == ProgressFailed || e.Type == ProgressDeleted
+}
+
+// Progress of an instance as it stands
+func newProgressEvent(instance *SaaSInstance) ProgressEvent {
+	event := ProgressEvent{
+		Type:        ProgressStep,
+		Tenant:      instance.TenantName(),
+		Phase:       instance.CurrentPhase(),
+		Step:        instance.Status.Step,
+		CurrentStep: instance.Status.CurrentStep,
+		Status:      instance.Status.Message,
+		Error:       instance.Status.Error,
+		Time:        metav1.Now(),
+	}
+	switch {
+	case event.Phase == PhaseReady:
+		event.Type = ProgressCompleted
+	case event.Phase == PhaseFailed && instance.Status.NextRetryTime == nil:
+		// Failed tenants with a retry scheduled carry on by themselves
+		event.Type = ProgressFailed
+	}
+	return event
+}
+
+// Whether two events describe the same state of a tenant
+func (e ProgressEvent) sameAs(other ProgressEvent) bool {
+	return e.Type == other.Type && e.Phase == other.Phase && e.Step == other.Step &&
+		e.CurrentStep == other.CurrentStep && e.Status == other.Status && e.Error == other.Error
+}
+
+// Fans the progress of tenants out to the clients streaming it.  Event ids start with the time the hub was created, so
+// an id handed out before the provisioner restarted is never mistaken for a new one
+type progressHub struct {
+	mutex       sync.Mutex
+	epoch       string
+	nextID      int
+	history     map[string][]ProgressEvent
+	subscribers map[string]map[chan ProgressEvent]bool
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		epoch:       strconv.FormatInt(time.Now().Unix(), 36),
+		history:     map[string][]ProgressEvent{},
+		subscribers: map[string]map[chan ProgressEvent]bool{},
+	}
+}
+
+// Give an event an id, remember it and send it to every subscriber of its tenant
+func (h *progressHub) publish(event ProgressEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	history := h.history[event.Tenant]
+	if len(history) > 0 && history[len(history)-1].sameAs(event) {
+		return
+	}
+
+	h.nextID++
+	event.ID = fmt.Sprintf("%s-%d", h.epoch, h.nextID)
+	history = append(history, event)
+	if len(history) > progressHistoryLimit {
+		history = history[len(history)-progressHistoryLimit:]
+	}
+	h.history[event.Tenant] = history
+	if event.Type == ProgressDeleted {
+		delete(h.history, event.Tenant)
+	}
+
+	for subscriber := range h.subscribers[event.Tenant] {
+		select {
+		case subscriber <- event:
+		default:
+			delete(h.subscribers[event.Tenant], subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe to the events of a tenant.  When lastID is a known event the events after it are returned to be sent
+// first and resumed is set, otherwise the caller starts from the current state of the tenant.  The channel is closed
+// when the subscriber falls behind
+func (h *progressHub) subscribe(tenant string, lastID string) (missed []ProgressEvent, resumed bool, events chan ProgressEvent, unsubscribe func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	history := h.history[tenant]
+	for i := range history {
+		if lastID != "" && history[i].ID == lastID {
+			missed = append(missed, history[i+1:]...)
+			resumed = true
+			break
+		}
+	}
+
+	subscriber := make(chan ProgressEvent, progressBuffer)
+	if h.subscribers[tenant] == nil {
+		h.subscribers[tenant] = map[chan ProgressEvent]bool{}
+	}
+	h.subscribers[tenant][subscriber] = true
+
+	unsubscribe = func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.subscribers[tenant][subscriber] {
+			delete(h.subscribers[tenant], subscriber)
+			close(subscriber)
+		}
+		if len(h.subscribers[tenant]) == 0 {
+			delete(h.subscribers, tenant)
+		}
+	}
+	return missed, resumed, subscriber, unsubscribe
+}
+
+// Id of the latest event of a tenant, empty if there is none
+func (h *progressHub) lastID(tenant string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	history := h.history[tenant]
+	if len(history) == 0 {
+		return ""
+	}
+	return history[len(history)-1].ID
+}
+
+// Publish the progress of a changed instance
+func (c *Controller) publishProgress(obj interface{}) {
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		return
+	}
+	c.progress.publish(newProgressEvent(instance))
+}
+
+// Publish the deletion of an instance
+func (c *Controller) publishDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	instance, err := instanceFromUnstructured(obj)
+	if err != nil {
+		return
+	}
+	c.progress.publish(ProgressEvent{
+		Type:   ProgressDeleted,
+		Tenant: instance.TenantName(),
+		Phase:  PhaseDeleting,
+		Status: "Deleted",
+		Time:   metav1.Now(),
+	})
+}
+
+type connKey struct{}
+
+// Keep the connection of each request in its context so long running responses, such as progress streams, can push
+// back the server's write timeout.  Set as the ConnContext of the API server
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// Allow the response to a request to be written for a while longer than the server's write timeout allows
+func extendWriteDeadline(ctx context.Context, d time.Duration) {
+	if conn, ok := ctx.Value(connKey{}).(net.Conn); ok {
+		_ = conn.SetWriteDeadline(time.Now().Add(d))
+	}
+}
@@ -1,18 +1,17 @@
 package provisioner
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/audit"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
 	"github.com/go-chi/chi"
-	corev1 "k8s.io/api/core/v1"
+	"github.com/go-chi/chi/middleware"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	appsv1type "k8s.io/client-go/kubernetes/typed/apps/v1"
-	corev1type "k8s.io/client-go/kubernetes/typed/core/v1"
 	"math/rand"
 	"net/http"
 	"regexp"
@@ -20,10 +19,18 @@ import (
 	"time"
 )
 
-var clientset *kubernetes.Clientset
+// Path of a tenant in the API
+const saasPath = "/v1/saas/"
+
+var clientset kubernetes.Interface
+var controller *Controller
 
 type NamespaceRequest struct {
 	Namespace string `json:"namespace"`
+	// Release to provision, the default release when empty
+	Release  string           `json:"release,omitempty"`
+	Versions ComponentVersion `json:"versions,omitempty"`
+	Sizes    ComponentSize    `json:"sizes,omitempty"`
 }
 
 type BackendUser struct {
@@ -32,22 +39,88 @@ type BackendUser struct {
 }
 
 type NamespaceResponse struct {
-	Name     string `json:"name,omitempty"`
-	Status   string `json:"status,omitempty"`
-	Error    string `json:"error,omitempty"`
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Url      string `json:"url,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Release string `json:"release,omitempty"`
+	Phase   Phase  `json:"phase,omitempty"`
+	Status  string `json:"status,omitempty"`
+	// Provisioning step currently running
+	Step       string      `json:"step,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Url        string      `json:"url,omitempty"`
+	Upgrades   []Upgrade   `json:"upgrades,omitempty"`
+	// Position in the provisioning queue starting from one, while the instance waits to be provisioned
+	QueuePosition int `json:"queuePosition,omitempty"`
+}
+
+type UpgradeRequest struct {
+	// Release to upgrade to, the default release when empty
+	Release string `json:"release,omitempty"`
+}
+
+type CredentialsResponse struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type CampaignRequest struct {
+	// Release to upgrade every tenant to, the default release when empty
+	Release   string `json:"release,omitempty"`
+	BatchSize int    `json:"batchSize,omitempty"`
+	// Pause between batches, such as "5m"
+	Pause             string `json:"pause,omitempty"`
+	MaxFailurePercent int    `json:"maxFailurePercent,omitempty"`
+}
+
+type CampaignResponse struct {
+	ID string `json:"id"`
+	UpgradeCampaignSpec
+	UpgradeCampaignStatus
 }
 
-func Routes(cs *kubernetes.Clientset) *chi.Mux {
+type OperationResponse struct {
+	// Empty when the request was carried out but its operation could not be recorded
+	ID string `json:"id,omitempty"`
+	// Where the state of the tenant can be read instead, when the operation could not be recorded
+	TenantPath string `json:"tenantPath,omitempty"`
+	OperationSpec
+	OperationStatus
+}
+
+type ReleaseResponse struct {
+	Release
+	Default bool `json:"default,omitempty"`
+}
+
+func Routes(cs kubernetes.Interface, ctrl *Controller) *chi.Mux {
 	clientset = cs
+	controller = ctrl
 
 	router := chi.NewRouter()
-	router.Post("/saas", CreateSaaS)
-	router.Get("/saas", GetSaaS)
-	router.Delete("/saas", DeleteSaaS)
+	router.With(auth.Require(auth.RoleOperator)).Post("/saas", CreateSaaS)
+	router.With(auth.Require(auth.RoleViewer)).Get("/saas", GetSaaS)
+	router.With(auth.Require(auth.RoleViewer)).Get("/saas/{name}", GetSaaSInstance)
+	router.With(auth.Require(auth.RoleViewer)).Get("/saas/{name}/events", StreamSaaSProgress)
+	router.With(auth.Require(auth.RoleOperator)).Get("/saas/{name}/credentials", GetSaaSCredentials)
+	router.With(auth.Require(auth.RoleOperator)).Post("/saas/{name}/upgrade", UpgradeSaaS)
+	router.With(auth.Require(auth.RoleOperator)).Post("/saas/{name}/retry", RetrySaaS)
+	router.With(auth.Require(auth.RoleOperator)).Delete("/saas", DeleteSaaS)
+	router.With(auth.Require(auth.RoleViewer)).Get("/releases", GetReleases)
+	router.With(auth.Require(auth.RoleAdmin)).Post("/campaigns", CreateCampaign)
+	router.With(auth.Require(auth.RoleAdmin)).Get("/campaigns/{id}", GetCampaign)
+	router.With(auth.Require(auth.RoleViewer)).Get("/operations/{id}", GetOperation)
+	router.With(auth.Require(auth.RoleAdmin)).Get("/webhooks/dead-letters", GetWebhookDeadLetters)
 	router.Options("/saas", AllowOptions)
+	router.Options("/saas/{name}", AllowOptions)
+	router.Options("/saas/{name}/events", AllowOptions)
+	router.Options("/saas/{name}/credentials", AllowOptions)
+	router.Options("/saas/{name}/upgrade", AllowOptions)
+	router.Options("/saas/{name}/retry", AllowOptions)
+	router.Options("/releases", AllowOptions)
+	router.Options("/campaigns", AllowOptions)
+	router.Options("/campaigns/{id}", AllowOptions)
+	router.Options("/operations/{id}", AllowOptions)
+	router.Options("/webhooks/dead-letters", AllowOptions)
 	return router
 }
 
@@ -55,11 +128,11 @@ func AllowOptions(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// Get all instances of SaaS
-// Get all instances of SaaS
-func GetSaaS(w http.ResponseWriter, _ *http.Request) {
+// Get all instances of SaaS owned by the caller, or every instance for admins
+func GetSaaS(w http.ResponseWriter, r *http.Request) {
+	identity := auth.IdentityFrom(r.Context())
 
-	namespaces, err := clientset.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
+	instances, err := controller.listInstances()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -67,32 +140,9 @@ func GetSaaS(w http.ResponseWriter, _ *http.Request) {
 
 	var nsResponse []NamespaceResponse
 
-	// Look for manager": "saas" annotation
-	for _, val := range namespaces.Items {
-		if annotations := val.GetAnnotations(); annotations != nil && annotations["manager"] == "saas" {
-
-			// Populate the return object
-			ns := NamespaceResponse{
-				Name:   val.Name,
-				Status: annotations["status"],
-				Error:  annotations["error"],
-				Url:    "http://" + val.Name + tld,
-			}
-
-			// Get the secret if the SaaS is in 'Completed' state
-			if strings.ToLower(annotations["status"]) == "completed" {
-				secret, err := clientset.CoreV1().Secrets(val.Name).Get(context.Background(), "backend-creds", metav1.GetOptions{})
-				if err != nil {
-					fmt.Printf("Error fetching backend-creds %v\n", err)
-					continue
-				}
-
-				ns.Username = string(secret.Data["username"])
-				ns.Password = string(secret.Data["password"])
-			}
-
-			// Append the response
-			nsResponse = append(nsResponse, ns)
+	for _, instance := range instances {
+		if instance.AccessibleBy(identity) {
+			nsResponse = append(nsResponse, newNamespaceResponse(instance))
 		}
 	}
 
@@ -114,288 +164,585 @@ func GetSaaS(w http.ResponseWriter, _ *http.Request) {
 
 }
 
-// Delete an instance of SaaS
-func DeleteSaaS(w http.ResponseWriter, r *http.Request) {
-	var ns NamespaceRequest
+// Get a single instance of SaaS by name
+func GetSaaSInstance(w http.ResponseWriter, r *http.Request) {
+	instance, exists, err := controller.instanceForTenant(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// Decode request
-	err := json.NewDecoder(r.Body).Decode(&ns)
+	// Other users' instances are reported as not found
+	if !exists || !instance.AccessibleBy(auth.IdentityFrom(r.Context())) {
+		http.NotFound(w, r)
+		return
+	}
+
+	nsResponseJson, err := json.Marshal(newNamespaceResponse(instance))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	_, err = clientset.CoreV1().Namespaces().Get(context.Background(), ns.Namespace, metav1.GetOptions{})
+	_, _ = w.Write(nsResponseJson)
+}
+
+// Stream the progress of an instance as server-sent events, one event for every transition of the instance, ending
+// once it has completed, failed or been deleted.  A client which reconnects with the id of the last event it got
+// through the Last-Event-ID header is sent the events it missed
+func StreamSaaSProgress(w http.ResponseWriter, r *http.Request) {
+	instance, exists, err := controller.instanceForTenant(chi.URLParam(r, "name"))
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists || !instance.AccessibleBy(auth.IdentityFrom(r.Context())) {
 		http.NotFound(w, r)
 		return
 	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
 
-	err = clientset.CoreV1().Namespaces().Delete(context.Background(), ns.Namespace, metav1.DeleteOptions{})
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	missed, resumed, events, unsubscribe := controller.progress.subscribe(instance.TenantName(), lastID)
+	defer unsubscribe()
+
+	// A new stream starts from where the instance is now
+	if !resumed {
+		current := newProgressEvent(instance)
+		current.ID = controller.progress.lastID(instance.TenantName())
+		missed = []ProgressEvent{current}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	extendWriteDeadline(r.Context(), 2*progressKeepAlive)
+	_, _ = w.Write([]byte("retry: 5000\n\n"))
+
+	for _, event := range missed {
+		if writeProgressEvent(w, event) != nil || event.Final() {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			extendWriteDeadline(r.Context(), 2*progressKeepAlive)
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case event, open := <-events:
+			// The stream fell behind, the client picks up the events it missed when it reconnects
+			if !open {
+				return
+			}
+			extendWriteDeadline(r.Context(), 2*progressKeepAlive)
+			if writeProgressEvent(w, event) != nil || event.Final() {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeProgressEvent(w http.ResponseWriter, event ProgressEvent) error {
+	eventJson, err := json.Marshal(event)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	var message strings.Builder
+	if event.ID != "" {
+		message.WriteString("id: " + event.ID + "\n")
+	}
+	message.WriteString("event: " + event.Type + "\n")
+	message.WriteString("data: " + string(eventJson) + "\n\n")
+	_, err = w.Write([]byte(message.String()))
+	return err
+}
 
+// Build the response for a single instance from its status.  Credentials are never part of it
+func newNamespaceResponse(instance *SaaSInstance) NamespaceResponse {
+	name := instance.TenantName()
+
+	return NamespaceResponse{
+		Name:       name,
+		Release:    instance.Spec.Release,
+		Phase:      instance.CurrentPhase(),
+		Status:     instance.Status.Message,
+		Step:       instance.Status.CurrentStep,
+		Conditions: instance.Status.Conditions,
+		Error:      instance.Status.Error,
+		Url:        "http://" + controller.current().Tenants.frontendHost(name),
+		Upgrades:   instance.Status.Upgrades,
+
+		QueuePosition: controller.queuePosition(instance),
+	}
 }
 
-// Provisions an instance of Order-Meow UI, Backend, and a Database
-// Note: the database is not persistent until a PVC is created and mounted at the correct location
-func CreateSaaS(w http.ResponseWriter, r *http.Request) {
+// Get the backend admin credentials of a ready instance, or of one being upgraded as it was ready before the upgrade
+// started.  Every read is recorded in the audit log
+func GetSaaSCredentials(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
 
-	var config NamespaceRequest
+	instance, exists, err := controller.instanceForTenant(name)
+	if err != nil {
+		audit.Record(r, "credentials.read", name, audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists || !instance.AccessibleBy(auth.IdentityFrom(r.Context())) {
+		audit.Record(r, "credentials.read", name, audit.OutcomeDenied)
+		http.NotFound(w, r)
+		return
+	}
+	if phase := instance.CurrentPhase(); phase != PhaseReady && phase != PhaseUpgrading {
+		audit.Record(r, "credentials.read", name, audit.OutcomeDenied)
+		http.Error(w, "credentials are not available until the instance is ready", http.StatusConflict)
+		return
+	}
 
-	// Decode request
-	err := json.NewDecoder(r.Body).Decode(&config)
+	secret, err := clientset.CoreV1().Secrets(name).Get(context.Background(), backendSecretName, metav1.GetOptions{})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		audit.Record(r, "credentials.read", name, audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	config.Namespace, err = validateNamespace(config.Namespace)
+	credsJson, err := json.Marshal(CredentialsResponse{
+		Username: string(secret.Data["username"]),
+		Password: string(secret.Data["password"]),
+	})
 	if err != nil {
+		audit.Record(r, "credentials.read", name, audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(r, "credentials.read", name, audit.OutcomeAllowed)
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(credsJson)
+}
+
+// Upgrade a ready instance to another release.  The controller rolls the new images out one deployment at a time and
+// rolls the instance back if a rollout fails
+func UpgradeSaaS(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	var upgrade UpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&upgrade); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	namespaceClient := clientset.CoreV1().Namespaces()
-	namespaceList, _ := namespaceClient.List(context.TODO(), metav1.ListOptions{})
+	instance, exists, err := controller.instanceForTenant(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists || !instance.AccessibleBy(auth.IdentityFrom(r.Context())) {
+		audit.Record(r, "saas.upgrade", name, audit.OutcomeDenied)
+		http.NotFound(w, r)
+		return
+	}
 
-	// Ensure there isn't a namespace already existing with this name
-	for _, val := range namespaceList.Items {
-		if val.Name == config.Namespace {
-			http.Error(w, "namespace already exists", http.StatusConflict)
+	release, ok := controller.current().Releases.Find(upgrade.Release)
+	if !ok {
+		http.Error(w, "unknown release "+upgrade.Release, http.StatusBadRequest)
+		return
+	}
+	// An instance whose spec names a release it does not run yet is already being upgraded
+	if instance.CurrentPhase() != PhaseReady || (instance.Spec.Release != "" && instance.Spec.Release != instance.Status.Release) {
+		http.Error(w, "only ready instances which are not being upgraded can be upgraded", http.StatusConflict)
+		return
+	}
+	if release.Name == instance.Status.Release {
+		http.Error(w, "instance already runs release "+release.Name, http.StatusConflict)
+		return
+	}
+
+	operation := newOperation(OperationSpec{Type: OperationUpgrade, Tenant: name, Release: release.Name})
+	err = controller.requestUpgrade(r.Context(), instance, release.Name, operation.Name)
+	if apierrors.IsConflict(err) {
+		http.Error(w, "instance changed while being upgraded, try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		audit.Record(r, "saas.upgrade", name, audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(r, "saas.upgrade", name, audit.OutcomeAllowed)
+	acceptOperation(w, r, operation)
+}
+
+// Start a campaign upgrading every tenant to a release in batches.  Campaigns touch every tenant so only admins can
+// start them
+func CreateCampaign(w http.ResponseWriter, r *http.Request) {
+	var request CampaignRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release, ok := controller.current().Releases.Find(request.Release)
+	if !ok {
+		http.Error(w, "unknown release "+request.Release, http.StatusBadRequest)
+		return
+	}
+	if request.BatchSize < 0 {
+		http.Error(w, "batch size must not be negative", http.StatusBadRequest)
+		return
+	}
+	if request.MaxFailurePercent < 0 || request.MaxFailurePercent > 100 {
+		http.Error(w, "max failure percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	var pause time.Duration
+	if request.Pause != "" {
+		var err error
+		pause, err = time.ParseDuration(request.Pause)
+		if err != nil || pause < 0 {
+			http.Error(w, "invalid pause "+request.Pause, http.StatusBadRequest)
 			return
 		}
 	}
 
-	// Provision the SaaS (do background work)
-	go func() {
-		password := generatePassword()
+	campaign, err := controller.createCampaign(context.Background(), newUpgradeCampaign(UpgradeCampaignSpec{
+		Release:           release.Name,
+		BatchSize:         request.BatchSize,
+		Pause:             metav1.Duration{Duration: pause},
+		MaxFailurePercent: request.MaxFailurePercent,
+	}))
+	if err != nil {
+		audit.Record(r, "campaign.create", "", audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, "campaign.create", "", audit.OutcomeAllowed)
 
-		// Create PVC
-		postgresPVC := getPersistentVolumeClaim()
+	campaignJson, err := json.Marshal(newCampaignResponse(campaign))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Create deployment objects
-		postgresDeploy := getPostgresDeploy()
-		backendDeploy := getBackendDeploy()
-		frontendDeploy := getFrontendDeploy()
+	w.Header().Set("Location", r.URL.Path+"/"+campaign.Name)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(campaignJson)
+}
 
-		// Create namespace
-		namespace, _ := namespaceClient.Create(context.Background(), &corev1.Namespace{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: config.Namespace,
-				Annotations: map[string]string{
-					"manager": "saas",
-				},
-			},
-		}, metav1.CreateOptions{})
+// Get the progress of a campaign
+func GetCampaign(w http.ResponseWriter, r *http.Request) {
+	campaign, exists, err := controller.campaignByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
 
-		// Update PVC
-		postgresPVC.Namespace = config.Namespace
+	campaignJson, err := json.Marshal(newCampaignResponse(campaign))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Create PVC
-		postgresPVC, err := clientset.CoreV1().PersistentVolumeClaims(config.Namespace).Create(context.Background(), postgresPVC, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create PVC in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create postgresql pvc")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created postgresql pvc")
-
-		// Update postgresql deployment
-		for i, container := range postgresDeploy.Spec.Template.Spec.Containers {
-			if container.Name == "postgresql" {
-				for j, env := range postgresDeploy.Spec.Template.Spec.Containers[i].Env {
-					if env.Name == "POSTGRES_PASSWORD" {
-						postgresDeploy.Spec.Template.Spec.Containers[i].Env[j].Value = password
-						break
-					}
-				}
-				break
-			}
-		}
+	_, _ = w.Write(campaignJson)
+}
 
-		// Create postgresql deployment
-		deploymentClient := clientset.AppsV1().Deployments(config.Namespace)
-		postgresDeploy, err = deploymentClient.Create(context.Background(), postgresDeploy, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create postgresql deployment in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create postgresql deployment")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created postgresql deployment")
+func newCampaignResponse(campaign *UpgradeCampaign) CampaignResponse {
+	response := CampaignResponse{
+		ID:                    campaign.Name,
+		UpgradeCampaignSpec:   campaign.Spec,
+		UpgradeCampaignStatus: campaign.Status,
+	}
+	if response.Phase == "" {
+		response.Phase = CampaignPending
+	}
+	return response
+}
 
-		// Wait on the postgresql deployment to become ready
-		err = waitOnDeployment(deploymentClient, postgresDeploy.Name)
-		if err != nil {
-			fmt.Printf("Postgresql deployment timeout - not ready in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Postgresql deployment not ready")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: postgresql deployment ready")
+// Retry provisioning a failed instance from the step which failed.  Objects created by earlier steps are reused, and
+// recreated if they have gone
+func RetrySaaS(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	instance, exists, err := controller.instanceForTenant(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists || !instance.AccessibleBy(auth.IdentityFrom(r.Context())) {
+		audit.Record(r, "saas.retry", name, audit.OutcomeDenied)
+		http.NotFound(w, r)
+		return
+	}
+	if instance.CurrentPhase() != PhaseFailed {
+		http.Error(w, "only failed instances can be retried", http.StatusConflict)
+		return
+	}
 
-		// Create postgresql service
-		serviceClient := clientset.CoreV1().Services(config.Namespace)
-		service := createService("postgresql", "postgresql", 5432)
-		service, err = serviceClient.Create(context.Background(), service, metav1.CreateOptions{})
+	if err := controller.retryInstance(r.Context(), instance); err != nil {
+		audit.Record(r, "saas.retry", name, audit.OutcomeError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			fmt.Printf("Failed to create postgresql service in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create postgresql service")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created postgresql service")
-
-		// Update backend deployment
-		for i, container := range backendDeploy.Spec.Template.Spec.Containers {
-			if container.Name == "backend" {
-				for j, env := range backendDeploy.Spec.Template.Spec.Containers[i].Env {
-					if env.Name == "SPRING_DATASOURCE_PASSWORD" {
-						backendDeploy.Spec.Template.Spec.Containers[i].Env[j].Value = password
-						break
-					}
-				}
-				break
-			}
-		}
+	audit.Record(r, "saas.retry", name, audit.OutcomeAllowed)
+	acceptOperation(w, r, newOperation(OperationSpec{Type: OperationRetry, Tenant: name}))
+}
 
-		// Create backend deployment
-		backendDeploy, err = deploymentClient.Create(context.Background(), backendDeploy, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create backend deployment in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend deployment")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created backend deployment")
+// Record an operation for a request the controller carries out in the background, and answer with where it can be
+// followed.  The request has already been carried out, so when the operation can not be recorded the request is still
+// accepted, pointing at the tenant rather than the operation, and the caller is not led to retry it
+func acceptOperation(w http.ResponseWriter, r *http.Request, operation *Operation) {
+	if identity := auth.IdentityFrom(r.Context()); identity != nil {
+		operation.Spec.Requester = identity.Subject()
+	}
+	operation.Spec.RequestID = middleware.GetReqID(r.Context())
 
-		// Wait on the backend deployment to become ready
-		err = waitOnDeployment(deploymentClient, backendDeploy.Name)
+	recorded, err := controller.createOperation(context.Background(), operation)
+	if err != nil {
+		logging.FromContext(r.Context()).WithField("tenant", operation.Spec.Tenant).WithError(err).
+			Warn("Failed to record the operation of an accepted request")
+		response := newOperationResponse(operation)
+		response.ID = ""
+		response.TenantPath = saasPath + operation.Spec.Tenant
+		operationJson, err := json.Marshal(response)
 		if err != nil {
-			fmt.Printf("Postgresql deployment timeout - not ready in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Backend deployment not ready")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: backend deployment ready")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(operationJson)
+		return
+	}
 
-		// Create backend service
-		service = createService("backend", "backend", 8080)
-		service, err = serviceClient.Create(context.Background(), service, metav1.CreateOptions{})
+	operationJson, err := json.Marshal(newOperationResponse(recorded))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			fmt.Printf("Failed to create backend service in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend service")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created backend service")
+	w.Header().Set("Location", operationsPath+recorded.Name)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(operationJson)
+}
 
-		// Create backend ingress (namespace-backend.tld)
-		ingressClient := clientset.NetworkingV1beta1().Ingresses(config.Namespace)
-		backendIngress := createIngress("backend", 8080, config.Namespace)
+// Get the state of an operation.  Other users' operations are reported as not found
+func GetOperation(w http.ResponseWriter, r *http.Request) {
+	operation, exists, err := controller.operationByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists || !operation.AccessibleBy(auth.IdentityFrom(r.Context())) {
+		http.NotFound(w, r)
+		return
+	}
 
-		backendIngress, err = ingressClient.Create(context.Background(), backendIngress, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create backend ingress in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend ingress")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created backend ingress")
-
-		// Update frontend deployment
-		for i, container := range frontendDeploy.Spec.Template.Spec.Containers {
-			if container.Name == "frontend" {
-				for j, env := range frontendDeploy.Spec.Template.Spec.Containers[i].Env {
-					if env.Name == "REACT_APP_API_URL" {
-						frontendDeploy.Spec.Template.Spec.Containers[i].Env[j].Value = "http://" + config.Namespace + "-backend" + tld
-						break
-					}
-				}
-				break
-			}
-		}
+	operationJson, err := json.Marshal(newOperationResponse(operation))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Create frontend deployment
-		frontendDeploy, err = deploymentClient.Create(context.Background(), frontendDeploy, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create frontend deployment in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create frontend deployment")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created frontend deployment")
+	_, _ = w.Write(operationJson)
+}
 
-		// Wait on the Frontend deployment to become ready
-		err = waitOnDeployment(deploymentClient, frontendDeploy.Name)
-		if err != nil {
-			fmt.Printf("Postgresql deployment timeout - not ready in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Frontend deployment not ready")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: frontend deployment ready")
+func newOperationResponse(operation *Operation) OperationResponse {
+	response := OperationResponse{
+		ID:              operation.Name,
+		OperationSpec:   operation.Spec,
+		OperationStatus: operation.Status,
+	}
+	if response.State == "" {
+		response.State = OperationPending
+	}
+	return response
+}
 
-		// Create Frontend service
-		service = createService("frontend", "frontend", 3000)
-		service, err = serviceClient.Create(context.Background(), service, metav1.CreateOptions{})
+// List the webhook deliveries which failed every attempt
+func GetWebhookDeadLetters(w http.ResponseWriter, _ *http.Request) {
+	deadLettersJson, err := json.Marshal(controller.webhooks.DeadLetters())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			fmt.Printf("Failed to create frontend service in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create frontend service")
-			return
-		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created frontend service")
+	_, _ = w.Write(deadLettersJson)
+}
 
-		// Create frontend ingress (namespace.tld)
-		frontendIngress := createIngress("frontend", 3000, config.Namespace)
+// List the releases tenants can be provisioned with
+func GetReleases(w http.ResponseWriter, _ *http.Request) {
+	catalogue := controller.current().Releases
+	releases := make([]ReleaseResponse, 0, len(catalogue.Releases))
+	for _, release := range catalogue.Releases {
+		releases = append(releases, ReleaseResponse{
+			Release: release,
+			Default: release.Name == catalogue.Default,
+		})
+	}
 
-		frontendIngress, err = ingressClient.Create(context.Background(), frontendIngress, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create frontend ingress in namespace %v.  Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create frontend ingress")
+	releasesJson, err := json.Marshal(releases)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write(releasesJson)
+}
+
+// Delete an instance of SaaS
+func DeleteSaaS(w http.ResponseWriter, r *http.Request) {
+	var ns NamespaceRequest
+
+	// Decode request
+	err := json.NewDecoder(r.Body).Decode(&ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Deleting the SaaSInstance deletes the namespace it owns
+	identity := auth.IdentityFrom(r.Context())
+	instance, exists, err := controller.instanceForTenant(ns.Namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		// Other users' instances are reported as not found
+		if !instance.AccessibleBy(identity) {
+			audit.Record(r, "saas.delete", ns.Namespace, audit.OutcomeDenied)
+			http.NotFound(w, r)
 			return
 		}
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Working: created frontend ingress")
 
-		// Create backend password
-		backendPassword := generatePassword()
-		backendCreds := BackendUser{
-			Username: "admin",
-			Password: backendPassword,
-		}
-		userJson, _ := json.Marshal(backendCreds)
-		userReader := bytes.NewReader(userJson)
-		resp, err := http.Post("http://"+config.Namespace+"-backend"+tld+"/register", "application/json", userReader)
+		err = controller.deleteInstance(r.Context(), instance.Name)
 		if err != nil {
-			fmt.Printf("Failed to create admin user for the backend in namespace %v. Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend admin user")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-			fmt.Printf("Failed to create admin user for the backend in namespace %v\n", config.Namespace)
-			fmt.Printf("Status code: %v", resp.StatusCode)
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend admin user")
-			return
-		}
+		audit.Record(r, "saas.delete", ns.Namespace, audit.OutcomeAllowed)
+		acceptOperation(w, r, newOperation(OperationSpec{Type: OperationDelete, Tenant: ns.Namespace}))
+		return
+	}
 
-		backendSecret := &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{Name: "backend-creds"},
-			StringData: map[string]string{"username": "admin", "password": backendPassword},
-		}
+	namespace, err := clientset.CoreV1().Namespaces().Get(context.Background(), ns.Namespace, metav1.GetOptions{})
+	if err != nil || namespace.Annotations["manager"] != "saas" {
+		http.NotFound(w, r)
+		return
+	}
 
-		// Create backend secret for admin user/pass
-		backendSecret, err = clientset.CoreV1().Secrets(config.Namespace).Create(context.Background(), backendSecret, metav1.CreateOptions{})
-		if err != nil {
-			fmt.Printf("Failed to create secret for the backend in namespace %v. Error was %v\n", config.Namespace, err.Error())
-			annotateNamespaceWithError(namespaceClient, namespace, "Failed to create backend secret")
-			return
-		}
+	// Namespaces without a SaaSInstance have no owner, so only admins can see them
+	if identity == nil || !identity.Role.Allows(auth.RoleAdmin) {
+		audit.Record(r, "saas.delete", ns.Namespace, audit.OutcomeDenied)
+		http.NotFound(w, r)
+		return
+	}
 
-		annotateNamespaceWithStatus(namespaceClient, namespace, "Completed")
+	err = clientset.CoreV1().Namespaces().Delete(context.Background(), ns.Namespace, metav1.DeleteOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	}()
+	audit.Record(r, "saas.delete", ns.Namespace, audit.OutcomeAllowed)
+	acceptOperation(w, r, newOperation(OperationSpec{Type: OperationDelete, Tenant: ns.Namespace}))
+}
 
-	// Respond
-	w.WriteHeader(http.StatusCreated)
+// Provisions an instance of Order-Meow UI, Backend, and a Database by creating a SaaSInstance for the controller to
+// reconcile
+func CreateSaaS(w http.ResponseWriter, r *http.Request) {
+
+	var config NamespaceRequest
+
+	// Decode request
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config.Namespace, err = validateNamespace(config.Namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Ensure there isn't a namespace already existing with this name
+	_, err = clientset.CoreV1().Namespaces().Get(context.Background(), config.Namespace, metav1.GetOptions{})
+	if err == nil {
+		http.Error(w, "namespace already exists", http.StatusConflict)
+		return
+	}
+
+	// The release is recorded on the instance, so a later change of the default release does not change the tenant
+	release, ok := controller.current().Releases.Find(config.Release)
+	if !ok {
+		http.Error(w, "unknown release "+config.Release, http.StatusBadRequest)
+		return
+	}
+
+	instance := newSaaSInstance(config.Namespace)
+	if identity := auth.IdentityFrom(r.Context()); identity != nil {
+		instance.Spec.Owner = identity.Subject()
+	}
+	instance.Spec.Release = release.Name
+	instance.Spec.Versions = config.Versions
+	instance.Spec.Sizes = config.Sizes
+
+	// Turn tenants away rather than queueing more than the provisioner can work through
+	switch err := controller.admit(instance); err {
+	case ErrOwnerQueueFull:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case ErrQueueFull:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case ErrAlreadyAdmitted:
+		http.Error(w, "namespace already exists", http.StatusConflict)
+		return
+	}
+
+	err = controller.createInstance(r.Context(), instance)
+	if err != nil {
+		controller.withdraw(instance)
+	}
+	if apierrors.IsAlreadyExists(err) {
+		http.Error(w, "namespace already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Nothing has been provisioned yet, the caller follows the operation until it has
+	acceptOperation(w, r, newOperation(OperationSpec{Type: OperationCreate, Tenant: config.Namespace}))
 }
 
 // Generate a database and backend password (8 characters in length)
@@ -412,38 +759,6 @@ func generatePassword() string {
 	return b.String()
 }
 
-// Update namespace with error annotations to be read later "error" annotation
-func annotateNamespaceWithStatus(namespaceClient corev1type.NamespaceInterface, namespace *corev1.Namespace, status string) {
-	annotationsPatch := []byte(fmt.Sprintf(`{"metadata":{"annotations": {"status": "%s", "manager": "saas" }}}`, status))
-
-	namespace, err := namespaceClient.Patch(context.Background(), namespace.Name, types.MergePatchType, annotationsPatch, metav1.PatchOptions{}, "")
-	if err != nil {
-		fmt.Printf("failed to patch namespace with status... error %v\n", err)
-	}
-}
-
-// Update namespace with error annotations to be read later "error" annotation
-func annotateNamespaceWithError(namespaceClient corev1type.NamespaceInterface, namespace *corev1.Namespace, errStr string) {
-	annotationsPatch := []byte(fmt.Sprintf(`{"metadata":{"annotations": {"status": "Failed", "manager": "saas", "error": "%s" }}}`, errStr))
-
-	namespace, err := namespaceClient.Patch(context.Background(), namespace.Name, types.MergePatchType, annotationsPatch, metav1.PatchOptions{}, "")
-	if err != nil {
-		fmt.Printf("failed to patch namespace with status... error %v\n", err)
-	}
-}
-
-// Wait for a deployment to become ready
-func waitOnDeployment(deploymentClient appsv1type.DeploymentInterface, deployName string) error {
-	for start := time.Now(); time.Since(start) < 180*time.Second; {
-		deploy, _ := deploymentClient.Get(context.Background(), deployName, metav1.GetOptions{})
-		if deploy.Status.ReadyReplicas >= 1 {
-			return nil
-		}
-	}
-
-	return errors.New("deployment was not ready in 120 seconds")
-}
-
 // Convert namespace string to valid k8s string
 func validateNamespace(namespace string) (string, error) {
 	reg, err := regexp.Compile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
@@ -0,0 +1,202 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"github.com/bennerv/provisioning-api/pkg/api/audit"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serve a request to one of the API handlers as the given caller, for the tenant named in the path when name is given
+func serveAs(handler http.HandlerFunc, identity *auth.Identity, method string, name string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/", bytes.NewBufferString(body))
+	routeContext := chi.NewRouteContext()
+	if name != "" {
+		routeContext.URLParams.Add("name", name)
+	}
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, routeContext)
+	r = r.WithContext(auth.WithIdentity(ctx, identity))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// Serve the API from a controller under test whose informer cache holds the instance, along with the fake clients
+func newTestAPI(t *testing.T, instance *SaaSInstance, objects ...runtime.Object) (*Controller, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	audit.SetOutput(ioutil.Discard)
+	obj, err := instanceToUnstructured(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cs, dc := newTestController(t, append(objects, obj.DeepCopy())...)
+	if err := c.instanceInformer.GetIndexer().Add(obj); err != nil {
+		t.Fatal(err)
+	}
+	Routes(cs, c)
+	return c, cs, dc
+}
+
+// The API answers requests for someone else's tenant as if the tenant did not exist, deletes included
+func TestDeleteSaaSHidesOtherTenants(t *testing.T) {
+	owned := newSaaSInstance("team-a")
+	owned.Spec.Owner = "apikey:alice"
+	unowned := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Annotations: map[string]string{"manager": "saas"}}}
+
+	alice := &auth.Identity{Name: "alice", Role: auth.RoleOperator, Method: "apikey"}
+	bob := &auth.Identity{Name: "bob", Role: auth.RoleOperator, Method: "apikey"}
+	admin := &auth.Identity{Name: "root", Role: auth.RoleAdmin, Method: "apikey"}
+
+	tests := []struct {
+		name     string
+		identity *auth.Identity
+		tenant   string
+		status   int
+	}{
+		{name: "owner", identity: alice, tenant: "team-a", status: http.StatusAccepted},
+		{name: "other user", identity: bob, tenant: "team-a", status: http.StatusNotFound},
+		{name: "unowned tenant", identity: bob, tenant: "team-b", status: http.StatusNotFound},
+		{name: "admin on an unowned tenant", identity: admin, tenant: "team-b", status: http.StatusAccepted},
+		{name: "missing tenant", identity: alice, tenant: "team-c", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, cs, dc := newTestAPI(t, owned, unowned.DeepCopy())
+
+			w := serveAs(DeleteSaaS, test.identity, http.MethodDelete, "", `{"namespace": "`+test.tenant+`"}`)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+
+			_, instanceErr := dc.Resource(saasInstanceGVR).Get(context.Background(), "team-a", metav1.GetOptions{})
+			_, namespaceErr := cs.CoreV1().Namespaces().Get(context.Background(), "team-b", metav1.GetOptions{})
+			deleted := apierrors.IsNotFound(instanceErr) || apierrors.IsNotFound(namespaceErr)
+			if deleted != (test.status == http.StatusAccepted) {
+				t.Errorf("expected the tenant to be deleted only when the request was accepted")
+			}
+		})
+	}
+}
+
+// Credentials are made while provisioning, and stay readable while the tenant is upgraded
+func TestGetSaaSCredentialsByPhase(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: backendSecretName, Namespace: "team-a"},
+		Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("password")},
+	}
+	alice := &auth.Identity{Name: "alice", Role: auth.RoleOperator, Method: "apikey"}
+
+	tests := []struct {
+		phase  Phase
+		status int
+	}{
+		{phase: PhasePending, status: http.StatusConflict},
+		{phase: PhaseProvisioning, status: http.StatusConflict},
+		{phase: PhaseReady, status: http.StatusOK},
+		{phase: PhaseUpgrading, status: http.StatusOK},
+		{phase: PhaseFailed, status: http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.phase), func(t *testing.T) {
+			instance := newSaaSInstance("team-a")
+			instance.Spec.Owner = "apikey:alice"
+			instance.Status.Phase = test.phase
+			newTestAPI(t, instance, secret.DeepCopy())
+
+			w := serveAs(GetSaaSCredentials, alice, http.MethodGet, "team-a", "")
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// Only failed tenants can be retried, and a retry gives them a fresh set of attempts straight away
+func TestRetrySaaS(t *testing.T) {
+	alice := &auth.Identity{Name: "alice", Role: auth.RoleOperator, Method: "apikey"}
+	bob := &auth.Identity{Name: "bob", Role: auth.RoleOperator, Method: "apikey"}
+
+	tests := []struct {
+		name     string
+		phase    Phase
+		identity *auth.Identity
+		status   int
+	}{
+		{name: "failed", phase: PhaseFailed, identity: alice, status: http.StatusAccepted},
+		{name: "provisioning", phase: PhaseProvisioning, identity: alice, status: http.StatusConflict},
+		{name: "ready", phase: PhaseReady, identity: alice, status: http.StatusConflict},
+		{name: "other user", phase: PhaseFailed, identity: bob, status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := metav1.NewTime(time.Now().Add(time.Hour))
+			instance := newSaaSInstance("team-a")
+			instance.Spec.Owner = "apikey:alice"
+			instance.Status = SaaSInstanceStatus{Phase: test.phase, Step: "backend-deployment", Attempts: 3, NextRetryTime: &next}
+			_, _, dc := newTestAPI(t, instance)
+
+			w := serveAs(RetrySaaS, test.identity, http.MethodPost, "team-a", "")
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+
+			stored := storedInstance(t, dc, "team-a")
+			if test.status != http.StatusAccepted {
+				if stored.Status.Phase != test.phase {
+					t.Errorf("expected the tenant to stay %s, got %s", test.phase, stored.Status.Phase)
+				}
+				return
+			}
+			if stored.Status.Phase != PhaseProvisioning || stored.Status.Attempts != 0 || stored.Status.NextRetryTime != nil {
+				t.Errorf("expected the tenant to be provisioned again with fresh attempts, got %s after %d attempts", stored.Status.Phase, stored.Status.Attempts)
+			}
+			if stored.Status.Step != "backend-deployment" {
+				t.Errorf("expected the retry to carry on after the last completed step, got %q", stored.Status.Step)
+			}
+		})
+	}
+}
+
+// A retried tenant carries on from the failed step, keeping what the steps before it made
+func TestRetriedTenantResumes(t *testing.T) {
+	registered := registerAdminUsers(t)
+	instance := newSaaSInstance("team-a")
+	instance.Spec.Owner = "apikey:alice"
+	instance.Status = SaaSInstanceStatus{Phase: PhaseFailed, Step: "backend-deployment", Attempts: 3}
+	c, cs, dc := newTestAPI(t, instance, provisionedObjects("team-a")...)
+	readyDeployments(cs)
+
+	alice := &auth.Identity{Name: "alice", Role: auth.RoleOperator, Method: "apikey"}
+	if w := serveAs(RetrySaaS, alice, http.MethodPost, "team-a", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the retry to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := c.reconcile("team-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseReady {
+		t.Fatalf("expected the retried tenant to be ready, got %s: %s", stored.Status.Phase, stored.Status.Error)
+	}
+	database, err := cs.CoreV1().Secrets("team-a").Get(context.Background(), databaseSecretName, metav1.GetOptions{})
+	if err != nil || string(database.Data["password"]) != "password" {
+		t.Errorf("expected the database credentials to be kept, got %v", err)
+	}
+	if len(registered.users) != 1 {
+		t.Errorf("expected the admin user to be registered once, got %d", len(registered.users))
+	}
+}
@@ -0,0 +1,221 @@
+package provisioner
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits on provisioning jobs
+type JobLimits struct {
+	// Number of tenants provisioned at once
+	Workers int
+	// Number of tenants allowed to wait for a worker, unlimited when zero
+	QueueSize int
+	// Number of tenants a single owner may have waiting, unlimited when zero
+	QueuedPerOwner int
+}
+
+var (
+	ErrQueueFull       = errors.New("provisioning queue is full")
+	ErrOwnerQueueFull  = errors.New("too many tenants waiting to be provisioned")
+	ErrAlreadyAdmitted = errors.New("tenant is already being created")
+)
+
+// Bounds the number of tenants being provisioned at once.  Tenants which can not start straight away wait in creation
+// order, so after a restart the queue is rebuilt in the same order as the controller reconciles every instance again.
+// Tenants admitted to the queue hold a reservation until the controller first reconciles them, so a burst of new
+// tenants can not all be admitted before any of them has joined the queue
+type provisionQueue struct {
+	mutex sync.Mutex
+	// Number of tenants provisioned at once
+	slots int
+	// Number of tenants allowed to wait
+	capacity int
+	running  map[string]bool
+	waiting  []queuedTenant
+	// Owners of the tenants admitted which have not reached the queue yet, by name
+	reserved map[string]string
+	// Called with the name of a waiting tenant when a slot frees up for it
+	wake func(name string)
+}
+
+type queuedTenant struct {
+	name    string
+	owner   string
+	created time.Time
+}
+
+func newProvisionQueue(slots int, capacity int, wake func(name string)) *provisionQueue {
+	if slots < 1 {
+		slots = 1
+	}
+	return &provisionQueue{
+		slots:    slots,
+		capacity: capacity,
+		running:  map[string]bool{},
+		reserved: map[string]string{},
+		wake:     wake,
+	}
+}
+
+// Take a slot for the instance, or queue it if every slot is taken or other tenants are waiting ahead of it
+func (q *provisionQueue) start(instance *SaaSInstance) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.running[instance.Name] {
+		return true
+	}
+	delete(q.reserved, instance.Name)
+
+	// Tenants at the front of the queue take the free slots before anyone joining the queue
+	free := q.slots - len(q.running)
+	position := q.positionLocked(instance.Name)
+	if (position > 0 && position <= free) || (position == 0 && len(q.waiting) < free) {
+		q.removeLocked(instance.Name)
+		q.running[instance.Name] = true
+		return true
+	}
+
+	if position == 0 {
+		q.waiting = append(q.waiting, queuedTenant{
+			name:    instance.Name,
+			owner:   instance.Spec.Owner,
+			created: instance.CreationTimestamp.Time,
+		})
+		sort.SliceStable(q.waiting, func(i, j int) bool {
+			return q.waiting[i].created.Before(q.waiting[j].created)
+		})
+	}
+	return false
+}
+
+// Change the number of tenants provisioned at once and allowed to wait.  Tenants already running keep their slots, and
+// tenants already waiting stay in the queue when it shrinks
+func (q *provisionQueue) resize(slots int, capacity int) {
+	if slots < 1 {
+		slots = 1
+	}
+	q.mutex.Lock()
+	q.slots = slots
+	q.capacity = capacity
+	q.mutex.Unlock()
+	q.wakeFree()
+}
+
+// Give up the slot of an instance, waking the tenants which can take the free slots
+func (q *provisionQueue) done(name string) {
+	q.mutex.Lock()
+	delete(q.running, name)
+	q.mutex.Unlock()
+	q.wakeFree()
+}
+
+// Take an instance which no longer needs provisioning out of the queue, such as one which has been deleted
+func (q *provisionQueue) forget(name string) {
+	q.mutex.Lock()
+	waiting := q.positionLocked(name) > 0
+	q.removeLocked(name)
+	delete(q.reserved, name)
+	q.mutex.Unlock()
+
+	if waiting {
+		q.wakeFree()
+	}
+}
+
+func (q *provisionQueue) wakeFree() {
+	q.mutex.Lock()
+	var next []string
+	for i := 0; i < len(q.waiting) && i < q.slots-len(q.running); i++ {
+		next = append(next, q.waiting[i].name)
+	}
+	q.mutex.Unlock()
+
+	for _, name := range next {
+		q.wake(name)
+	}
+}
+
+// Position of an instance in the queue starting from one, or zero if it is not waiting
+func (q *provisionQueue) position(name string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.positionLocked(name)
+}
+
+// Number of tenants being provisioned and waiting to be
+func (q *provisionQueue) depth() (running int, waiting int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.running), len(q.waiting)
+}
+
+// Reserve a place in the queue for a new tenant of an owner, allowing at most perOwner tenants of the owner to wait
+// when it is above zero.  The error is ErrQueueFull when every slot is taken and the queue is full, and
+// ErrOwnerQueueFull when the owner already has too many tenants waiting, or ErrAlreadyAdmitted when another request is
+// creating a tenant of the same name.  Tenants admitted but not reconciled yet count as waiting, the reservation is
+// given up by release if the tenant is not created after all
+func (q *provisionQueue) admit(name string, owner string, perOwner int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.reserved[name]; ok {
+		return ErrAlreadyAdmitted
+	}
+	free := q.slots - len(q.running)
+	if free < 0 {
+		free = 0
+	}
+	if q.capacity > 0 && len(q.waiting)+len(q.reserved) >= free+q.capacity {
+		return ErrQueueFull
+	}
+	if perOwner > 0 && q.queuedForLocked(owner) >= perOwner {
+		return ErrOwnerQueueFull
+	}
+	q.reserved[name] = owner
+	return nil
+}
+
+// Give up the reservation of a tenant which was admitted but not created
+func (q *provisionQueue) release(name string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.reserved, name)
+}
+
+// Number of tenants of an owner waiting in the queue or admitted to it
+func (q *provisionQueue) queuedForLocked(owner string) int {
+	count := 0
+	for _, queued := range q.waiting {
+		if queued.owner == owner {
+			count++
+		}
+	}
+	for _, reservedOwner := range q.reserved {
+		if reservedOwner == owner {
+			count++
+		}
+	}
+	return count
+}
+
+func (q *provisionQueue) positionLocked(name string) int {
+	for i, queued := range q.waiting {
+		if queued.name == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *provisionQueue) removeLocked(name string) {
+	for i, queued := range q.waiting {
+		if queued.name == name {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
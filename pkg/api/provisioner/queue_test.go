@@ -0,0 +1,212 @@
+package provisioner
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An instance of an owner created the given number of seconds after the first
+func queuedInstance(name string, owner string, created int) *SaaSInstance {
+	instance := newSaaSInstance(name)
+	instance.Spec.Owner = owner
+	instance.CreationTimestamp = metav1.NewTime(time.Unix(1600000000+int64(created), 0))
+	return instance
+}
+
+// A queue recording the tenants it wakes
+func newTestQueue(slots int, capacity int) (*provisionQueue, *[]string) {
+	var mutex sync.Mutex
+	woken := []string{}
+	q := newProvisionQueue(slots, capacity, func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		woken = append(woken, name)
+	})
+	return q, &woken
+}
+
+func TestAdmitConcurrently(t *testing.T) {
+	q, _ := newTestQueue(2, 3)
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- q.admit(fmt.Sprintf("tenant-%d", i), fmt.Sprintf("owner-%d", i), 0)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	// Two tenants can start straight away and three can wait
+	admitted := 0
+	for err := range results {
+		switch err {
+		case nil:
+			admitted++
+		case ErrQueueFull:
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if admitted != 5 {
+		t.Errorf("expected 5 tenants admitted, got %d", admitted)
+	}
+}
+
+func TestAdmitPerOwnerConcurrently(t *testing.T) {
+	q, _ := newTestQueue(1, 0)
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- q.admit(fmt.Sprintf("tenant-%d", i), "jwt:alice", 2)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	admitted := 0
+	for err := range results {
+		switch err {
+		case nil:
+			admitted++
+		case ErrOwnerQueueFull:
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if admitted != 2 {
+		t.Errorf("expected 2 tenants of the owner admitted, got %d", admitted)
+	}
+	if err := q.admit("other", "jwt:bob", 2); err != nil {
+		t.Errorf("expected a tenant of another owner to be admitted, got %v", err)
+	}
+}
+
+func TestAdmitReservations(t *testing.T) {
+	q, _ := newTestQueue(1, 1)
+
+	if err := q.admit("a", "jwt:alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.admit("a", "jwt:alice", 0); err != ErrAlreadyAdmitted {
+		t.Errorf("expected a second request for the same tenant to be refused, got %v", err)
+	}
+	if err := q.admit("b", "jwt:alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.admit("c", "jwt:alice", 0); err != ErrQueueFull {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+
+	// A tenant which could not be created gives its place back
+	q.release("b")
+	if err := q.admit("c", "jwt:alice", 0); err != nil {
+		t.Errorf("expected the released place to be taken, got %v", err)
+	}
+
+	// Reconciling the tenants turns their reservations into a slot and a place in the queue
+	if !q.start(queuedInstance("a", "jwt:alice", 0)) {
+		t.Error("expected the first tenant to start")
+	}
+	if q.start(queuedInstance("c", "jwt:alice", 1)) {
+		t.Error("expected the second tenant to wait")
+	}
+	if len(q.reserved) != 0 {
+		t.Errorf("expected no reservations left, got %v", q.reserved)
+	}
+	if err := q.admit("d", "jwt:alice", 0); err != ErrQueueFull {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+
+	// A deleted tenant gives up its reservation
+	q.done("a")
+	if err := q.admit("d", "jwt:alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	q.forget("d")
+	if _, ok := q.reserved["d"]; ok {
+		t.Error("expected the reservation of a forgotten tenant to be given up")
+	}
+}
+
+func TestStartAndPosition(t *testing.T) {
+	q, woken := newTestQueue(1, 0)
+
+	if !q.start(queuedInstance("first", "", 0)) {
+		t.Fatal("expected the first tenant to take the free slot")
+	}
+	if !q.start(queuedInstance("first", "", 0)) {
+		t.Error("expected a running tenant to keep its slot")
+	}
+	// Tenants wait in creation order, whatever order they are reconciled in
+	if q.start(queuedInstance("third", "", 3)) || q.start(queuedInstance("second", "", 2)) {
+		t.Fatal("expected the other tenants to wait")
+	}
+	if q.position("second") != 1 || q.position("third") != 2 || q.position("first") != 0 {
+		t.Errorf("unexpected positions %d, %d and %d", q.position("second"), q.position("third"), q.position("first"))
+	}
+	if running, waiting := q.depth(); running != 1 || waiting != 2 {
+		t.Errorf("expected 1 running and 2 waiting, got %d and %d", running, waiting)
+	}
+
+	// A tenant behind the front of the queue can not take a free slot
+	q.done("first")
+	if !reflect.DeepEqual(*woken, []string{"second"}) {
+		t.Errorf("expected the front of the queue to be woken, got %v", *woken)
+	}
+	if q.start(queuedInstance("third", "", 3)) {
+		t.Error("expected the tenant behind the front of the queue to keep waiting")
+	}
+	if !q.start(queuedInstance("second", "", 2)) {
+		t.Error("expected the front of the queue to take the free slot")
+	}
+	if q.position("third") != 1 {
+		t.Errorf("expected the last tenant to move up, got %d", q.position("third"))
+	}
+
+	// Forgetting a waiting tenant takes it out of the queue
+	q.forget("third")
+	if running, waiting := q.depth(); running != 1 || waiting != 0 {
+		t.Errorf("expected 1 running and none waiting, got %d and %d", running, waiting)
+	}
+}
+
+func TestResize(t *testing.T) {
+	q, woken := newTestQueue(1, 1)
+	q.start(queuedInstance("a", "", 0))
+	q.start(queuedInstance("b", "", 1))
+	q.start(queuedInstance("c", "", 2))
+	q.start(queuedInstance("d", "", 3))
+
+	// Tenants already waiting stay in the queue when it shrinks
+	q.resize(0, 1)
+	if q.slots != 1 || q.position("d") != 3 {
+		t.Errorf("expected at least one slot and the queue kept, got %d slots and position %d", q.slots, q.position("d"))
+	}
+	if err := q.admit("e", "", 0); err != ErrQueueFull {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+
+	// New slots wake the tenants at the front of the queue
+	q.resize(3, 1)
+	if !reflect.DeepEqual(*woken, []string{"b", "c"}) {
+		t.Errorf("expected the front of the queue to be woken, got %v", *woken)
+	}
+	if !q.start(queuedInstance("b", "", 1)) || !q.start(queuedInstance("c", "", 2)) {
+		t.Error("expected the woken tenants to start")
+	}
+	if q.start(queuedInstance("d", "", 3)) {
+		t.Error("expected the last tenant to wait for a slot")
+	}
+}
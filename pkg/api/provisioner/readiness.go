@@ -0,0 +1,223 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"strings"
+	"time"
+)
+
+// How long each component is given to become ready
+type ReadinessTimeouts struct {
+	Default time.Duration
+	// Timeouts of single components, such as "postgresql", replacing the default
+	Components map[string]time.Duration
+}
+
+// Timeout of a component
+func (r ReadinessTimeouts) For(component string) time.Duration {
+	if timeout, ok := r.Components[component]; ok && timeout > 0 {
+		return timeout
+	}
+	return r.Default
+}
+
+// Wait before a ready tenant whose deployments a repair found not ready yet is looked at again
+const repairRecheckInterval = 30 * time.Second
+
+// Errors of a deployment which was not ready within its readiness timeout, and of one whose rollout has passed its
+// progress deadline
+var (
+	errReadinessTimeout = errors.New("was not ready")
+	errProgressDeadline = errors.New("exceeded its progress deadline")
+)
+
+// A deployment which is not ready yet, found by a repair which checks deployments rather than waiting on them
+type notReadyError struct {
+	name string
+}
+
+func (e *notReadyError) Error() string {
+	return e.name + " deployment is not ready yet"
+}
+
+// Container waiting reasons which mean a pod will not become ready by itself
+var podProblemReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Wait until a deployment has rolled out its latest generation and every desired replica runs it and is available.
+// The deployment is watched rather than polled.  When it is not ready in time the error holds the reasons its pods
+// are not ready, such as an image which can not be pulled or a claim which can not be bound
+func (t *tenant) waitOnDeployment(name string) error {
+	if t.checkOnly {
+		return t.checkDeployment(name)
+	}
+	t.beat()
+	timeout := t.readiness.For(name)
+	ctx, cancel := context.WithTimeout(t.context(), timeout)
+	defer cancel()
+
+	deployments := t.clientset.AppsV1().Deployments(t.name)
+	nameSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = nameSelector
+			return deployments.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = nameSelector
+			return deployments.Watch(ctx, options)
+		},
+	}
+
+	var deploy *appsv1.Deployment
+	_, err := watchtools.UntilWithSync(ctx, listWatch, &appsv1.Deployment{}, nil, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("%s deployment was deleted", name)
+		case watch.Added, watch.Modified:
+			deploy = event.Object.(*appsv1.Deployment)
+			return deploymentReady(deploy)
+		}
+		return false, nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	// The provisioner is shutting down
+	if t.context().Err() != nil {
+		return t.context().Err()
+	}
+	if errors.Is(err, wait.ErrWaitTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		if deploy == nil {
+			return fmt.Errorf("%s deployment was not ready in %v: deployment not found", name, timeout)
+		}
+		return t.withPodProblems(fmt.Errorf("%s deployment %w in %v", name, errReadinessTimeout, timeout), deploy)
+	}
+	if errors.Is(err, errProgressDeadline) {
+		return t.withPodProblems(err, deploy)
+	}
+	return err
+}
+
+// Check a deployment once without waiting for it, so repairing a ready tenant never holds a worker for the readiness
+// timeout.  A deployment which is still rolling out is a notReadyError
+func (t *tenant) checkDeployment(name string) error {
+	deploy, err := t.clientset.AppsV1().Deployments(t.name).Get(t.callContext(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	ready, err := deploymentReady(deploy)
+	if err != nil {
+		return t.withPodProblems(err, deploy)
+	}
+	if !ready {
+		return &notReadyError{name: name}
+	}
+	return nil
+}
+
+// An error about a deployment along with the reasons its pods are not ready
+type podProblemsError struct {
+	err      error
+	problems []string
+	// Waiting reasons of the containers, such as ImagePullBackOff
+	waiting map[string]bool
+}
+
+func (e *podProblemsError) Error() string {
+	return e.err.Error() + ": " + strings.Join(e.problems, "; ")
+}
+
+func (e *podProblemsError) Unwrap() error {
+	return e.err
+}
+
+// Whether any container is waiting for one of the reasons
+func (e *podProblemsError) has(reasons ...string) bool {
+	for _, reason := range reasons {
+		if e.waiting[reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the reasons the pods of a deployment are not ready to an error about the deployment
+func (t *tenant) withPodProblems(err error, deploy *appsv1.Deployment) error {
+	problems, waiting := t.podProblems(deploy)
+	if len(problems) == 0 {
+		return err
+	}
+	return &podProblemsError{err: err, problems: problems, waiting: waiting}
+}
+
+// Whether the latest generation of a deployment has rolled out and every desired replica is available.  A rollout
+// which has passed its progress deadline is an error
+func deploymentReady(deploy *appsv1.Deployment) (bool, error) {
+	if deploy.Generation > deploy.Status.ObservedGeneration {
+		return false, nil
+	}
+	for _, condition := range deploy.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("%s deployment %w: %s", deploy.Name, errProgressDeadline, condition.Message)
+		}
+	}
+
+	desired := int32(1)
+	if deploy.Spec.Replicas != nil {
+		desired = *deploy.Spec.Replicas
+	}
+	return deploy.Status.UpdatedReplicas == desired &&
+		deploy.Status.Replicas == desired &&
+		deploy.Status.ReadyReplicas >= desired &&
+		deploy.Status.AvailableReplicas >= desired, nil
+}
+
+// Reasons the pods of a deployment are not ready, and the waiting reasons of their containers
+func (t *tenant) podProblems(deploy *appsv1.Deployment) ([]string, map[string]bool) {
+	selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		return nil, nil
+	}
+	pods, err := t.clientset.CoreV1().Pods(t.name).List(t.callContext(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, nil
+	}
+
+	var problems []string
+	waitingReasons := map[string]bool{}
+	for _, pod := range pods.Items {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+				problems = append(problems, fmt.Sprintf("pod %s is %s: %s", pod.Name, pod.Status.Phase, condition.Message))
+			}
+		}
+
+		statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil && podProblemReasons[waiting.Reason] {
+				waitingReasons[waiting.Reason] = true
+				problems = append(problems, strings.TrimSpace(fmt.Sprintf("container %s of pod %s is waiting: %s %s", status.Name, pod.Name, waiting.Reason, waiting.Message)))
+			}
+		}
+	}
+	return problems, waitingReasons
+}
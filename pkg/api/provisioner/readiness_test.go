@@ -0,0 +1,148 @@
+package provisioner
+
+import (
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeploymentReady(t *testing.T) {
+	rolledOut := appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2, AvailableReplicas: 2}
+
+	tests := []struct {
+		name     string
+		replicas *int32
+		status   appsv1.DeploymentStatus
+		ready    bool
+		err      error
+	}{
+		{name: "rolled out", replicas: pointer.Int32Ptr(2), status: rolledOut, ready: true},
+		{name: "one replica by default", status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1, AvailableReplicas: 1}, ready: true},
+		{name: "generation not observed", replicas: pointer.Int32Ptr(2), status: appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2, AvailableReplicas: 2}},
+		{name: "old replicas left", replicas: pointer.Int32Ptr(2), status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, ReadyReplicas: 3, AvailableReplicas: 3}},
+		{name: "not available", replicas: pointer.Int32Ptr(2), status: appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2, AvailableReplicas: 1}},
+		{name: "past its progress deadline", replicas: pointer.Int32Ptr(2), status: appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			Conditions: []appsv1.DeploymentCondition{{
+				Type:    appsv1.DeploymentProgressing,
+				Status:  corev1.ConditionFalse,
+				Reason:  "ProgressDeadlineExceeded",
+				Message: `ReplicaSet "backend-5d4f8" has timed out progressing.`,
+			}},
+		}, err: errProgressDeadline},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "backend", Generation: 2},
+				Spec:       appsv1.DeploymentSpec{Replicas: test.replicas},
+				Status:     test.status,
+			}
+			ready, err := deploymentReady(deploy)
+			if ready != test.ready || !errors.Is(err, test.err) {
+				t.Errorf("expected %t, %v, got %t, %v", test.ready, test.err, ready, err)
+			}
+		})
+	}
+}
+
+// Pods which will not become ready by themselves are named along with why, pods which are only slow are not
+func TestPodProblems(t *testing.T) {
+	pod := func(name string, status corev1.PodStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a", Labels: map[string]string{"app": "backend"}},
+			Status:     status,
+		}
+	}
+	waiting := func(reason string, message string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{Name: "backend", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message}}}
+	}
+
+	tn, _, _ := newTestTenant(t, newSaaSInstance("team-a"),
+		pod("backend-pull", corev1.PodStatus{Phase: corev1.PodPending, ContainerStatuses: []corev1.ContainerStatus{waiting("ImagePullBackOff", `Back-off pulling image "backend:9.9"`)}}),
+		pod("backend-crash", corev1.PodStatus{Phase: corev1.PodRunning, InitContainerStatuses: []corev1.ContainerStatus{waiting("CrashLoopBackOff", "")}}),
+		pod("backend-unscheduled", corev1.PodStatus{Phase: corev1.PodPending, Conditions: []corev1.PodCondition{{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Message: "0/3 nodes are available: 3 pod has unbound immediate PersistentVolumeClaims.",
+		}}}),
+		pod("backend-starting", corev1.PodStatus{Phase: corev1.PodPending, ContainerStatuses: []corev1.ContainerStatus{waiting("ContainerCreating", "")}}),
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "frontend-pull", Namespace: "team-a", Labels: map[string]string{"app": "frontend"}},
+			Status:     corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{waiting("ErrImagePull", "")}},
+		},
+	)
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "team-a"},
+		Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}}},
+	}
+
+	problems, reasons := tn.podProblems(deploy)
+	joined := strings.Join(problems, "\n")
+	for _, expected := range []string{
+		`container backend of pod backend-pull is waiting: ImagePullBackOff Back-off pulling image "backend:9.9"`,
+		"container backend of pod backend-crash is waiting: CrashLoopBackOff",
+		"pod backend-unscheduled is Pending: 0/3 nodes are available",
+	} {
+		if !strings.Contains(joined, expected) {
+			t.Errorf("expected the problems to hold %q, got\n%s", expected, joined)
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("expected 3 problems, got\n%s", joined)
+	}
+	if !reasons["ImagePullBackOff"] || !reasons["CrashLoopBackOff"] || len(reasons) != 2 {
+		t.Errorf("expected the waiting reasons of the backend pods, got %v", reasons)
+	}
+
+	err := tn.withPodProblems(errReadinessTimeout, deploy)
+	var problemsErr *podProblemsError
+	if !errors.As(err, &problemsErr) || !errors.Is(err, errReadinessTimeout) || !problemsErr.has("ErrImagePull", "ImagePullBackOff") {
+		t.Errorf("expected the timeout along with the pod problems, got %v", err)
+	}
+}
+
+// Repairs check deployments without waiting on them, a deployment still rolling out is looked at again later
+func TestCheckDeployment(t *testing.T) {
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "team-a", Generation: 2},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1},
+	}
+	tn, _, _ := newTestTenant(t, newSaaSInstance("team-a"), deploy)
+	tn.checkOnly = true
+
+	err := tn.waitOnDeployment("backend")
+	var notReady *notReadyError
+	if !errors.As(err, &notReady) {
+		t.Errorf("expected the deployment to be reported not ready, got %v", err)
+	}
+}
+
+// A deployment which is not ready in time fails with the reasons its pods are not ready
+func TestWaitOnDeploymentTimesOut(t *testing.T) {
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "team-a", Generation: 1},
+		Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}}},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend-pull", Namespace: "team-a", Labels: map[string]string{"app": "backend"}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "backend",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+		}}},
+	}
+	tn, _, _ := newTestTenant(t, newSaaSInstance("team-a"), deploy, pod)
+	tn.readiness = ReadinessTimeouts{Default: time.Hour, Components: map[string]time.Duration{"backend": 50 * time.Millisecond}}
+
+	err := tn.waitOnDeployment("backend")
+	if !errors.Is(err, errReadinessTimeout) || !strings.Contains(err.Error(), "ImagePullBackOff") {
+		t.Errorf("expected the deployment to time out with its pod problems, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package provisioner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// A named set of component images tenants can be provisioned with
+type Release struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Images      ComponentImages `json:"images"`
+}
+
+// Images of each component.  Empty images use the image in the blueprint
+type ComponentImages struct {
+	PostgreSQL string `json:"postgresql,omitempty"`
+	Backend    string `json:"backend,omitempty"`
+	Frontend   string `json:"frontend,omitempty"`
+}
+
+// The releases tenants can choose from.  Tenants which do not choose a release get the default release
+type ReleaseCatalogue struct {
+	Default  string    `json:"default,omitempty"`
+	Releases []Release `json:"releases"`
+}
+
+// The built in catalogue, holding the release the built in blueprint was written for.  Its images are set in the
+// configuration, and default to Order Meow API 0.1.0 and UI 0.1.2
+const defaultReleases = `
+default: "0.1"
+releases:
+  - name: "0.1"
+    description: Order Meow API and UI
+`
+
+// Load the release catalogue from a YAML or JSON file.  An empty path loads the built in catalogue, whose release runs
+// the given images
+func LoadReleases(path string, images ComponentImages) (*ReleaseCatalogue, error) {
+	data := []byte(defaultReleases)
+	if path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	catalogue := &ReleaseCatalogue{}
+	if err := yaml.Unmarshal(data, catalogue); err != nil {
+		return nil, fmt.Errorf("failed to parse releases file %s: %w", path, err)
+	}
+	if path == "" {
+		catalogue.Releases[0].Images = images
+	}
+	return catalogue, catalogue.validate()
+}
+
+func (c *ReleaseCatalogue) validate() error {
+	if len(c.Releases) == 0 {
+		return fmt.Errorf("release catalogue has no releases")
+	}
+
+	seen := map[string]bool{}
+	for i, release := range c.Releases {
+		if release.Name == "" {
+			return fmt.Errorf("release %d needs a name", i)
+		}
+		if errs := validation.IsValidLabelValue(release.Name); len(errs) > 0 {
+			return fmt.Errorf("release %d has an invalid name %q: %s", i, release.Name, strings.Join(errs, ", "))
+		}
+		if seen[release.Name] {
+			return fmt.Errorf("release %s is defined more than once", release.Name)
+		}
+		seen[release.Name] = true
+	}
+
+	// The first release is the default unless another is named
+	if c.Default == "" {
+		c.Default = c.Releases[0].Name
+	}
+	if !seen[c.Default] {
+		return fmt.Errorf("default release %s is not in the catalogue", c.Default)
+	}
+	return nil
+}
+
+// Find a release by name.  An empty name finds the default release
+func (c *ReleaseCatalogue) Find(name string) (*Release, bool) {
+	if name == "" {
+		name = c.Default
+	}
+	for i := range c.Releases {
+		if c.Releases[i].Name == name {
+			return &c.Releases[i], true
+		}
+	}
+	return nil, false
+}
+
+// Image of the named component, or an empty string to keep the image in the blueprint
+func (i ComponentImages) image(component string) string {
+	switch component {
+	case "postgresql":
+		return i.PostgreSQL
+	case "backend":
+		return i.Backend
+	case "frontend":
+		return i.Frontend
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+package provisioner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bennerv/provisioning-api/pkg/api/auth"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Group, version and resource of the SaaSInstance custom resource (deploy/00-saasinstance-crd.yaml)
+var saasInstanceGVR = schema.GroupVersionResource{
+	Group:    "saas.bennerv.com",
+	Version:  "v1alpha1",
+	Resource: "saasinstances",
+}
+
+const saasInstanceKind = "SaaSInstance"
+
+// Label and annotation recording the owner of a tenant on its namespace.  Owner names are not always valid label
+// values, so the label holds a hash of the name when it is not and the annotation holds the name itself
+const (
+	ownerLabel      = "saas.bennerv.com/owner"
+	ownerAnnotation = "saas.bennerv.com/owner"
+)
+
+// Annotation holding the id of the last API request which asked for work on an instance, carried by the controller's
+// logs about the instance
+const requestIDAnnotation = "saas.bennerv.com/request-id"
+
+// Annotation holding the W3C traceparent of the span of that request, which the traces of the work done for the
+// request link back to
+const traceParentAnnotation = "saas.bennerv.com/traceparent"
+
+// Annotation holding the image tag overrides an instance had before an upgrade request dropped them, as JSON of a
+// previousVersions.  The upgrade records them so a rolled back tenant gets its overrides back
+const previousVersionsAnnotation = "saas.bennerv.com/previous-versions"
+
+// Annotation holding the id of the operation which asked for the upgrade of an instance, recorded with the upgrade so
+// the operation follows its own upgrade
+const operationAnnotation = "saas.bennerv.com/operation"
+
+// Finalizer holding a SaaSInstance until its namespace has been deleted
+const namespaceFinalizer = "saas.bennerv.com/namespace"
+
+// Phase of a SaaSInstance
+type Phase string
+
+const (
+	PhasePending      Phase = "Pending"
+	PhaseProvisioning Phase = "Provisioning"
+	PhaseReady        Phase = "Ready"
+	PhaseUpgrading    Phase = "Upgrading"
+	PhaseFailed       Phase = "Failed"
+	PhaseDeleting     Phase = "Deleting"
+)
+
+// Condition types.  Every component has a condition which is true once it has been provisioned, the Ready condition
+// is true once the whole tenant is
+const (
+	ConditionReady      = "Ready"
+	ConditionPostgreSQL = "PostgreSQL"
+	ConditionBackend    = "Backend"
+	ConditionFrontend   = "Frontend"
+	ConditionIngress    = "Ingress"
+	ConditionAdminUser  = "AdminUser"
+)
+
+// Condition statuses
+const (
+	ConditionTrue  = "True"
+	ConditionFalse = "False"
+)
+
+// A SaaSInstance is the desired state of a single tenant.  It is cluster scoped and named after the tenant namespace
+type SaaSInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SaaSInstanceSpec   `json:"spec,omitempty"`
+	Status SaaSInstanceStatus `json:"status,omitempty"`
+}
+
+type SaaSInstanceSpec struct {
+	// Name of the tenant namespace, defaults to the name of the SaaSInstance
+	TenantName string `json:"tenantName,omitempty"`
+	// Subject of the authenticated caller which created the instance, its name qualified by how it was authenticated
+	// such as jwt:alice.  Instances without an owner are only visible to admins
+	Owner string `json:"owner,omitempty"`
+	// Release from the release catalogue the tenant runs, empty for the default release
+	Release  string           `json:"release,omitempty"`
+	Versions ComponentVersion `json:"versions,omitempty"`
+	Sizes    ComponentSize    `json:"sizes,omitempty"`
+}
+
+// Image tags of each component, replacing the tag of the release image.  Empty tags use the release image
+type ComponentVersion struct {
+	PostgreSQL string `json:"postgresql,omitempty"`
+	Backend    string `json:"backend,omitempty"`
+	Frontend   string `json:"frontend,omitempty"`
+}
+
+// Resource quantities of each component.  Empty quantities use the default size
+type ComponentSize struct {
+	Storage string `json:"storage,omitempty"`
+}
+
+type SaaSInstanceStatus struct {
+	Phase Phase `json:"phase,omitempty"`
+	// Last completed provisioning step
+	Step string `json:"step,omitempty"`
+	// Provisioning step currently running, empty when no step is running
+	CurrentStep string       `json:"currentStep,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Conditions  []Condition  `json:"conditions,omitempty"`
+	URLs        InstanceURLs `json:"urls,omitempty"`
+	// Release the tenant runs, set once it has been provisioned and changed by upgrades
+	Release string `json:"release,omitempty"`
+	// Provisioning attempts which have failed, and when the tenant is next retried
+	Attempts      int          `json:"attempts,omitempty"`
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// Most recent upgrades, oldest first
+	Upgrades []Upgrade `json:"upgrades,omitempty"`
+}
+
+// Results of an upgrade
+const (
+	UpgradeSucceeded  = "Succeeded"
+	UpgradeRolledBack = "RolledBack"
+	UpgradeFailed     = "Failed"
+)
+
+// An upgrade of a tenant from one release to another
+type Upgrade struct {
+	From           string       `json:"from,omitempty"`
+	To             string       `json:"to"`
+	StartTime      metav1.Time  `json:"startTime"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Id of the operation which asked for the upgrade, empty for upgrades started by a campaign
+	Operation string `json:"operation,omitempty"`
+	// Empty while the upgrade is running
+	Result  string `json:"result,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Image tag overrides the tenant had before the upgrade, restored when it is rolled back
+	FromVersions ComponentVersion `json:"fromVersions,omitempty"`
+	// Components whose deployment the upgrade changed, recorded before each deployment is patched so an upgrade
+	// resumed after a restart can still roll them back
+	Components []ComponentUpgrade `json:"components,omitempty"`
+}
+
+type ComponentUpgrade struct {
+	Component string `json:"component"`
+	FromImage string `json:"fromImage"`
+	ToImage   string `json:"toImage"`
+	// Revision of the deployment before it was patched
+	Revision string `json:"revision,omitempty"`
+}
+
+// Condition of a SaaSInstance, following the usual Kubernetes condition conventions
+type Condition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	LastUpdateTime     metav1.Time `json:"lastUpdateTime,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+type InstanceURLs struct {
+	Frontend string `json:"frontend,omitempty"`
+	Backend  string `json:"backend,omitempty"`
+}
+
+// Name of the namespace the instance is provisioned into
+func (s *SaaSInstance) TenantName() string {
+	if s.Spec.TenantName != "" {
+		return s.Spec.TenantName
+	}
+	return s.Name
+}
+
+// Set a condition, keeping the transition time if the condition status has not changed
+func (s *SaaSInstanceStatus) SetCondition(condition Condition) {
+	condition.LastUpdateTime = metav1.Now()
+	condition.LastTransitionTime = condition.LastUpdateTime
+	for i, existing := range s.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		s.Conditions[i] = condition
+		return
+	}
+	s.Conditions = append(s.Conditions, condition)
+}
+
+// Find a condition by type
+func (s *SaaSInstanceStatus) GetCondition(conditionType string) *Condition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Phase of the instance as reported to users, an instance being deleted is Deleting whatever its recorded phase
+func (s *SaaSInstance) CurrentPhase() Phase {
+	if s.DeletionTimestamp != nil {
+		return PhaseDeleting
+	}
+	if s.Status.Phase == "" {
+		return PhasePending
+	}
+	return s.Status.Phase
+}
+
+// Whether the caller with the given identity may see and change the instance
+func (s *SaaSInstance) AccessibleBy(identity *auth.Identity) bool {
+	if identity == nil {
+		return false
+	}
+	return identity.Role.Allows(auth.RoleAdmin) || (s.Spec.Owner != "" && s.Spec.Owner == identity.Subject())
+}
+
+// Value of the owner label for an owner name
+func ownerLabelValue(owner string) string {
+	if len(validation.IsValidLabelValue(owner)) == 0 {
+		return owner
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return "sha256-" + hex.EncodeToString(sum[:])[:48]
+}
+
+func newSaaSInstance(name string) *SaaSInstance {
+	return &SaaSInstance{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: saasInstanceGVR.GroupVersion().String(),
+			Kind:       saasInstanceKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Finalizers: []string{namespaceFinalizer},
+		},
+		Spec: SaaSInstanceSpec{TenantName: name},
+	}
+}
+
+func instanceFromUnstructured(obj interface{}) (*SaaSInstance, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errNotUnstructured
+	}
+
+	instance := &SaaSInstance{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, instance)
+	return instance, err
+}
+
+func instanceToUnstructured(instance *SaaSInstance) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(instance)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/blueprint"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Settings of the controller which can change while it runs, when the configuration is reloaded.  They are replaced
+// as a whole, and each provisioning run or request works with the settings it started with, so nothing ever sees a
+// mix of old and new settings
+type Settings struct {
+	Blueprint *blueprint.Blueprint
+	Tenants   TenantSettings
+	Releases  *ReleaseCatalogue
+	Retry     RetryPolicy
+	Readiness ReadinessTimeouts
+	Jobs      JobLimits
+}
+
+// Settings in use
+func (c *Controller) current() *Settings {
+	return c.settings.Load().(*Settings)
+}
+
+// Replace the settings of the running controller.  The release catalogue must still hold every release tenants run
+// or were asked to run, otherwise the settings are rejected and the controller keeps its settings.  Tenants already
+// being provisioned finish with the settings they started with, and existing tenants pick up a new blueprint or
+// domain when they are next reconciled
+func (c *Controller) Reconfigure(settings Settings) error {
+	if atomic.LoadInt32(&c.synced) == 0 {
+		return errors.New("settings can not be checked against the tenants before the informer caches have synced")
+	}
+	if missing := c.releasesInUse(settings.Releases); len(missing) > 0 {
+		return fmt.Errorf("release catalogue is missing releases tenants use: %s", strings.Join(missing, ", "))
+	}
+
+	c.settings.Store(&settings)
+	c.provisioning.resize(settings.Jobs.Workers, settings.Jobs.QueueSize)
+	return nil
+}
+
+// Releases of tenants and campaigns which are not in the catalogue
+func (c *Controller) releasesInUse(catalogue *ReleaseCatalogue) []string {
+	missing := map[string]bool{}
+	check := func(name string) {
+		if _, ok := catalogue.Find(name); name != "" && !ok {
+			missing[name] = true
+		}
+	}
+	for _, obj := range c.instanceInformer.GetIndexer().List() {
+		if instance, err := instanceFromUnstructured(obj); err == nil {
+			check(instance.Spec.Release)
+			check(instance.Status.Release)
+		}
+	}
+	for _, obj := range c.campaignInformer.GetIndexer().List() {
+		if campaign, err := campaignFromUnstructured(obj); err == nil && !campaign.Finished() {
+			check(campaign.Spec.Release)
+		}
+	}
+
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
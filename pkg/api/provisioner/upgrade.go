@@ -0,0 +1,364 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// Annotation the deployment controller records the revision of a deployment and its replica sets in
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// Number of upgrades kept in the history of an instance
+const upgradeHistoryLimit = 10
+
+// Image tag overrides an instance had before an upgrade request to a release dropped them
+type previousVersions struct {
+	Release  string           `json:"release"`
+	Versions ComponentVersion `json:"versions"`
+}
+
+// Components upgraded to a new release, in the order they are rolled out
+var upgradeComponents = []string{"postgresql", "backend", "frontend"}
+
+// Whether the tenant is running a different release than the one asked for, or was part way through an upgrade
+func (t *tenant) upgradePending() bool {
+	if t.instance.Status.Phase == PhaseUpgrading {
+		return true
+	}
+	return t.instance.Spec.Release != "" && t.instance.Spec.Release != t.instance.Status.Release
+}
+
+// Roll every component out to the images of the release in the spec, one deployment at a time.  If a rollout fails
+// the components already upgraded are rolled back to the replica set they ran before, and the spec goes back to the
+// release the tenant was running
+func (t *tenant) upgrade() error {
+	upgrade := t.recordUpgradeStarted()
+	if upgrade == nil {
+		return errors.New("failed to record upgrade")
+	}
+
+	release, ok := t.releases.Find(upgrade.To)
+	if !ok {
+		t.recordUpgradeFailed(fmt.Errorf("unknown release %s", upgrade.To), nil)
+		return t.requestRelease(upgrade.From, upgrade.FromVersions)
+	}
+
+	for _, component := range upgradeComponents {
+		if err := t.rollOut(component, release); err != nil {
+			t.log.WithFields(logrus.Fields{logging.FieldStep: "upgrade " + component, "release": upgrade.To}).WithError(err).Error("Upgrade failed")
+			rollbackErr := t.rollBack()
+			t.recordUpgradeFailed(err, rollbackErr)
+			if rollbackErr != nil {
+				return nil
+			}
+			return t.requestRelease(upgrade.From, upgrade.FromVersions)
+		}
+	}
+
+	t.recordUpgraded()
+	return nil
+}
+
+// Patch the deployment of a component to the image of the release and wait for it to roll out.  Components already
+// patched by the running upgrade are only waited on
+func (t *tenant) rollOut(component string, release *Release) error {
+	deployments := t.clientset.AppsV1().Deployments(t.name)
+	deploy, err := deployments.Get(t.callContext(), component, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	container := findContainer(deploy.Spec.Template.Spec.Containers, component)
+	if container == nil {
+		return fmt.Errorf("deployment %s has no %s container", component, component)
+	}
+
+	image, err := t.releaseImage(component, release)
+	if err != nil {
+		return err
+	}
+	if container.Image == image {
+		if t.runningUpgrade().component(component) == nil {
+			// Nothing changes for this component
+			return nil
+		}
+		return t.waitOnDeployment(component)
+	}
+
+	// The revision is recorded before patching so the component can be rolled back even if the provisioner restarts
+	err = t.recordComponentUpgrade(ComponentUpgrade{
+		Component: component,
+		FromImage: container.Image,
+		ToImage:   image,
+		Revision:  deploy.Annotations[revisionAnnotation],
+	})
+	if err != nil {
+		return err
+	}
+
+	// Components the blueprint recreates, such as postgresql, never run the old and new image side by side
+	desired := &appsv1.Deployment{}
+	if err := t.decode("Deployment", component, desired); err != nil {
+		return err
+	}
+	if err := t.recreateStrategy(deploy, desired); err != nil {
+		return fmt.Errorf("failed to patch %s deployment: %w", component, err)
+	}
+
+	imagePatch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []map[string]string{{"name": component, "image": image}},
+				},
+			},
+		},
+	})
+	_, err = deployments.Patch(t.callContext(), component, types.StrategicMergePatchType, imagePatch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch %s deployment: %w", component, err)
+	}
+
+	return t.waitOnDeployment(component)
+}
+
+// Roll back every component patched by the running upgrade, most recently patched first
+func (t *tenant) rollBack() error {
+	components := t.runningUpgrade().Components
+	for i := len(components) - 1; i >= 0; i-- {
+		if err := t.rollBackComponent(components[i]); err != nil {
+			return fmt.Errorf("failed to roll back %s: %w", components[i].Component, err)
+		}
+	}
+	return nil
+}
+
+// Return the deployment of a component to the pod template of the replica set it ran before the upgrade.  If that
+// replica set has gone the previous image is restored instead
+func (t *tenant) rollBackComponent(upgraded ComponentUpgrade) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deploy, err := t.clientset.AppsV1().Deployments(t.name).Get(t.callContext(), upgraded.Component, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		template, err := t.replicaSetTemplate(deploy, upgraded.Revision)
+		if err != nil {
+			return err
+		}
+		if template != nil {
+			deploy.Spec.Template = *template
+		} else if container := findContainer(deploy.Spec.Template.Spec.Containers, upgraded.Component); container != nil {
+			container.Image = upgraded.FromImage
+		}
+
+		_, err = t.clientset.AppsV1().Deployments(t.name).Update(t.callContext(), deploy, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.waitOnDeployment(upgraded.Component)
+}
+
+// Pod template of the replica set of a deployment with the given revision, or nil if there is no such replica set
+func (t *tenant) replicaSetTemplate(deploy *appsv1.Deployment, revision string) (*corev1.PodTemplateSpec, error) {
+	if revision == "" {
+		return nil, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	replicaSets, err := t.clientset.AppsV1().ReplicaSets(t.name).List(t.callContext(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range replicaSets.Items {
+		replicaSet := &replicaSets.Items[i]
+		if !metav1.IsControlledBy(replicaSet, deploy) || replicaSet.Annotations[revisionAnnotation] != revision {
+			continue
+		}
+		// The hash label is added by the deployment controller and must not be carried over
+		template := replicaSet.Spec.Template.DeepCopy()
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+		return template, nil
+	}
+	return nil, nil
+}
+
+// Image a component runs in a release, the image in the blueprint unless the release names one
+func (t *tenant) releaseImage(component string, release *Release) (string, error) {
+	if image := release.Images.image(component); image != "" {
+		return image, nil
+	}
+
+	deploy := &appsv1.Deployment{}
+	if err := t.decode("Deployment", component, deploy); err != nil {
+		return "", err
+	}
+	container := findContainer(deploy.Spec.Template.Spec.Containers, component)
+	if container == nil {
+		return "", fmt.Errorf("blueprint deployment %s has no %s container", component, component)
+	}
+	return container.Image, nil
+}
+
+func findContainer(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+// The upgrade in progress, the last upgrade in the history while it has no result
+func (t *tenant) runningUpgrade() *Upgrade {
+	return t.instance.Status.runningUpgrade()
+}
+
+func (s *SaaSInstanceStatus) runningUpgrade() *Upgrade {
+	if len(s.Upgrades) == 0 || s.Upgrades[len(s.Upgrades)-1].Result != "" {
+		return nil
+	}
+	return &s.Upgrades[len(s.Upgrades)-1]
+}
+
+// Find the change an upgrade made to a component
+func (u *Upgrade) component(component string) *ComponentUpgrade {
+	if u == nil {
+		return nil
+	}
+	for i := range u.Components {
+		if u.Components[i].Component == component {
+			return &u.Components[i]
+		}
+	}
+	return nil
+}
+
+// Ask for the tenant to run a release with the given image tag overrides, the controller upgrades the tenant when the
+// release differs from the running release
+func (t *tenant) requestRelease(release string, versions ComponentVersion) error {
+	releasePatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{previousVersionsAnnotation: nil, operationAnnotation: nil}},
+		"spec":     map[string]interface{}{"release": release, "versions": versions},
+	})
+	_, err := t.instances.Patch(t.callContext(), t.instance.Name, types.MergePatchType, releasePatch, metav1.PatchOptions{})
+	return err
+}
+
+// Record the start of an upgrade to the release in the spec, or pick up the upgrade which was running
+func (t *tenant) recordUpgradeStarted() *Upgrade {
+	err := t.updateStatus(func(status *SaaSInstanceStatus) {
+		status.Phase = PhaseUpgrading
+		status.CurrentStep = "upgrade"
+		status.Message = "Upgrading to release " + t.instance.Spec.Release
+		if status.runningUpgrade() != nil {
+			return
+		}
+
+		status.Upgrades = append(status.Upgrades, Upgrade{
+			From:         status.Release,
+			To:           t.instance.Spec.Release,
+			StartTime:    metav1.Now(),
+			Operation:    t.instance.Annotations[operationAnnotation],
+			FromVersions: t.previousVersions(),
+		})
+		if len(status.Upgrades) > upgradeHistoryLimit {
+			status.Upgrades = status.Upgrades[len(status.Upgrades)-upgradeHistoryLimit:]
+		}
+	})
+	if err != nil {
+		return nil
+	}
+	t.log.WithField("release", t.instance.Spec.Release).Info("Upgrade started")
+	t.event(corev1.EventTypeNormal, EventUpgradeStarted, "Upgrading to release %s", t.instance.Spec.Release)
+	return t.runningUpgrade()
+}
+
+// Image tag overrides of a tenant before the upgrade to the release in its spec.  They were kept in an annotation when
+// an upgrade request dropped them, otherwise the release was changed without touching them
+func (t *tenant) previousVersions() ComponentVersion {
+	var previous previousVersions
+	annotation := t.instance.Annotations[previousVersionsAnnotation]
+	if annotation != "" && json.Unmarshal([]byte(annotation), &previous) == nil && previous.Release == t.instance.Spec.Release {
+		return previous.Versions
+	}
+	return t.instance.Spec.Versions
+}
+
+// Record a component about to be patched by the running upgrade
+func (t *tenant) recordComponentUpgrade(upgraded ComponentUpgrade) error {
+	return t.updateStatus(func(status *SaaSInstanceStatus) {
+		if upgrade := status.runningUpgrade(); upgrade != nil && upgrade.component(upgraded.Component) == nil {
+			upgrade.Components = append(upgrade.Components, upgraded)
+		}
+	})
+}
+
+// Record a completed upgrade, the tenant now runs the release it was upgraded to
+func (t *tenant) recordUpgraded() {
+	_ = t.updateStatus(func(status *SaaSInstanceStatus) {
+		upgrade := status.runningUpgrade()
+		if upgrade == nil {
+			return
+		}
+		now := metav1.Now()
+		upgrade.CompletionTime = &now
+		upgrade.Result = UpgradeSucceeded
+		status.Release = upgrade.To
+		status.Phase = PhaseReady
+		status.CurrentStep = ""
+		status.Message = "Completed"
+		status.Error = ""
+	})
+	t.log.WithField("release", t.instance.Status.Release).Info("Upgrade completed")
+	t.event(corev1.EventTypeNormal, EventUpgraded, "Upgraded to release %s", t.instance.Status.Release)
+}
+
+// Record a failed upgrade.  The tenant stays ready on its previous release when it was rolled back, and is failed
+// when the roll back failed too
+func (t *tenant) recordUpgradeFailed(upgradeErr error, rollbackErr error) {
+	_ = t.updateStatus(func(status *SaaSInstanceStatus) {
+		upgrade := status.runningUpgrade()
+		if upgrade == nil {
+			return
+		}
+		now := metav1.Now()
+		upgrade.CompletionTime = &now
+		upgrade.Message = upgradeErr.Error()
+		status.CurrentStep = ""
+
+		if rollbackErr != nil {
+			upgrade.Result = UpgradeFailed
+			upgrade.Message += "; " + rollbackErr.Error()
+			status.Phase = PhaseFailed
+			status.Message = "Failed"
+			status.Error = upgrade.Message
+			status.SetCondition(Condition{Type: ConditionReady, Status: ConditionFalse, Reason: "UpgradeFailed", Message: upgrade.Message})
+			return
+		}
+
+		upgrade.Result = UpgradeRolledBack
+		status.Phase = PhaseReady
+		status.Message = "Upgrade to release " + upgrade.To + " rolled back"
+	})
+
+	if rollbackErr != nil {
+		t.event(corev1.EventTypeWarning, EventUpgradeFailed, "Upgrade failed and could not be rolled back: %v; %v", upgradeErr, rollbackErr)
+		return
+	}
+	t.event(corev1.EventTypeWarning, EventRolledBack, "Upgrade rolled back: %v", upgradeErr)
+}
@@ -0,0 +1,202 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+// Images of the components on release 0.1, from the built in blueprint, and on release 0.2
+var (
+	releaseImages = map[string]ComponentImages{
+		"0.1": {PostgreSQL: "postgres:12.3-alpine", Backend: "bennerv/order-meow-api:0.1.0", Frontend: "bennerv/order-meow-ui:0.1.2"},
+		"0.2": {PostgreSQL: "postgres:13.1-alpine", Backend: "bennerv/order-meow-api:0.2.0", Frontend: "bennerv/order-meow-ui:0.2.0"},
+	}
+)
+
+// A deployment at its first revision and the replica set running that revision, as the deployment controller leaves
+// them
+func deploymentAtRevision(name string, image string) (*appsv1.Deployment, *appsv1.ReplicaSet) {
+	labels := map[string]string{"app": name}
+	deploy := rollingDeployment("team-a", name)
+	deploy.UID = types.UID("uid-" + name)
+	deploy.Annotations = map[string]string{revisionAnnotation: "1"}
+	deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	deploy.Spec.Template.Labels = labels
+	deploy.Spec.Template.Spec.Containers[0].Image = image
+
+	template := deploy.Spec.Template.DeepCopy()
+	template.Labels = map[string]string{"app": name, appsv1.DefaultDeploymentUniqueLabelKey: "5d4f8"}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name + "-5d4f8",
+			Namespace:       "team-a",
+			Labels:          template.Labels,
+			Annotations:     map[string]string{revisionAnnotation: "1"},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(deploy, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+		},
+		Spec: appsv1.ReplicaSetSpec{Selector: deploy.Spec.Selector, Template: *template},
+	}
+	return deploy, replicaSet
+}
+
+// A ready tenant on release 0.1 which has been asked to upgrade to release 0.2, its deployments stuck on any of the
+// failing images
+func newUpgradingTenant(t *testing.T, status SaaSInstanceStatus, failingImages ...string) (*tenant, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	instance := newSaaSInstance("team-a")
+	instance.Spec.Release = "0.2"
+	instance.Status = status
+
+	objects := []runtime.Object{databaseSecret("team-a")}
+	for component, image := range map[string]string{
+		"postgresql": releaseImages["0.1"].PostgreSQL,
+		"backend":    releaseImages["0.1"].Backend,
+		"frontend":   releaseImages["0.1"].Frontend,
+	} {
+		deploy, replicaSet := deploymentAtRevision(component, image)
+		objects = append(objects, deploy, replicaSet)
+	}
+	tn, cs, dc := newTestTenant(t, instance, objects...)
+	tn.releases = &ReleaseCatalogue{Default: "0.1", Releases: []Release{{Name: "0.1"}, {Name: "0.2", Images: releaseImages["0.2"]}}}
+	readyDeployments(cs, failingImages...)
+	return tn, cs, dc
+}
+
+// Images the deployments of a tenant run
+func deploymentImages(t *testing.T, cs *fake.Clientset) ComponentImages {
+	image := func(name string) string {
+		deploy, err := cs.AppsV1().Deployments("team-a").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return findContainer(deploy.Spec.Template.Spec.Containers, name).Image
+	}
+	return ComponentImages{PostgreSQL: image("postgresql"), Backend: image("backend"), Frontend: image("frontend")}
+}
+
+func TestUpgrade(t *testing.T) {
+	tn, cs, dc := newUpgradingTenant(t, SaaSInstanceStatus{Phase: PhaseReady, Release: "0.1"})
+
+	if err := tn.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	if images := deploymentImages(t, cs); images != releaseImages["0.2"] {
+		t.Errorf("expected every component on release 0.2, got %+v", images)
+	}
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseReady || stored.Status.Release != "0.2" {
+		t.Errorf("expected the tenant to be ready on release 0.2, got %s on %s", stored.Status.Phase, stored.Status.Release)
+	}
+	if len(stored.Status.Upgrades) != 1 || stored.Status.Upgrades[0].Result != UpgradeSucceeded || len(stored.Status.Upgrades[0].Components) != 3 {
+		t.Errorf("expected a single successful upgrade of every component, got %+v", stored.Status.Upgrades)
+	}
+}
+
+// A rollout which fails rolls every component already patched back to the replica set it ran before, and puts the
+// tenant back on the release it was running
+func TestUpgradeRolledBack(t *testing.T) {
+	tn, cs, dc := newUpgradingTenant(t, SaaSInstanceStatus{Phase: PhaseReady, Release: "0.1"}, releaseImages["0.2"].Frontend)
+
+	if err := tn.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	if images := deploymentImages(t, cs); images != releaseImages["0.1"] {
+		t.Errorf("expected every component back on release 0.1, got %+v", images)
+	}
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseReady || stored.Status.Release != "0.1" || stored.Spec.Release != "0.1" {
+		t.Errorf("expected the tenant to be ready on release 0.1, got %s on %s asking for %s", stored.Status.Phase, stored.Status.Release, stored.Spec.Release)
+	}
+	if upgrade := stored.Status.Upgrades[0]; upgrade.Result != UpgradeRolledBack {
+		t.Errorf("expected the upgrade to be rolled back, got %s: %s", upgrade.Result, upgrade.Message)
+	}
+}
+
+// A tenant whose upgrade can not be rolled back either is failed rather than left half upgraded without a word
+func TestUpgradeRollbackFails(t *testing.T) {
+	tn, cs, dc := newUpgradingTenant(t, SaaSInstanceStatus{Phase: PhaseReady, Release: "0.1"}, releaseImages["0.2"].Frontend)
+	cs.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	if err := tn.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storedInstance(t, dc, "team-a")
+	if stored.Status.Phase != PhaseFailed || stored.Status.Upgrades[0].Result != UpgradeFailed {
+		t.Errorf("expected the tenant to fail, got %s with %+v", stored.Status.Phase, stored.Status.Upgrades)
+	}
+	if stored.Spec.Release != "0.2" {
+		t.Errorf("expected the release asked for to be kept while the tenant runs part of it, got %s", stored.Spec.Release)
+	}
+}
+
+// An upgrade which was running when the provisioner restarted carries on, without patching the components it had
+// already patched again, and can still roll them back
+func TestUpgradeResumesAfterRestart(t *testing.T) {
+	running := SaaSInstanceStatus{
+		Phase:   PhaseUpgrading,
+		Release: "0.1",
+		Upgrades: []Upgrade{{
+			From:      "0.1",
+			To:        "0.2",
+			StartTime: metav1.Now(),
+			Components: []ComponentUpgrade{{
+				Component: "postgresql",
+				FromImage: releaseImages["0.1"].PostgreSQL,
+				ToImage:   releaseImages["0.2"].PostgreSQL,
+				Revision:  "1",
+			}},
+		}},
+	}
+	tn, cs, dc := newUpgradingTenant(t, running, releaseImages["0.2"].Backend)
+	postgres, err := cs.AppsV1().Deployments("team-a").Get(context.Background(), "postgresql", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres.Spec.Template.Spec.Containers[0].Image = releaseImages["0.2"].PostgreSQL
+	if _, err := cs.AppsV1().Deployments("team-a").Update(context.Background(), postgres, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cs.ClearActions()
+
+	if err := tn.upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range cs.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && patch.GetName() == "postgresql" {
+			t.Error("expected the postgresql deployment patched before the restart not to be patched again")
+		}
+	}
+	if images := deploymentImages(t, cs); images != releaseImages["0.1"] {
+		t.Errorf("expected every component back on release 0.1, got %+v", images)
+	}
+	stored := storedInstance(t, dc, "team-a")
+	if len(stored.Status.Upgrades) != 1 || stored.Status.Upgrades[0].Result != UpgradeRolledBack {
+		t.Errorf("expected the resumed upgrade to be rolled back, got %+v", stored.Status.Upgrades)
+	}
+}
+
+// Deployments keep the pod template of the revision they ran, the image is only restored when its replica set has gone
+func TestRollBackComponentWithoutReplicaSet(t *testing.T) {
+	tn, cs, _ := newUpgradingTenant(t, SaaSInstanceStatus{Phase: PhaseUpgrading, Release: "0.1"})
+	upgraded := ComponentUpgrade{Component: "backend", FromImage: "bennerv/order-meow-api:0.0.9", ToImage: releaseImages["0.2"].Backend, Revision: "7"}
+
+	if err := tn.rollBackComponent(upgraded); err != nil {
+		t.Fatal(err)
+	}
+	if image := deploymentImages(t, cs).Backend; image != upgraded.FromImage {
+		t.Errorf("expected the image from before the upgrade, got %s", image)
+	}
+}
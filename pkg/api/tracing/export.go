@@ -0,0 +1,170 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Exporters spans can be sent to
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Spans sent in a single export, and the longest a span waits to be exported
+const (
+	batchSize     = 256
+	batchInterval = 5 * time.Second
+)
+
+// Spans waiting to be exported.  Spans ended while the buffer is full are dropped
+const exportBuffer = 2048
+
+var droppedSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "saas_tracing_spans_dropped_total",
+	Help: "Spans which were never exported, by whether the export buffer was full or the export failed.",
+}, []string{"reason"})
+
+type Options struct {
+	// Where spans are sent: none, otlp, stdout or file
+	Exporter string
+	// OTLP/HTTP traces endpoint spans are posted to, such as http://collector:4318/v1/traces
+	Endpoint string
+	// File spans are appended to as JSON by the file exporter
+	File string
+	// Name the provisioner is reported as
+	ServiceName string
+}
+
+// Start exporting spans as the options say, installing the tracer provider spans are started from.  The returned
+// function exports the spans still waiting and stops exporting, it must be called before the provisioner exits.
+// Nothing is traced with the none exporter
+func Setup(options Options) (func(ctx context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	switch options.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		endpoint, err := url.Parse(options.Endpoint)
+		if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return nil, fmt.Errorf("the otlp trace exporter needs an http or https endpoint, got %q", options.Endpoint)
+		}
+		driverOptions := []otlphttp.Option{otlphttp.WithEndpoint(endpoint.Host), otlphttp.WithTracesURLPath(endpoint.Path)}
+		if endpoint.Scheme == "http" {
+			driverOptions = append(driverOptions, otlphttp.WithInsecure())
+		}
+		exporter, err = otlp.NewExporter(context.Background(), otlphttp.NewDriver(driverOptions...))
+		if err != nil {
+			return nil, err
+		}
+	case ExporterStdout:
+		var err error
+		if exporter, err = stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport()); err != nil {
+			return nil, err
+		}
+	case ExporterFile:
+		var err error
+		if file, err = os.OpenFile(options.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return nil, err
+		}
+		if exporter, err = stdout.NewExporter(stdout.WithWriter(file), stdout.WithoutMetricExport()); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %s", options.Exporter)
+	}
+
+	otel.SetErrorHandler(errorHandler{})
+	provider := newProvider(exporter, options.ServiceName)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// A provider exporting its spans in batches, counting the spans which are dropped
+func newProvider(exporter sdktrace.SpanExporter, serviceName string) *sdktrace.TracerProvider {
+	var waiting int64
+	batches := sdktrace.NewBatchSpanProcessor(countingExporter{SpanExporter: exporter, waiting: &waiting},
+		sdktrace.WithMaxQueueSize(exportBuffer),
+		sdktrace.WithMaxExportBatchSize(batchSize),
+		sdktrace.WithBatchTimeout(batchInterval),
+	)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(boundedProcessor{SpanProcessor: batches, waiting: &waiting}),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+}
+
+// Hands ended spans on to be batched while fewer than exportBuffer are waiting to be exported.  The batch processor
+// drops the spans which do not fit in its queue without saying so, this drops them first and counts them
+type boundedProcessor struct {
+	sdktrace.SpanProcessor
+	waiting *int64
+}
+
+func (p boundedProcessor) OnEnd(span sdktrace.ReadOnlySpan) {
+	// Spans which are not sampled are never exported
+	if !span.SpanContext().IsSampled() {
+		return
+	}
+	if atomic.AddInt64(p.waiting, 1) > exportBuffer {
+		atomic.AddInt64(p.waiting, -1)
+		droppedSpans.WithLabelValues("buffer_full").Inc()
+		return
+	}
+	p.SpanProcessor.OnEnd(span)
+}
+
+// Counts the spans which have left the buffer, and those which failed to be exported
+type countingExporter struct {
+	sdktrace.SpanExporter
+	waiting *int64
+}
+
+func (e countingExporter) ExportSpans(ctx context.Context, spans []*sdktrace.SpanSnapshot) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	atomic.AddInt64(e.waiting, -int64(len(spans)))
+	if err != nil {
+		droppedSpans.WithLabelValues("export_failed").Add(float64(len(spans)))
+	}
+	return err
+}
+
+// Logs the errors of the OpenTelemetry SDK, such as failed exports, with the provisioner's logger
+type errorHandler struct{}
+
+func (errorHandler) Handle(err error) {
+	// The SDK also hands over nil when it found nothing wrong reading the resource from the environment
+	if err == nil {
+		return
+	}
+	logging.Root().WithError(err).Warn("Failed to export spans")
+}
@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An OTLP/HTTP endpoint recording the requests it is sent, answering them with status
+type collectorServer struct {
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	paths    []string
+	requests []*collectortrace.ExportTraceServiceRequest
+}
+
+func newCollector(t *testing.T, status int) *collectorServer {
+	c := &collectorServer{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		request := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("request is not OTLP protobuf: %v", err)
+		}
+		c.mutex.Lock()
+		c.paths = append(c.paths, r.URL.Path)
+		c.requests = append(c.requests, request)
+		c.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+// Start exporting as the options say, stopping when the test ends if it has not stopped by then
+func setup(t *testing.T, options Options) func() {
+	shutdown, err := Setup(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if err := shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestOTLPExport(t *testing.T) {
+	collector := newCollector(t, http.StatusOK)
+	stop := setup(t, Options{Exporter: ExporterOTLP, Endpoint: collector.server.URL + "/v1/traces", ServiceName: "provisioner-test"})
+
+	ctx, parent := Start(context.Background(), "GET /v1/saas")
+	_, child := Start(ctx, "create namespace")
+	child.End()
+	parent.End()
+	stop()
+
+	if len(collector.requests) != 1 || collector.paths[0] != "/v1/traces" {
+		t.Fatalf("expected one export to /v1/traces, got %v", collector.paths)
+	}
+	resourceSpans := collector.requests[0].ResourceSpans
+	if len(resourceSpans) != 1 {
+		t.Fatalf("expected the spans of a single resource, got %d", len(resourceSpans))
+	}
+	var serviceName string
+	for _, kv := range resourceSpans[0].Resource.Attributes {
+		if kv.Key == "service.name" {
+			serviceName = kv.Value.GetStringValue()
+		}
+	}
+	if serviceName != "provisioner-test" {
+		t.Errorf("expected the service name provisioner-test, got %q", serviceName)
+	}
+
+	names := map[string]bool{}
+	for _, library := range resourceSpans[0].InstrumentationLibrarySpans {
+		if library.InstrumentationLibrary.Name != scopeName {
+			t.Errorf("expected the spans of %s, got %s", scopeName, library.InstrumentationLibrary.Name)
+		}
+		for _, span := range library.Spans {
+			names[span.Name] = true
+		}
+	}
+	if !names["GET /v1/saas"] || !names["create namespace"] {
+		t.Errorf("expected both spans to be exported, got %v", names)
+	}
+}
+
+func TestFailedExportCountsDroppedSpans(t *testing.T) {
+	collector := newCollector(t, http.StatusBadRequest)
+	stop := setup(t, Options{Exporter: ExporterOTLP, Endpoint: collector.server.URL + "/v1/traces"})
+	before := testutil.ToFloat64(droppedSpans.WithLabelValues("export_failed"))
+
+	for i := 0; i < 3; i++ {
+		_, span := Start(context.Background(), "span")
+		span.End()
+	}
+	stop()
+
+	if len(collector.requests) != 1 {
+		t.Fatalf("expected one export, got %d", len(collector.requests))
+	}
+	if count := testutil.ToFloat64(droppedSpans.WithLabelValues("export_failed")) - before; count != 3 {
+		t.Errorf("expected 3 dropped spans, got %v", count)
+	}
+}
+
+func TestFullBufferCountsDroppedSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	// Room for one more span
+	waiting := int64(exportBuffer - 1)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(boundedProcessor{
+		SpanProcessor: sdktrace.NewSimpleSpanProcessor(exporter),
+		waiting:       &waiting,
+	}))
+	before := testutil.ToFloat64(droppedSpans.WithLabelValues("buffer_full"))
+
+	for i := 0; i < 3; i++ {
+		_, span := provider.Tracer(scopeName).Start(context.Background(), "span")
+		span.End()
+	}
+
+	if len(exporter.GetSpans()) != 1 {
+		t.Errorf("expected the span which fit to be exported, got %d", len(exporter.GetSpans()))
+	}
+	if count := testutil.ToFloat64(droppedSpans.WithLabelValues("buffer_full")) - before; count != 2 {
+		t.Errorf("expected 2 dropped spans, got %v", count)
+	}
+}
+
+func TestFileExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+
+	for _, name := range []string{"first", "second"} {
+		stop := setup(t, Options{Exporter: ExporterFile, File: path})
+		_, span := Start(context.Background(), name)
+		span.End()
+		stop()
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line for each batch appended to the file, got %q", data)
+	}
+	for i, name := range []string{"first", "second"} {
+		var spans []struct{ Name string }
+		if err := json.Unmarshal([]byte(lines[i]), &spans); err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 || spans[0].Name != name {
+			t.Errorf("expected the span %s, got %+v", name, spans)
+		}
+	}
+}
+
+func TestNoneTracesNothing(t *testing.T) {
+	setup(t, Options{Exporter: ExporterNone})
+
+	ctx, span := Start(context.Background(), "span")
+	defer span.End()
+	if span.IsRecording() || TraceParent(ctx) != "" {
+		t.Fatal("expected no span while tracing is disabled")
+	}
+}
+
+func TestSetupRejectsBadOptions(t *testing.T) {
+	tests := map[string]Options{
+		"unknown exporter":         {Exporter: "zipkin"},
+		"otlp without address":     {Exporter: ExporterOTLP},
+		"otlp address without url": {Exporter: ExporterOTLP, Endpoint: "collector:4318"},
+		"unwritable file":          {Exporter: ExporterFile, File: filepath.Join("missing", "directory", "traces.json")},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Setup(options); err == nil {
+				t.Error("expected the options to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Spans of requests are named after their method and path, server spans are renamed after their route once it is known
+func spanName(_ string, r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// Start a server span for every request, continuing the trace of the caller when it sent a traceparent header.  The
+// span is named after the route the request matched once it has been served.  Must come after chi's RequestID
+// middleware
+func Middleware(next http.Handler) http.Handler {
+	routed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.String(logging.FieldRequestID, middleware.GetReqID(ctx)))
+		// Callers can find the trace of their request
+		if traceParent := TraceParent(ctx); traceParent != "" {
+			w.Header().Set(TraceParentHeader, traceParent)
+		}
+
+		next.ServeHTTP(w, r)
+
+		if routeContext := chi.RouteContext(ctx); routeContext != nil && routeContext.RoutePattern() != "" {
+			span.SetName(r.Method + " " + routeContext.RoutePattern())
+			span.SetAttributes(semconv.HTTPRouteKey.String(routeContext.RoutePattern()))
+		}
+	})
+	return otelhttp.NewHandler(routed, "", otelhttp.WithPropagators(propagator), otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// Wrap a round tripper so every request made with a context carrying a span gets a client span of its own, and
+// carries the span to the server in a traceparent header.  Requests made without a span, such as the watches of
+// informers, are not traced.  Fits the WrapTransport of a Kubernetes client config
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return clonedRequests{otelhttp.NewTransport(rt,
+		otelhttp.WithPropagators(propagator),
+		otelhttp.WithSpanNameFormatter(spanName),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return trace.SpanContextFromContext(r.Context()).IsValid()
+		}),
+	)}
+}
+
+// The otelhttp transport sets the traceparent header on the request it is given, round trippers must not change
+// their requests so it is given a copy
+type clonedRequests struct {
+	traced http.RoundTripper
+}
+
+func (c clonedRequests) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(r.Context()).IsValid() {
+		return c.traced.RoundTrip(r)
+	}
+	return c.traced.RoundTrip(r.Clone(r.Context()))
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+// Name of the instrumentation recorded with every span
+const scopeName = "github.com/bennerv/provisioning-api"
+
+// Header spans are propagated in, as set out by W3C Trace Context
+const TraceParentHeader = "traceparent"
+
+// Spans are carried across process boundaries in traceparent headers
+var propagator = propagation.TraceContext{}
+
+// Start a span as a child of the span in the context, or as the root of a new trace.  The returned context carries
+// the new span.  Spans are only recorded once Setup has installed an exporter
+func Start(ctx context.Context, name string, options ...trace.SpanOption) (context.Context, trace.Span) {
+	return otel.Tracer(scopeName).Start(ctx, name, options...)
+}
+
+// Mark a span as failed with an error, nil errors are ignored
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// W3C traceparent of the span carried by a context, empty when it carries none
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.HeaderCarrier(http.Header{})
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceParentHeader)
+}
+
+// Parse a W3C traceparent header, returning false when it is missing or malformed
+func ParseTraceParent(header string) (trace.SpanContext, bool) {
+	carrier := propagation.HeaderCarrier(http.Header{})
+	carrier.Set(TraceParentHeader, header)
+	sc := trace.SpanContextFromContext(propagator.Extract(context.Background(), carrier))
+	return sc, sc.IsValid()
+}
+
+// A context carrying the values of another, such as its span, which is never cancelled.  Work which must finish even
+// when the work it is part of is cancelled, such as recording a failure, still shows up in the trace
+func WithoutCancel(ctx context.Context) context.Context {
+	return detached{parent: ctx}
+}
+
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
+
+func (d detached) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
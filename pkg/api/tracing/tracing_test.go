@@ -0,0 +1,199 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Trace into memory, the test reads the spans once they have ended
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	})
+	return exporter
+}
+
+// The single span recorded
+func ended(t *testing.T, exporter *tracetest.InMemoryExporter) *sdktrace.SpanSnapshot {
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected a span to end, got %d", len(spans))
+	}
+	return spans[0]
+}
+
+func attributeOf(span *sdktrace.SpanSnapshot, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"later version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"missing flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := ParseTraceParent(test.header)
+			if ok != test.ok {
+				t.Fatalf("expected %v, got %v", test.ok, ok)
+			}
+			if ok && (sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID().String() != "00f067aa0ba902b7") {
+				t.Errorf("unexpected span context %v", sc)
+			}
+		})
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	recordSpans(t)
+	if TraceParent(context.Background()) != "" {
+		t.Error("expected no traceparent without a span")
+	}
+
+	ctx, span := Start(context.Background(), "span")
+	defer span.End()
+	sc, ok := ParseTraceParent(TraceParent(ctx))
+	if !ok || sc.TraceID() != span.SpanContext().TraceID() || sc.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("expected the traceparent of the span, got %s", TraceParent(ctx))
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	exporter := recordSpans(t)
+
+	_, span := Start(context.Background(), "span")
+	RecordError(span, nil)
+	RecordError(span, errors.New("failed"))
+	span.End()
+
+	recorded := ended(t, exporter)
+	if recorded.StatusCode != codes.Error || recorded.StatusMessage != "failed" || len(recorded.MessageEvents) != 1 {
+		t.Errorf("expected the span to fail with the error once, got %v %q and %v", recorded.StatusCode, recorded.StatusMessage, recorded.MessageEvents)
+	}
+}
+
+func TestWithoutCancel(t *testing.T) {
+	recordSpans(t)
+	ctx, span := Start(context.Background(), "span")
+	defer span.End()
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	detached := WithoutCancel(ctx)
+	if detached.Err() != nil || detached.Done() != nil {
+		t.Error("expected the detached context not to be cancelled")
+	}
+	if trace.SpanFromContext(detached) != span {
+		t.Error("expected the detached context to carry the span")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := recordSpans(t)
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID, Middleware)
+	router.Get("/saas/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if !trace.SpanFromContext(r.Context()).IsRecording() {
+			t.Error("expected the request to carry its span")
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	r := httptest.NewRequest("GET", "/saas/team-a", nil)
+	r.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, r)
+
+	span := ended(t, exporter)
+	remote, _ := ParseTraceParent(r.Header.Get(TraceParentHeader))
+	if span.SpanContext.TraceID() != remote.TraceID() || span.Parent.SpanID() != remote.SpanID() || span.SpanKind != trace.SpanKindServer {
+		t.Errorf("expected a server span continuing the caller's trace, got %v with parent %v", span.SpanContext, span.Parent.SpanID())
+	}
+	if sc, _ := ParseTraceParent(recorder.Header().Get(TraceParentHeader)); sc.SpanID() != span.SpanContext.SpanID() {
+		t.Errorf("expected the response to carry the span, got %s", recorder.Header().Get(TraceParentHeader))
+	}
+	if span.Name != "GET /saas/{name}" || attributeOf(span, "http.route").AsString() != "/saas/{name}" {
+		t.Errorf("expected the span to be named after the route, got %s", span.Name)
+	}
+	if attributeOf(span, "http.status_code").AsInt64() != http.StatusInternalServerError || span.StatusCode != codes.Error {
+		t.Errorf("expected a failed span, got status %v and %v", attributeOf(span, "http.status_code").AsInterface(), span.StatusCode)
+	}
+	if attributeOf(span, logging.FieldRequestID).AsString() == "" {
+		t.Errorf("expected the request id on the span, got %v", span.Attributes)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	exporter := recordSpans(t)
+	var traceParents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParents = append(traceParents, r.Header.Get(TraceParentHeader))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: Transport(nil)}
+
+	// Requests made without a span, such as the watches of informers, are not traced
+	resp, err := client.Get(server.URL + "/untraced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, parent := Start(context.Background(), "step")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/traced", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	span := ended(t, exporter)
+	if span.SpanKind != trace.SpanKindClient || span.Parent.SpanID() != parent.SpanContext().SpanID() || span.Name != "GET /traced" {
+		t.Errorf("expected a client span of the step, got %s with parent %v", span.Name, span.Parent.SpanID())
+	}
+	if sc, _ := ParseTraceParent(traceParents[len(traceParents)-1]); len(traceParents) != 2 || traceParents[0] != "" || sc.SpanID() != span.SpanContext.SpanID() {
+		t.Errorf("expected only the traced request to carry the client span, got %v", traceParents)
+	}
+	if attributeOf(span, "http.status_code").AsInt64() != http.StatusNotFound || span.StatusCode != codes.Error {
+		t.Errorf("expected a failed span, got status %v and %v", attributeOf(span, "http.status_code").AsInterface(), span.StatusCode)
+	}
+	if req.Header.Get(TraceParentHeader) != "" {
+		t.Error("expected the request given to the transport to be left unchanged")
+	}
+}
@@ -0,0 +1,357 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bennerv/provisioning-api/pkg/api/logging"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifecycle events of a tenant
+const (
+	TenantCreated  = "tenant.created"
+	TenantReady    = "tenant.ready"
+	TenantFailed   = "tenant.failed"
+	TenantUpgraded = "tenant.upgraded"
+	TenantDeleted  = "tenant.deleted"
+)
+
+// Header holding the signature of a delivery, "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">"
+const SignatureHeader = "X-Webhook-Signature"
+
+// Headers holding the event type and the id of a delivery, the id stays the same across retries
+const (
+	EventHeader    = "X-Webhook-Event"
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// Longest wait between two attempts of a delivery
+const maxBackoff = 10 * time.Minute
+
+// Deliveries kept in the dead-letter list, the oldest are dropped first
+const deadLetterLimit = 100
+
+// A subscription of an endpoint to tenant events, read from the webhooks file
+type Subscription struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Key the payloads sent to the endpoint are signed with
+	Secret string `json:"secret"`
+	// Events sent to the endpoint, every event when empty
+	Events []string `json:"events,omitempty"`
+}
+
+// Whether the subscription wants an event type
+func (s Subscription) wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, event := range s.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// The JSON payload sent for an event
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Tenant string    `json:"tenant"`
+	Time   time.Time `json:"time"`
+	// Details of the event, such as the release a tenant was upgraded to or the error it failed with
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// A delivery which failed every attempt
+type DeadLetter struct {
+	Subscription string    `json:"subscription"`
+	Event        Event     `json:"event"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"lastError"`
+	FailedAt     time.Time `json:"failedAt"`
+}
+
+type Options struct {
+	// Client deliveries are sent with, http.DefaultClient with a timeout when nil
+	Client *http.Client
+	// Workers sending deliveries
+	Workers int
+	// Attempts made before a delivery goes to the dead-letter list, and the wait before the first retry which doubles
+	// for every attempt after that
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+type delivery struct {
+	subscription Subscription
+	event        Event
+	attempts     int
+}
+
+// Sends tenant events to the subscribed endpoints in the background, retrying failed deliveries with exponential
+// backoff.  Deliveries still waiting to be retried when the dispatcher stops are lost
+type Dispatcher struct {
+	options Options
+	queue   chan delivery
+
+	mutex         sync.Mutex
+	subscriptions []Subscription
+	deadLetters   []DeadLetter
+}
+
+// Load subscriptions from a YAML or JSON file holding a list of subscriptions.  No subscriptions are loaded when the
+// path is empty
+func LoadSubscriptions(path string) ([]Subscription, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []Subscription
+	if err := yaml.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks file %s: %w", path, err)
+	}
+	for i, subscription := range subscriptions {
+		if subscription.Name == "" || subscription.URL == "" || subscription.Secret == "" {
+			return nil, fmt.Errorf("webhook %d needs a name, a url and a secret", i)
+		}
+	}
+	return subscriptions, nil
+}
+
+func NewDispatcher(subscriptions []Subscription, options Options) *Dispatcher {
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	return &Dispatcher{
+		subscriptions: subscriptions,
+		options:       options,
+		queue:         make(chan delivery, 1000),
+	}
+}
+
+// Start the workers sending deliveries, they stop when the context is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < d.options.Workers; i++ {
+		go d.run(ctx)
+	}
+}
+
+// Queue an event for every subscription which wants it.  Events are given an id and a time when they have none
+func (d *Dispatcher) Send(event Event) {
+	if d == nil {
+		return
+	}
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for _, subscription := range d.Subscriptions() {
+		if subscription.wants(event.Type) {
+			d.enqueue(delivery{subscription: subscription, event: event})
+		}
+	}
+}
+
+// Subscriptions events are sent to
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.subscriptions
+}
+
+// Replace the subscriptions, such as when the webhooks file changes.  Deliveries already queued are still sent to the
+// subscription they were queued for
+func (d *Dispatcher) SetSubscriptions(subscriptions []Subscription) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.subscriptions = subscriptions
+}
+
+// Deliveries which failed every attempt, oldest first
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]DeadLetter{}, d.deadLetters...)
+}
+
+func (d *Dispatcher) enqueue(next delivery) {
+	select {
+	case d.queue <- next:
+	default:
+		d.deadLetter(next, errors.New("delivery queue is full"))
+	}
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case next := <-d.queue:
+			d.attempt(ctx, next)
+		}
+	}
+}
+
+// Send a delivery once, scheduling a retry or moving it to the dead-letter list when it fails
+func (d *Dispatcher) attempt(ctx context.Context, next delivery) {
+	next.attempts++
+	err := d.post(ctx, next)
+	if err == nil {
+		return
+	}
+
+	if next.attempts >= d.options.MaxAttempts {
+		d.deadLetter(next, err)
+		return
+	}
+	deliveryLogger(next).WithError(err).Warn("Webhook delivery failed")
+	time.AfterFunc(d.backoff(next.attempts), func() {
+		if ctx.Err() == nil {
+			d.enqueue(next)
+		}
+	})
+}
+
+func (d *Dispatcher) post(ctx context.Context, next delivery) error {
+	body, err := json.Marshal(next.event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, next.subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, next.event.Type)
+	req.Header.Set(DeliveryHeader, next.event.ID)
+	req.Header.Set(SignatureHeader, Sign(next.subscription.Secret, time.Now(), body))
+
+	resp, err := d.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Wait before the retry following the given number of attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.options.Backoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func (d *Dispatcher) deadLetter(next delivery, err error) {
+	deliveryLogger(next).WithError(err).Error("Webhook delivery failed every attempt, moved to the dead-letter list")
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		Subscription: next.subscription.Name,
+		Event:        next.event,
+		Attempts:     next.attempts,
+		LastError:    err.Error(),
+		FailedAt:     time.Now().UTC(),
+	})
+	if len(d.deadLetters) > deadLetterLimit {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-deadLetterLimit:]
+	}
+}
+
+func deliveryLogger(next delivery) *logrus.Entry {
+	return logging.Root().WithFields(logrus.Fields{
+		"webhook":           next.subscription.Name,
+		"delivery":          next.event.ID,
+		"event":             next.event.Type,
+		logging.FieldTenant: next.event.Tenant,
+		"attempts":          next.attempts,
+	})
+}
+
+// Signature of a payload sent at a time, as found in the signature header
+func Sign(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + mac(secret, timestamp, body)
+}
+
+// Check the signature header of a payload received by an endpoint.  Payloads signed longer than tolerance ago are
+// rejected so a captured delivery can not be replayed
+func Verify(secret string, header string, body []byte, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "v1="):
+			signature = strings.TrimPrefix(part, "v1=")
+		}
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("malformed signature")
+	}
+	if age := time.Since(time.Unix(signedAt, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature is too old")
+	}
+	if !hmac.Equal([]byte(signature), []byte(mac(secret, timestamp, body))) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func mac(secret string, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
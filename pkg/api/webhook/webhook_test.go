@@ -0,0 +1,309 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A delivery received by a test endpoint
+type received struct {
+	event    Event
+	header   http.Header
+	body     []byte
+	received time.Time
+}
+
+// An endpoint recording the deliveries it receives, answering each with the next status, or the last one once they
+// run out
+type receiver struct {
+	server *httptest.Server
+
+	mutex      sync.Mutex
+	statuses   []int
+	deliveries []received
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("delivery is not an event: %v", err)
+		}
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.deliveries = append(r.deliveries, received{event: event, header: req.Header, body: body, received: time.Now()})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status = r.statuses[0]
+			if len(r.statuses) > 1 {
+				r.statuses = r.statuses[1:]
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *receiver) received() []received {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]received(nil), r.deliveries...)
+}
+
+func (r *receiver) subscription(name string) Subscription {
+	return Subscription{Name: name, URL: r.server.URL, Secret: name + "-secret"}
+}
+
+// Start a dispatcher sending to the receiver, stopped when the test ends
+func startDispatcher(t *testing.T, r *receiver, subscriptions []Subscription, options Options) *Dispatcher {
+	options.Client = r.server.Client()
+	dispatcher := NewDispatcher(subscriptions, options)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	dispatcher.Start(ctx)
+	return dispatcher
+}
+
+// Wait up to a few seconds for a condition to hold
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"tenant.ready"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		valid  bool
+	}{
+		{name: "valid", header: Sign("secret", now, body), body: body, valid: true},
+		{name: "within tolerance", header: Sign("secret", now.Add(-4*time.Minute), body), body: body, valid: true},
+		{name: "wrong secret", header: Sign("other", now, body), body: body},
+		{name: "tampered body", header: Sign("secret", now, body), body: []byte(`{"type":"tenant.deleted"}`)},
+		{name: "too old", header: Sign("secret", now.Add(-6*time.Minute), body), body: body},
+		{name: "from the future", header: Sign("secret", now.Add(6*time.Minute), body), body: body},
+		{name: "timestamp changed", header: strings.Replace(Sign("secret", now, body), "t=", "t=1", 1), body: body},
+		{name: "no signature", header: "t=" + strconv.FormatInt(now.Unix(), 10), body: body},
+		{name: "malformed", header: "v1=abc", body: body},
+		{name: "empty", header: "", body: body},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify("secret", test.header, test.body, 5*time.Minute)
+			if test.valid && err != nil {
+				t.Errorf("expected the signature to be valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("expected the signature to be rejected")
+			}
+		})
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	r := newReceiver(t)
+	ready := r.subscription("ready")
+	ready.Events = []string{TenantReady}
+	dispatcher := startDispatcher(t, r, []Subscription{r.subscription("all"), ready}, Options{MaxAttempts: 1})
+
+	dispatcher.Send(Event{Type: TenantCreated, Tenant: "team-a"})
+	dispatcher.Send(Event{Type: TenantReady, Tenant: "team-a", Data: map[string]string{"url": "http://team-a"}})
+	waitFor(t, "three deliveries", func() bool { return len(r.received()) == 3 })
+
+	secrets := map[string]string{ready.Secret: TenantReady, r.subscription("all").Secret: ""}
+	counts := map[string]int{}
+	for _, delivery := range r.received() {
+		if delivery.header.Get(EventHeader) != delivery.event.Type {
+			t.Errorf("event header %q does not match the event %q", delivery.header.Get(EventHeader), delivery.event.Type)
+		}
+		if delivery.header.Get(DeliveryHeader) != delivery.event.ID || delivery.event.ID == "" {
+			t.Errorf("delivery header %q does not match the event id %q", delivery.header.Get(DeliveryHeader), delivery.event.ID)
+		}
+		if delivery.event.Time.IsZero() || delivery.event.Tenant != "team-a" {
+			t.Errorf("unexpected event %+v", delivery.event)
+		}
+
+		// Each delivery is signed with the secret of one of the subscriptions wanting it
+		signedBy := ""
+		for secret, only := range secrets {
+			if (only == "" || only == delivery.event.Type) &&
+				Verify(secret, delivery.header.Get(SignatureHeader), delivery.body, time.Minute) == nil {
+				signedBy = secret
+			}
+		}
+		if signedBy == "" {
+			t.Errorf("delivery of %s is not signed by a subscription wanting it", delivery.event.Type)
+		}
+		counts[signedBy+"/"+delivery.event.Type]++
+	}
+	expected := map[string]int{"all-secret/" + TenantCreated: 1, "all-secret/" + TenantReady: 1, "ready-secret/" + TenantReady: 1}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("expected %d deliveries for %s, got %v", count, key, counts)
+		}
+	}
+}
+
+func TestRetriesWithBackoff(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK)
+	backoff := 50 * time.Millisecond
+	dispatcher := startDispatcher(t, r, []Subscription{r.subscription("flaky")}, Options{MaxAttempts: 3, Backoff: backoff})
+
+	dispatcher.Send(Event{Type: TenantCreated, Tenant: "team-a"})
+	waitFor(t, "three attempts", func() bool { return len(r.received()) == 3 })
+
+	deliveries := r.received()
+	for i, delivery := range deliveries {
+		if delivery.event.ID != deliveries[0].event.ID {
+			t.Errorf("attempt %d has a different delivery id %s from %s", i+1, delivery.event.ID, deliveries[0].event.ID)
+		}
+	}
+	if wait := deliveries[1].received.Sub(deliveries[0].received); wait < backoff {
+		t.Errorf("expected the first retry to wait at least %v, waited %v", backoff, wait)
+	}
+	if wait := deliveries[2].received.Sub(deliveries[1].received); wait < 2*backoff {
+		t.Errorf("expected the second retry to wait at least %v, waited %v", 2*backoff, wait)
+	}
+
+	time.Sleep(4 * backoff)
+	if attempts := len(r.received()); attempts != 3 {
+		t.Errorf("expected no attempts after the delivery succeeded, got %d attempts", attempts)
+	}
+	if deadLetters := dispatcher.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("expected no dead letters, got %v", deadLetters)
+	}
+}
+
+func TestBackoffDoublesUpToTheLimit(t *testing.T) {
+	dispatcher := NewDispatcher(nil, Options{Backoff: time.Minute})
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, maxBackoff, maxBackoff}
+	for i, backoff := range expected {
+		if actual := dispatcher.backoff(i + 1); actual != backoff {
+			t.Errorf("expected a backoff of %v after %d attempts, got %v", backoff, i+1, actual)
+		}
+	}
+}
+
+func TestDeadLetterAfterMaxAttempts(t *testing.T) {
+	r := newReceiver(t, http.StatusBadGateway)
+	dispatcher := startDispatcher(t, r, []Subscription{r.subscription("down")}, Options{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	dispatcher.Send(Event{Type: TenantFailed, Tenant: "team-a"})
+	waitFor(t, "a dead letter", func() bool { return len(dispatcher.DeadLetters()) == 1 })
+
+	deadLetter := dispatcher.DeadLetters()[0]
+	if deadLetter.Subscription != "down" || deadLetter.Attempts != 3 || deadLetter.Event.Type != TenantFailed {
+		t.Errorf("unexpected dead letter %+v", deadLetter)
+	}
+	if !strings.Contains(deadLetter.LastError, "502") {
+		t.Errorf("expected the last error to hold the status, got %q", deadLetter.LastError)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if attempts := len(r.received()); attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDeadLetterListIsBounded(t *testing.T) {
+	dispatcher := NewDispatcher(nil, Options{})
+	for i := 0; i < deadLetterLimit+10; i++ {
+		dispatcher.deadLetter(delivery{event: Event{ID: string(rune('a' + i%26))}, attempts: i}, context.Canceled)
+	}
+
+	deadLetters := dispatcher.DeadLetters()
+	if len(deadLetters) != deadLetterLimit {
+		t.Fatalf("expected %d dead letters, got %d", deadLetterLimit, len(deadLetters))
+	}
+	if deadLetters[0].Attempts != 10 {
+		t.Errorf("expected the oldest dead letters to be dropped, the oldest kept has %d attempts", deadLetters[0].Attempts)
+	}
+}
+
+func TestSetSubscriptionsUnderLoad(t *testing.T) {
+	r := newReceiver(t)
+	first, second := r.subscription("first"), r.subscription("second")
+	dispatcher := startDispatcher(t, r, []Subscription{first}, Options{Workers: 4, MaxAttempts: 1})
+
+	const senders, events = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				dispatcher.Send(Event{Type: TenantCreated, Tenant: "team-a"})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < events; j++ {
+			if j%2 == 0 {
+				dispatcher.SetSubscriptions([]Subscription{second})
+			} else {
+				dispatcher.SetSubscriptions([]Subscription{first, second})
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Every event went to one or two subscriptions, depending on the subscriptions when it was sent
+	waitFor(t, "every delivery", func() bool {
+		return len(r.received())+len(dispatcher.DeadLetters()) >= senders*events
+	})
+	for _, delivery := range r.received() {
+		signature := delivery.header.Get(SignatureHeader)
+		if Verify(first.Secret, signature, delivery.body, time.Minute) != nil &&
+			Verify(second.Secret, signature, delivery.body, time.Minute) != nil {
+			t.Fatalf("delivery %s is not signed by a subscription", delivery.event.ID)
+		}
+	}
+
+	dispatcher.SetSubscriptions([]Subscription{second})
+	dispatcher.Send(Event{Type: TenantDeleted, Tenant: "team-a"})
+	deleted := func() []received {
+		var deliveries []received
+		for _, delivery := range r.received() {
+			if delivery.event.Type == TenantDeleted {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		return deliveries
+	}
+	waitFor(t, "the delivery after the subscriptions changed", func() bool { return len(deleted()) > 0 })
+	time.Sleep(20 * time.Millisecond)
+
+	deliveries := deleted()
+	if len(deliveries) != 1 || Verify(second.Secret, deliveries[0].header.Get(SignatureHeader), deliveries[0].body, time.Minute) != nil {
+		t.Errorf("expected one delivery to the second subscription, got %d deliveries", len(deliveries))
+	}
+	if created := len(r.received()) - len(deliveries); created > 2*senders*events {
+		t.Errorf("expected at most %d deliveries of the events, got %d", 2*senders*events, created)
+	}
+}
@@ -9,30 +9,146 @@ type web struct {
 	ReadTimeout     time.Duration `config:"default:5s"`
 	WriteTimeout    time.Duration `config:"default:5s"`
 	ShutdownTimeout time.Duration `config:"default:5s"`
+	// Origins allowed to call the API from a browser, none by default.  "*" allows any origin
+	AllowedOrigins []string `config:"default:"`
 }
 
-// Stores application configuration
-type Config struct {
-	Web web
+type controller struct {
+	// Workers reconciling tenants, and how many of them may be provisioning a tenant at once
+	Workers          int `config:"default:4"`
+	ProvisionWorkers int `config:"default:2"`
+	// Tenants allowed to wait to be provisioned, in total and for a single owner.  Zero is unlimited
+	QueueSize      int           `config:"default:50"`
+	QueuedPerOwner int           `config:"default:5"`
+	ResyncPeriod   time.Duration `config:"default:10m"`
+	// What is left of a tenant whose provisioning fails: keep, rollback (empty the namespace) or delete (the namespace)
+	FailurePolicy string `config:"default:keep"`
+	// Provisioning attempts made before a failed tenant is no longer retried, and the wait before the first retry
+	MaxAttempts  int           `config:"default:3"`
+	RetryBackoff time.Duration `config:"default:30s"`
+	// Time a component is given to become ready, and the time given to single components such as postgresql
+	ReadinessTimeout           time.Duration            `config:"default:3m"`
+	ComponentReadinessTimeouts map[string]time.Duration `config:"default:"`
+}
+
+type auditLog struct {
+	// File audit records are appended to, records are written to stdout when empty
+	Path string `config:"default:"`
+}
+
+type auth struct {
+	// YAML file listing static API keys, API keys are disabled when empty
+	APIKeysFile string `config:"default:"`
+	// JWKS file holding the keys bearer JWTs are signed with, JWTs are disabled when empty
+	JWKSFile     string `config:"default:"`
+	JWTIssuer    string `config:"default:"`
+	JWTAudience  string `config:"default:"`
+	JWTRoleClaim string `config:"default:role"`
+	// Validate Kubernetes tokens with a TokenReview
+	TokenReview          bool     `config:"default:true"`
+	TokenReviewAudiences []string `config:"default:"`
+	// Time a token the TokenReview rejected is rejected without another review, zero reviews it every time
+	TokenReviewRejectedTTL time.Duration `config:"default:10s"`
+	// Role granted to each Kubernetes group
+	GroupRoles map[string]string `config:"default:"`
+	// Method (apikey, jwt or tokenreview) the owners of tenants created before owners were qualified by their method
+	// were authenticated with.  Their owners are qualified with it on startup, and left to admins when empty
+	LegacyOwnerMethod string `config:"default:"`
+}
+
+type blueprints struct {
+	// Directory holding the YAML manifests tenants are provisioned from, the built in blueprint is used when empty
+	Dir string `config:"default:"`
+}
+
+type releases struct {
+	// YAML file holding the release catalogue, the built in catalogue is used when empty
+	File string `config:"default:"`
+	// Images of the release in the built in catalogue
+	Images images
 }
 
-// Read in configuration from environment variables
-func GetConfig() *Config {
+type images struct {
+	PostgreSQL string `config:"default:postgres:12.3-alpine"`
+	Backend    string `config:"default:bennerv/order-meow-api:0.1.0"`
+	Frontend   string `config:"default:bennerv/order-meow-ui:0.1.2"`
+}
 
-	//TODO - Use a better configuration parsing mechanism (github.com/spf13/viper)
-	config := newConfig()
+type tenants struct {
+	// Domain tenants are served under, the frontend of tenant "foo" is served at foo.<domain>
+	Domain string `config:"default:gcp.bennerv.com"`
+	// Size of the postgresql volume of tenants which do not ask for one
+	Storage string `config:"default:5Gi"`
+	// CPU and memory requested by the containers of each component, and their limits, such as backend=100m.
+	// Components left out keep the resources set in the blueprint
+	CPURequests    map[string]string `config:"default:postgresql=50m,backend=100m,frontend=50m"`
+	MemoryRequests map[string]string `config:"default:postgresql=50Mi,backend=250Mi,frontend=50Mi"`
+	CPULimits      map[string]string `config:"default:postgresql=1000m,backend=2000m,frontend=1000m"`
+	MemoryLimits   map[string]string `config:"default:postgresql=250Mi,backend=2Gi,frontend=1Gi"`
+}
+
+type kubernetesConfig struct {
+	// Kubeconfig file used outside a cluster.  When empty the in cluster configuration is tried first, then
+	// $HOME/.kube/config
+	Kubeconfig string `config:"default:"`
+}
+
+type logConfig struct {
+	// Lowest level logged: debug, info, warn or error
+	Level string `config:"default:info"`
+}
+
+type webhooks struct {
+	// YAML file listing webhook subscriptions, no webhooks are sent when empty
+	File    string `config:"default:"`
+	Workers int    `config:"default:2"`
+	// Attempts made before a delivery goes to the dead-letter list, and the wait before the first retry
+	MaxAttempts int           `config:"default:5"`
+	Backoff     time.Duration `config:"default:10s"`
+}
+
+type tracingConfig struct {
+	// Where spans are exported: none, otlp (OTLP/HTTP to Endpoint), stdout or file (JSON lines appended to File)
+	Exporter    string `config:"default:none"`
+	Endpoint    string `config:"default:http://localhost:4318/v1/traces"`
+	File        string `config:"default:traces.json"`
+	ServiceName string `config:"default:saas-provisioner"`
+}
+
+type probes struct {
+	// Time the checks behind a probe are given, keep it below the timeout of the probes in the deployment
+	Timeout time.Duration `config:"default:3s"`
+	// Time the outcome of the permission check is kept, it makes a request for every permission
+	PermissionsInterval time.Duration `config:"default:1m"`
+}
+
+type reload struct {
+	// How often the configuration file, and the blueprint, releases and webhooks files it names, are checked for
+	// changes.  Zero turns reloading off
+	Interval time.Duration `config:"default:10s"`
+}
+
+// Stores application configuration
+type Config struct {
+	Web        web
+	Kubernetes kubernetesConfig
+	Tenants    tenants
+	Controller controller
+	Audit      auditLog
+	Auth       auth
+	Blueprint  blueprints
+	Releases   releases
+	Webhooks   webhooks
+	Log        logConfig
+	Tracing    tracingConfig
+	Probes     probes
+	Reload     reload
 
-	return config
+	// File the configuration was read from, empty when it was not read from a file
+	file string
 }
 
-// Create a new config with defaults
-func newConfig() *Config {
-	return &Config{
-		Web: web{
-			Address:         ":8080",
-			ReadTimeout:     time.Second * 5,
-			WriteTimeout:    time.Second * 5,
-			ShutdownTimeout: time.Second * 5,
-		},
-	}
+// File the configuration was read from, empty when it was not read from a file
+func (c *Config) File() string {
+	return c.file
 }
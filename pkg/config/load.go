@@ -0,0 +1,348 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Prefix of the environment variables setting configuration, such as PROVISIONER_WEB_ADDRESS
+const envPrefix = "PROVISIONER_"
+
+// Environment variable naming the configuration file when the --config flag is not given
+const fileEnv = envPrefix + "CONFIG"
+
+// A single setting, such as Web.ReadTimeout, found by walking the Config struct
+type setting struct {
+	path  []string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// Name of the setting in a configuration file, such as web.readTimeout
+func (s setting) key() string {
+	parts := make([]string, len(s.path))
+	for i, part := range s.path {
+		parts[i] = lowerFirst(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Name of the environment variable setting it, such as PROVISIONER_WEB_READ_TIMEOUT
+func (s setting) env() string {
+	parts := make([]string, len(s.path))
+	for i, part := range s.path {
+		parts[i] = strings.ToUpper(strings.Join(words(part), "_"))
+	}
+	return envPrefix + strings.Join(parts, "_")
+}
+
+// Name of the flag setting it, such as --web.read-timeout
+func (s setting) flag() string {
+	parts := make([]string, len(s.path))
+	for i, part := range s.path {
+		parts[i] = strings.ToLower(strings.Join(words(part), "-"))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Read the configuration, each source overriding the one before it: the defaults in the config struct tags, the YAML
+// file named by --config or $PROVISIONER_CONFIG, environment variables such as PROVISIONER_WEB_ADDRESS and flags such
+// as --web.address.  printConfig is set when --print-config asks for the configuration to be printed rather than run
+func Load(args []string) (cfg *Config, printConfig bool, err error) {
+	cfg = &Config{}
+	settings := settingsOf(cfg)
+	for _, s := range settings {
+		if err := set(s, strings.TrimPrefix(s.field.Tag.Get("config"), "default:")); err != nil {
+			return nil, false, fmt.Errorf("invalid default of %s: %w", s.key(), err)
+		}
+	}
+
+	flags := flag.NewFlagSet("provisioner", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv(fileEnv), "YAML configuration file")
+	flags.BoolVar(&printConfig, "print-config", false, "Print the effective configuration as YAML and exit")
+	values := map[string]*flagValue{}
+	for _, s := range settings {
+		values[s.flag()] = &flagValue{setting: s}
+		flags.Var(values[s.flag()], s.flag(), fmt.Sprintf("%s (%s)", s.key(), s.env()))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if *file != "" {
+		cfg.file = *file
+		if err := loadFile(*file, settings); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env()); ok {
+			if err := set(s, value); err != nil {
+				return nil, false, fmt.Errorf("invalid %s: %w", s.env(), err)
+			}
+		}
+	}
+
+	// Flags were parsed first to find the configuration file, and are applied last
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := values[f.Name]; ok && flagErr == nil {
+			if err := set(value.setting, value.raw); err != nil {
+				flagErr = fmt.Errorf("invalid --%s: %w", f.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, false, flagErr
+	}
+
+	return cfg, printConfig, cfg.Validate()
+}
+
+// A flag of a setting.  Its value is kept as given, and applied once the file and environment have been read
+type flagValue struct {
+	setting setting
+	raw     string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *flagValue) Set(value string) error {
+	f.raw = value
+	return nil
+}
+
+// Flags of boolean settings may be given without a value, --auth.token-review is --auth.token-review=true
+func (f *flagValue) IsBoolFlag() bool {
+	return f.setting.value.Kind() == reflect.Bool
+}
+
+// Read a YAML file of settings, keyed by section then setting such as web: {readTimeout: 10s}.  Keys are matched
+// without regard to case, unknown keys are an error so a misspelt setting is not silently ignored
+func loadFile(path string, settings []setting) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	byKey := map[string]setting{}
+	for _, s := range settings {
+		byKey[strings.ToLower(s.key())] = s
+	}
+
+	var problems []string
+	var walk func(prefix string, values map[string]interface{})
+	walk = func(prefix string, values map[string]interface{}) {
+		for key, value := range values {
+			key = prefix + strings.ToLower(key)
+			s, ok := byKey[key]
+			if !ok {
+				if nested, isMap := value.(map[string]interface{}); isMap {
+					walk(key+".", nested)
+					continue
+				}
+				problems = append(problems, "unknown setting "+key)
+				continue
+			}
+			if err := setValue(s, value); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s: %v", s.key(), err))
+			}
+		}
+	}
+	walk("", document)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("config file %s: %s", path, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Set a setting from a value read from YAML, which may be a list or a map as well as a scalar
+func setValue(s setting, value interface{}) error {
+	switch typed := value.(type) {
+	case nil:
+		return set(s, "")
+	case float64:
+		// YAML numbers are read as floats, whole numbers are written without an exponent so they parse as ints
+		return set(s, strconv.FormatFloat(typed, 'f', -1, 64))
+	case []interface{}:
+		if s.value.Kind() != reflect.Slice {
+			return errors.New("expected a single value")
+		}
+		items := make([]string, len(typed))
+		for i, item := range typed {
+			items[i] = fmt.Sprint(item)
+		}
+		s.value.Set(reflect.ValueOf(items))
+		return nil
+	case map[string]interface{}:
+		if s.value.Kind() != reflect.Map {
+			return errors.New("expected a single value")
+		}
+		var entries []string
+		for key, item := range typed {
+			entries = append(entries, key+"="+fmt.Sprint(item))
+		}
+		return set(s, strings.Join(entries, ","))
+	}
+	return set(s, fmt.Sprint(value))
+}
+
+// Set a setting from a string.  Lists are comma separated, and maps are comma separated key=value pairs
+func set(s setting, value string) error {
+	v := s.value
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		entries := reflect.MakeMap(v.Type())
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			i := strings.Index(entry, "=")
+			if i < 0 {
+				return fmt.Errorf("%q is not a key=value pair", entry)
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := set(setting{value: item}, strings.TrimSpace(entry[i+1:])); err != nil {
+				return err
+			}
+			entries.SetMapIndex(reflect.ValueOf(strings.TrimSpace(entry[:i])), item)
+		}
+		v.Set(entries)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Every setting of the config, in the order they are declared
+func settingsOf(cfg *Config) []setting {
+	var settings []setting
+	var walk func(path []string, v reflect.Value)
+	walk = func(path []string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			// Only exported fields are settings
+			if field.PkgPath != "" {
+				continue
+			}
+			fieldPath := append(append([]string{}, path...), field.Name)
+			if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(fieldPath, v.Field(i))
+				continue
+			}
+			settings = append(settings, setting{path: fieldPath, field: field, value: v.Field(i)})
+		}
+	}
+	walk(nil, reflect.ValueOf(cfg).Elem())
+	return settings
+}
+
+// Write the configuration as a YAML file Load reads back
+func Print(w io.Writer, cfg *Config) error {
+	document := map[string]interface{}{}
+	for _, s := range settingsOf(cfg) {
+		section := document
+		for _, part := range s.path[:len(s.path)-1] {
+			key := lowerFirst(part)
+			if _, ok := section[key]; !ok {
+				section[key] = map[string]interface{}{}
+			}
+			section = section[key].(map[string]interface{})
+		}
+
+		var value interface{} = s.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if m, ok := value.(map[string]time.Duration); ok {
+			durations := map[string]string{}
+			for key, d := range m {
+				durations[key] = d.String()
+			}
+			value = durations
+		}
+		section[lowerFirst(s.path[len(s.path)-1])] = value
+	}
+
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Split a Go name into its words, keeping initialisms together: ReadTimeout is Read Timeout, JWKSFile is JWKS File.
+// A word starts at a capital followed by a lower case letter, so a run of capitals ending a word is part of it and
+// PostgreSQL is one word
+func words(name string) []string {
+	runes := []rune(name)
+	var result []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		beforeLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if unicode.IsUpper(runes[i]) && beforeLower {
+			result = append(result, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(result, string(runes[start:]))
+}
+
+// ReadTimeout as readTimeout and JWKSFile as jwksFile
+func lowerFirst(name string) string {
+	first := words(name)[0]
+	return strings.ToLower(first) + name[len(first):]
+}
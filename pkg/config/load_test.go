@@ -0,0 +1,277 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a configuration file for the test, removed when it ends
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Set environment variables for the test, restoring them when it ends.  The configuration file variable is always
+// cleared so the environment of whoever runs the tests does not leak in
+func setEnv(t *testing.T, env map[string]string) {
+	if _, ok := env[fileEnv]; !ok {
+		env[fileEnv] = ""
+	}
+	for name, value := range env {
+		previous, existed := os.LookupEnv(name)
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+		name := name
+		t.Cleanup(func() {
+			if existed {
+				_ = os.Setenv(name, previous)
+			} else {
+				_ = os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := map[string][]string{
+		"Address":      {"Address"},
+		"ReadTimeout":  {"Read", "Timeout"},
+		"JWKSFile":     {"JWKS", "File"},
+		"APIKeysFile":  {"API", "Keys", "File"},
+		"JWTRoleClaim": {"JWT", "Role", "Claim"},
+		"PostgreSQL":   {"PostgreSQL"},
+		"PostgreSQLDB": {"PostgreSQLDB"},
+		"TLS":          {"TLS"},
+	}
+	for name, expected := range tests {
+		if actual := words(name); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %s to be the words %v, got %v", name, expected, actual)
+		}
+	}
+}
+
+func TestSettingNames(t *testing.T) {
+	tests := []struct {
+		path []string
+		key  string
+		env  string
+		flag string
+	}{
+		{[]string{"Web", "ReadTimeout"}, "web.readTimeout", "PROVISIONER_WEB_READ_TIMEOUT", "web.read-timeout"},
+		{[]string{"Auth", "JWKSFile"}, "auth.jwksFile", "PROVISIONER_AUTH_JWKS_FILE", "auth.jwks-file"},
+		{[]string{"Auth", "APIKeysFile"}, "auth.apiKeysFile", "PROVISIONER_AUTH_API_KEYS_FILE", "auth.api-keys-file"},
+		{[]string{"Releases", "Images", "PostgreSQL"}, "releases.images.postgresql", "PROVISIONER_RELEASES_IMAGES_POSTGRESQL", "releases.images.postgresql"},
+	}
+	for _, test := range tests {
+		s := setting{path: test.path}
+		if s.key() != test.key || s.env() != test.env || s.flag() != test.flag {
+			t.Errorf("expected %v to be %s, %s and --%s, got %s, %s and --%s",
+				test.path, test.key, test.env, test.flag, s.key(), s.env(), s.flag())
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, `
+web:
+  readTimeout: 10s
+  writeTimeout: 10s
+  shutdownTimeout: 10s
+tenants:
+  domain: file.example.com
+releases:
+  images:
+    postgresql: postgres:13
+controller:
+  componentReadinessTimeouts:
+    postgresql: 10m
+`)
+	setEnv(t, map[string]string{
+		"PROVISIONER_WEB_WRITE_TIMEOUT":    "20s",
+		"PROVISIONER_WEB_SHUTDOWN_TIMEOUT": "20s",
+		"PROVISIONER_WEB_ALLOWED_ORIGINS":  "https://a.example.com, https://b.example.com",
+		"PROVISIONER_AUTH_TOKEN_REVIEW":    "false",
+	})
+
+	cfg, printConfig, err := Load([]string{"--config", file, "--auth.token-review", "--web.shutdown-timeout", "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("expected the configuration not to be printed")
+	}
+	if cfg.File() != file {
+		t.Errorf("expected the configuration to be read from %s, got %s", file, cfg.File())
+	}
+
+	tests := []struct {
+		name     string
+		actual   interface{}
+		expected interface{}
+	}{
+		{"default", cfg.Web.Address, ":8080"},
+		{"file over default", cfg.Web.ReadTimeout, 10 * time.Second},
+		{"environment over file", cfg.Web.WriteTimeout, 20 * time.Second},
+		{"flag over environment", cfg.Web.ShutdownTimeout, 30 * time.Second},
+		{"file", cfg.Tenants.Domain, "file.example.com"},
+		{"file key of an initialism", cfg.Releases.Images.PostgreSQL, "postgres:13"},
+		{"environment list", cfg.Web.AllowedOrigins, []string{"https://a.example.com", "https://b.example.com"}},
+		{"file map", cfg.Controller.ComponentReadinessTimeouts, map[string]time.Duration{"postgresql": 10 * time.Minute}},
+		{"boolean flag without a value", cfg.Auth.TokenReview, true},
+		{"default map", cfg.Tenants.CPURequests, map[string]string{"postgresql": "50m", "backend": "100m", "frontend": "50m"}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.actual)
+		}
+	}
+}
+
+func TestLoadFileFromEnvironment(t *testing.T) {
+	file := writeFile(t, "tenants: {domain: env-file.example.com}\n")
+	setEnv(t, map[string]string{fileEnv: file})
+
+	cfg, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tenants.Domain != "env-file.example.com" {
+		t.Errorf("expected the file named by %s to be read, got domain %s", fileEnv, cfg.Tenants.Domain)
+	}
+}
+
+func TestLoadRejectsBadValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// Parts of the error expected
+		errors []string
+	}{
+		{
+			name:   "unknown file setting",
+			file:   "web: {readTimout: 10s}\n",
+			errors: []string{"unknown setting web.readtimout"},
+		},
+		{
+			name:   "every problem in the file",
+			file:   "web: {readTimeout: soon}\ncontroller: {workers: many}\n",
+			errors: []string{"invalid web.readTimeout", "invalid controller.workers"},
+		},
+		{
+			name:   "list for a single value",
+			file:   "tenants: {domain: [a.example.com, b.example.com]}\n",
+			errors: []string{"invalid tenants.domain: expected a single value"},
+		},
+		{
+			name:   "unparseable file",
+			file:   "web: [\n",
+			errors: []string{"failed to parse config file"},
+		},
+		{
+			name:   "environment variable",
+			env:    map[string]string{"PROVISIONER_CONTROLLER_WORKERS": "four"},
+			errors: []string{"invalid PROVISIONER_CONTROLLER_WORKERS"},
+		},
+		{
+			name:   "flag",
+			args:   []string{"--web.read-timeout", "10"},
+			errors: []string{"invalid --web.read-timeout"},
+		},
+		{
+			name:   "unknown flag",
+			args:   []string{"--web.read-timout", "10s"},
+			errors: []string{"flag provided but not defined"},
+		},
+		{
+			name:   "map entry without a key",
+			args:   []string{"--controller.component-readiness-timeouts", "10m"},
+			errors: []string{`"10m" is not a key=value pair`},
+		},
+		{
+			name: "failed validation",
+			env: map[string]string{
+				"PROVISIONER_CONTROLLER_FAILURE_POLICY": "explode",
+				"PROVISIONER_TENANTS_STORAGE":           "lots",
+			},
+			errors: []string{"controller.failurePolicy must be one of", `tenants.storage "lots" is not a valid size`},
+		},
+		{
+			name: "resources",
+			args: []string{"--tenants.cpu-requests", "backend=3", "--tenants.memory-limits", "backend=lots"},
+			errors: []string{
+				"tenants.cpuRequests.backend must not be above its limit",
+				`tenants.memoryLimits.backend "lots" is not a valid quantity`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{}
+			for name, value := range test.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"--config", writeFile(t, test.file)}, args...)
+			}
+
+			_, _, err := Load(args)
+			if err == nil {
+				t.Fatal("expected the configuration to be rejected")
+			}
+			for _, part := range test.errors {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("expected the error to contain %q, got %v", part, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintIsReadBack(t *testing.T) {
+	setEnv(t, map[string]string{})
+	cfg, _, err := Load([]string{
+		"--web.allowed-origins", "https://a.example.com",
+		"--controller.component-readiness-timeouts", "postgresql=10m",
+		"--auth.group-roles", "ops=operator",
+		"--releases.images.postgresql", "postgres:13",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var printed bytes.Buffer
+	if err := Print(&printed, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(printed.String(), "postgresql: postgres:13") {
+		t.Errorf("expected the postgresql image under the postgresql key, got\n%s", printed.String())
+	}
+
+	read, _, err := Load([]string{"--config", writeFile(t, printed.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read.file = cfg.file
+	if !reflect.DeepEqual(read, cfg) {
+		t.Errorf("expected the printed configuration to be read back as\n%+v\ngot\n%+v", cfg, read)
+	}
+}
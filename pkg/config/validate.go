@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"os"
+	"strings"
+	"time"
+)
+
+// Check every setting, returning all the problems found at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		check(d > 0, "%s must be positive", name)
+	}
+	oneOf := func(name string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s must be one of %s", name, strings.Join(allowed, ", ")))
+	}
+
+	check(c.Web.Address != "", "web.address must be set")
+	positive("web.readTimeout", c.Web.ReadTimeout)
+	positive("web.writeTimeout", c.Web.WriteTimeout)
+	positive("web.shutdownTimeout", c.Web.ShutdownTimeout)
+
+	if c.Kubernetes.Kubeconfig != "" {
+		_, err := os.Stat(c.Kubernetes.Kubeconfig)
+		check(err == nil, "kubernetes.kubeconfig: %v", err)
+	}
+
+	errs := validation.IsDNS1123Subdomain(c.Tenants.Domain)
+	check(len(errs) == 0, "tenants.domain %q is not a valid domain: %s", c.Tenants.Domain, strings.Join(errs, ", "))
+	_, err := resource.ParseQuantity(c.Tenants.Storage)
+	check(err == nil, "tenants.storage %q is not a valid size", c.Tenants.Storage)
+	quantities := func(name string, values map[string]string) map[string]resource.Quantity {
+		parsed := map[string]resource.Quantity{}
+		for component, value := range values {
+			q, err := resource.ParseQuantity(value)
+			check(err == nil, "%s.%s %q is not a valid quantity", name, component, value)
+			parsed[component] = q
+		}
+		return parsed
+	}
+	// Kubernetes rejects a container requesting more than its limit
+	atMost := func(name string, requests map[string]resource.Quantity, limits map[string]resource.Quantity) {
+		for component, request := range requests {
+			limit, ok := limits[component]
+			check(!ok || request.Cmp(limit) <= 0, "tenants.%sRequests.%s must not be above its limit", name, component)
+		}
+	}
+	atMost("cpu", quantities("tenants.cpuRequests", c.Tenants.CPURequests), quantities("tenants.cpuLimits", c.Tenants.CPULimits))
+	atMost("memory", quantities("tenants.memoryRequests", c.Tenants.MemoryRequests), quantities("tenants.memoryLimits", c.Tenants.MemoryLimits))
+
+	check(c.Controller.Workers >= 1, "controller.workers must be at least 1")
+	check(c.Controller.ProvisionWorkers >= 1, "controller.provisionWorkers must be at least 1")
+	check(c.Controller.QueueSize >= 0, "controller.queueSize must not be negative")
+	check(c.Controller.QueuedPerOwner >= 0, "controller.queuedPerOwner must not be negative")
+	positive("controller.resyncPeriod", c.Controller.ResyncPeriod)
+	oneOf("controller.failurePolicy", c.Controller.FailurePolicy, "keep", "rollback", "delete")
+	check(c.Controller.MaxAttempts >= 1, "controller.maxAttempts must be at least 1")
+	check(c.Controller.RetryBackoff >= 0, "controller.retryBackoff must not be negative")
+	positive("controller.readinessTimeout", c.Controller.ReadinessTimeout)
+	for component, timeout := range c.Controller.ComponentReadinessTimeouts {
+		positive("controller.componentReadinessTimeouts."+component, timeout)
+	}
+
+	check(c.Auth.JWKSFile == "" || c.Auth.JWTRoleClaim != "", "auth.jwtRoleClaim must be set when auth.jwksFile is")
+	if c.Auth.LegacyOwnerMethod != "" {
+		oneOf("auth.legacyOwnerMethod", c.Auth.LegacyOwnerMethod, "apikey", "jwt", "tokenreview")
+	}
+	check(c.Auth.TokenReviewRejectedTTL >= 0, "auth.tokenReviewRejectedTTL must not be negative")
+	for group, role := range c.Auth.GroupRoles {
+		oneOf("auth.groupRoles."+group, role, "viewer", "operator", "admin")
+	}
+
+	check(c.Webhooks.Workers >= 1, "webhooks.workers must be at least 1")
+	check(c.Webhooks.MaxAttempts >= 1, "webhooks.maxAttempts must be at least 1")
+	check(c.Webhooks.Backoff >= 0, "webhooks.backoff must not be negative")
+
+	oneOf("log.level", c.Log.Level, "trace", "debug", "info", "warn", "warning", "error", "fatal", "panic")
+
+	oneOf("tracing.exporter", c.Tracing.Exporter, "none", "otlp", "stdout", "file")
+	check(c.Tracing.Exporter != "otlp" || c.Tracing.Endpoint != "", "tracing.endpoint must be set for the otlp exporter")
+	check(c.Tracing.Exporter != "file" || c.Tracing.File != "", "tracing.file must be set for the file exporter")
+
+	positive("probes.timeout", c.Probes.Timeout)
+	check(c.Probes.PermissionsInterval >= 0, "probes.permissionsInterval must not be negative")
+
+	check(c.Reload.Interval >= 0, "reload.interval must not be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
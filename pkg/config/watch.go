@@ -0,0 +1,247 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings applied while the provisioner runs, a key ending in a dot covers its whole section.  Changes to any other
+// setting only take effect once the provisioner restarts
+var reloadable = []string{
+	"tenants.",
+	"blueprint.",
+	"releases.",
+	"webhooks.file",
+	"controller.provisionWorkers",
+	"controller.queueSize",
+	"controller.queuedPerOwner",
+	"controller.failurePolicy",
+	"controller.maxAttempts",
+	"controller.retryBackoff",
+	"controller.readinessTimeout",
+	"controller.componentReadinessTimeouts",
+	"log.level",
+}
+
+// Applies a new configuration to the running provisioner, returning why it was rejected.  A rejected configuration
+// must leave the provisioner running as it was
+type ApplyFunc func(cfg *Config) error
+
+// Told the outcome of a reload, such as to log and count it.  The error is nil when the configuration was applied
+type ReportFunc func(status ReloadStatus, err error)
+
+// Outcome of the reloads since the provisioner started
+type ReloadStatus struct {
+	// Configuration file being watched, empty when the configuration was not read from a file
+	File     string `json:"file,omitempty"`
+	Reloads  int    `json:"reloads"`
+	Failures int    `json:"failures"`
+	// When a configuration was last applied
+	LastReload *time.Time `json:"lastReload,omitempty"`
+	// Why the last rejected configuration was rejected, cleared once a configuration is applied
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	// Settings changed since the provisioner started which are only applied when it restarts
+	RestartRequired []string `json:"restartRequired,omitempty"`
+}
+
+// Reads the configuration again when its file, or the blueprint, releases or webhooks files it names, change.  A new
+// configuration is loaded and validated like the first one, from the same flags and environment, then handed to the
+// apply func.  When either fails the provisioner keeps running with the last good configuration, and the configuration
+// is read again at every check until one is applied.  Files are compared by their content, so a ConfigMap mounted as a
+// volume is picked up when the kubelet swaps its files
+type Watcher struct {
+	args   []string
+	apply  ApplyFunc
+	report ReportFunc
+	// Configuration the provisioner started with
+	initial *Config
+
+	// Held while the configuration is read and applied, so reloads never overlap
+	reloading sync.Mutex
+	// Files read for the last configuration applied, and a hash of what they held
+	files       []string
+	fingerprint string
+	// Why the last reload failed, nil once a configuration is applied
+	failure error
+
+	mutex  sync.Mutex
+	status ReloadStatus
+}
+
+// Watch the configuration read by Load from the given arguments, reporting the outcome of every reload to report
+func NewWatcher(args []string, cfg *Config, apply ApplyFunc, report ReportFunc) *Watcher {
+	files := watchedFiles(cfg)
+	return &Watcher{
+		args:        args,
+		apply:       apply,
+		report:      report,
+		initial:     cfg,
+		files:       files,
+		fingerprint: fingerprint(files),
+		status:      ReloadStatus{File: cfg.File()},
+	}
+}
+
+// Check the files for changes every Reload.Interval, until the context is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	if w.initial.Reload.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.initial.Reload.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+// Reload the configuration if any of its files changed since a configuration was last applied, or the last reload
+// failed
+func (w *Watcher) Check() {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	if w.failure != nil || fingerprint(w.files) != w.fingerprint {
+		_ = w.reloadLocked(false)
+	}
+}
+
+// Reload the configuration whether or not its files changed, such as when the provisioner is sent a SIGHUP
+func (w *Watcher) Reload() error {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	return w.reloadLocked(true)
+}
+
+// Read and apply the configuration.  A failing configuration is read again at every check, and is only reported again
+// when it fails in another way or the reload was asked for
+func (w *Watcher) reloadLocked(asked bool) error {
+	cfg, _, err := Load(w.args)
+	var files []string
+	var hash string
+	if err == nil {
+		files = watchedFiles(cfg)
+		hash = fingerprint(files)
+		err = w.apply(cfg)
+	}
+
+	now := time.Now().UTC()
+	if err != nil {
+		repeated := w.failure != nil && w.failure.Error() == err.Error()
+		w.failure = err
+		if repeated && !asked {
+			return err
+		}
+
+		w.mutex.Lock()
+		w.status.Failures++
+		w.status.LastError = err.Error()
+		w.status.LastErrorAt = &now
+		w.mutex.Unlock()
+		w.notify(err)
+		return err
+	}
+
+	// Only a configuration which was applied moves the watcher on, so files which were put back the way they were, or
+	// named for the first time by a rejected configuration, are still read again
+	w.files = files
+	w.fingerprint = hash
+	w.failure = nil
+
+	w.mutex.Lock()
+	w.status.Reloads++
+	w.status.LastReload = &now
+	w.status.LastError = ""
+	w.status.LastErrorAt = nil
+	w.status.RestartRequired = restartRequired(w.initial, cfg)
+	w.mutex.Unlock()
+	w.notify(nil)
+	return nil
+}
+
+func (w *Watcher) notify(err error) {
+	if w.report != nil {
+		w.report(w.Status(), err)
+	}
+}
+
+// Outcome of the reloads so far
+func (w *Watcher) Status() ReloadStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	status := w.status
+	status.RestartRequired = append([]string(nil), w.status.RestartRequired...)
+	return status
+}
+
+// Keys of the settings which differ between two configurations and are not reloadable
+func restartRequired(old *Config, new *Config) []string {
+	oldSettings, newSettings := settingsOf(old), settingsOf(new)
+	var changed []string
+	for i, s := range newSettings {
+		if isReloadable(s.key()) || reflect.DeepEqual(s.value.Interface(), oldSettings[i].value.Interface()) {
+			continue
+		}
+		changed = append(changed, s.key())
+	}
+	return changed
+}
+
+func isReloadable(key string) bool {
+	for _, prefix := range reloadable {
+		if key == prefix || (strings.HasSuffix(prefix, ".") && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Files a configuration is read from: the configuration file and the blueprint, releases and webhooks files it names
+func watchedFiles(cfg *Config) []string {
+	var files []string
+	for _, file := range []string{cfg.File(), cfg.Releases.File, cfg.Webhooks.File} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if cfg.Blueprint.Dir != "" {
+		// Files added to or removed from the blueprint change the matches, not only their content
+		files = append(files, filepath.Join(cfg.Blueprint.Dir, "*.yaml"), filepath.Join(cfg.Blueprint.Dir, "*.yml"))
+	}
+	return files
+}
+
+// Hash of the content of the files, following symbolic links.  Patterns hash every file they match, files which can
+// not be read hash the error so they change when they can be read again
+func fingerprint(files []string) string {
+	h := sha256.New()
+	for _, pattern := range files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || !strings.ContainsAny(pattern, "*?[") {
+			matches = []string{pattern}
+		}
+		sort.Strings(matches)
+		for _, path := range matches {
+			h.Write([]byte(path + "\x00"))
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				data = []byte(err.Error())
+			}
+			h.Write(data)
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// A watcher of a configuration file, recording the outcome of every reload
+type watched struct {
+	file    string
+	watcher *Watcher
+	applied []*Config
+	reports []error
+}
+
+func newWatched(t *testing.T, content string, apply func(cfg *Config) error) *watched {
+	setEnv(t, map[string]string{})
+	w := &watched{file: writeFile(t, content)}
+	args := []string{"--config", w.file}
+	cfg, _, err := Load(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.watcher = NewWatcher(args, cfg, func(cfg *Config) error {
+		if err := apply(cfg); err != nil {
+			return err
+		}
+		w.applied = append(w.applied, cfg)
+		return nil
+	}, func(status ReloadStatus, err error) {
+		w.reports = append(w.reports, err)
+	})
+	return w
+}
+
+func (w *watched) write(t *testing.T, content string) {
+	if err := ioutil.WriteFile(w.file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherAppliesChanges(t *testing.T) {
+	w := newWatched(t, "tenants: {domain: a.example.com}\n", func(*Config) error { return nil })
+
+	w.watcher.Check()
+	if len(w.applied) != 0 || len(w.reports) != 0 {
+		t.Fatalf("expected no reload before the file changed, got %d reports", len(w.reports))
+	}
+
+	w.write(t, "tenants: {domain: b.example.com}\nweb: {address: ':9090'}\n")
+	w.watcher.Check()
+	if len(w.applied) != 1 || w.applied[0].Tenants.Domain != "b.example.com" {
+		t.Fatalf("expected the changed configuration to be applied, got %d configurations", len(w.applied))
+	}
+	status := w.watcher.Status()
+	if status.Reloads != 1 || status.Failures != 0 || status.File != w.file {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(status.RestartRequired) != 1 || status.RestartRequired[0] != "web.address" {
+		t.Errorf("expected web.address to need a restart, got %v", status.RestartRequired)
+	}
+
+	w.watcher.Check()
+	if len(w.applied) != 1 {
+		t.Errorf("expected no reload once the change was applied, got %d configurations", len(w.applied))
+	}
+}
+
+func TestWatcherRetriesRejectedConfiguration(t *testing.T) {
+	good := "tenants: {domain: a.example.com}\n"
+	w := newWatched(t, good, func(*Config) error { return nil })
+
+	w.write(t, "tenants: {domain: 'not a domain'}\n")
+	w.watcher.Check()
+	w.watcher.Check()
+	if len(w.reports) != 1 || w.reports[0] == nil {
+		t.Fatalf("expected the rejected configuration to be reported once, got %v", w.reports)
+	}
+	status := w.watcher.Status()
+	if status.Failures != 1 || !strings.Contains(status.LastError, "tenants.domain") || status.LastErrorAt == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Putting the file back the way it was applies it again, clearing the error
+	w.write(t, good)
+	w.watcher.Check()
+	if len(w.applied) != 1 || len(w.reports) != 2 || w.reports[1] != nil {
+		t.Fatalf("expected the restored configuration to be applied, got reports %v", w.reports)
+	}
+	if status := w.watcher.Status(); status.LastError != "" || status.Reloads != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestWatcherRetriesConfigurationItCouldNotApply(t *testing.T) {
+	var reject error = errors.New("release catalogue is missing releases tenants use: 1.0.0")
+	w := newWatched(t, "tenants: {domain: a.example.com}\n", func(*Config) error { return reject })
+
+	w.write(t, "tenants: {domain: b.example.com}\n")
+	w.watcher.Check()
+	if len(w.reports) != 1 || w.reports[0] != reject {
+		t.Fatalf("expected the configuration to be rejected, got %v", w.reports)
+	}
+
+	// Nothing changed in the files, but what made the configuration fail did
+	reject = nil
+	w.watcher.Check()
+	if len(w.applied) != 1 || w.applied[0].Tenants.Domain != "b.example.com" {
+		t.Errorf("expected the configuration to be applied once it could be, got %d configurations", len(w.applied))
+	}
+}
+
+func TestWatcherReloadReportsRepeatedFailures(t *testing.T) {
+	w := newWatched(t, "tenants: {domain: a.example.com}\n", func(*Config) error { return nil })
+
+	w.write(t, "tenants: {domain: 'not a domain'}\n")
+	w.watcher.Check()
+	if err := w.watcher.Reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if len(w.reports) != 2 || w.watcher.Status().Failures != 2 {
+		t.Errorf("expected a reload which was asked for to be reported, got %v", w.reports)
+	}
+}